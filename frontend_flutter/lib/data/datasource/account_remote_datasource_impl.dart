@@ -10,6 +10,16 @@ import 'package:http/http.dart' as http;
 
 const String _baseUrl = "http://192.168.5.10:8080";
 
+// Currency of the account opened at registration, which deposits and withdrawals use
+const String _currency = "USD";
+
+// Amounts are entered in whole units; the server takes money as a decimal string plus
+// a currency code
+Map<String, String> _money(int amount) => {
+  'amount': amount.toString(),
+  'currency': _currency,
+};
+
 class AccountRemoteDatasourceImpl implements AccountRemoteDatasource {
   final TokenService _tokenService;
 
@@ -57,7 +67,7 @@ class AccountRemoteDatasourceImpl implements AccountRemoteDatasource {
           url,
           headers: headers,
           body: jsonEncode({
-            'amount': amount
+            'amount': _money(amount)
           })
       ).timeout(const Duration(seconds: 15));
 
@@ -91,7 +101,7 @@ class AccountRemoteDatasourceImpl implements AccountRemoteDatasource {
         url,
         headers: headers,
         body: jsonEncode({
-          'amount': amount
+          'amount': _money(amount)
         }),
       ).timeout(const Duration(seconds: 15));
 
@@ -1,17 +1,21 @@
-
 class Account{
   final String id;
   final String? name;
-  final int balance;
+  // decimal amount in major units as sent by the server, e.g. "12.34"
+  final String balance;
+  final String currency;
 
-  Account({required this.id, required this.name, required this.balance});
+  Account({required this.id, required this.name, required this.balance, required this.currency});
 
   // create Account instance from JSON data
+  // the balance is a money object: {"amount": "12.34", "currency": "USD"}
   factory Account.fromJSON(Map<String, dynamic> json){
+    final balance = json['balance'] as Map<String, dynamic>;
     return Account(
         id: json['accountId'].toString(),
         name: json['name'] as String? ?? 'Unknown',
-        balance: json['balance'] as int,
+        balance: balance['amount'] as String,
+        currency: balance['currency'] as String,
     );
   }
 
@@ -19,7 +23,7 @@ class Account{
     return {
       'id' : id,
       'name' : name,
-      'balance' : balance,
+      'balance' : {'amount': balance, 'currency': currency},
     };
   }
-}
\ No newline at end of file
+}
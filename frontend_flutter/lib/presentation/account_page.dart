@@ -107,7 +107,7 @@ class _AccountPageState extends State<AccountPage> {
                                 // Balance
                                 _InfoRow(
                                   label: 'Current Balance',
-                                  value: '\$${account.balance}',
+                                  value: '${account.balance} ${account.currency}',
                                   valueStyle: Theme.of(context)
                                       .textTheme
                                       .headlineSmall
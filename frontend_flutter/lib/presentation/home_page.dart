@@ -204,7 +204,7 @@ class _AccountContent extends StatelessWidget {
                         ),
                         const SizedBox(height: 4),
                         Text(
-                          '\$${account.balance}',
+                          '${account.balance} ${account.currency}',
                           style: Theme.of(context).textTheme.headlineSmall?.copyWith(
                                 fontWeight: FontWeight.bold,
                                 color: Colors.white,
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"server/internal/config"
+	"server/internal/models"
+	"server/internal/store"
+
+	"gorm.io/gorm"
+)
+
+// adminUsage describes the arguments of the admin subcommand
+const adminUsage = `usage: %s admin <command>
+
+commands:
+  grant <userId>  grant the admin role to an existing user
+`
+
+// runAdmin manages operators directly in the configured database, to create the first
+// admin before anyone can use the admin API, and returns the exit code of the process
+func runAdmin(cfg config.DBConfig, args []string) int {
+	if len(args) != 2 || args[0] != "grant" || args[1] == "" {
+		fmt.Fprintf(os.Stderr, adminUsage, os.Args[0])
+		return 2
+	}
+	userID := args[1]
+
+	if err := cfg.Validate(); err != nil {
+		log.Printf("Invalid configuration: %v", err)
+		return 1
+	}
+	ctx := context.Background()
+	db, err := store.InitDB(ctx, cfg)
+	if errors.Is(err, store.ErrSchemaBehind) {
+		log.Printf("Failed to open database: %v; run \"%s migrate up\" first", err, os.Args[0])
+		return 1
+	}
+	if err != nil {
+		log.Printf("Failed to open database: %v", err)
+		return 1
+	}
+	defer db.Close()
+
+	err = db.GrantRole(ctx, userID, models.RoleAdmin)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("User %s does not exist; register it first", userID)
+		return 1
+	}
+	if err != nil {
+		log.Printf("Failed to grant admin role to %s: %v", userID, err)
+		return 1
+	}
+	log.Printf("Granted admin role to %s", userID)
+	return 0
+}
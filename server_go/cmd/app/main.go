@@ -3,7 +3,10 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,8 +15,12 @@ import (
 
 	"github.com/go-chi/chi"
 	chimiddleware "github.com/go-chi/chi/middleware"
+	"server/internal/auth"
 	"server/internal/config"
+	"server/internal/fx"
 	"server/internal/handler"
+	"server/internal/metrics"
+	"server/internal/notify"
 	"server/internal/store"
 )
 
@@ -21,12 +28,86 @@ import (
 func main() {
 	// Load configuration from environment variables
 	cfg := config.Load()
-	
-	// Initialize SQLite database
-	db, err := store.InitDB(cfg.DB.Path)
+
+	// "migrate" manages the database schema and "admin" the operators instead of serving requests
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(cfg.DB, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(runAdmin(cfg.DB, os.Args[2:]))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// Structured logging; the log package is routed through the same handler
+	logger := newLogger(cfg.Log)
+	slog.SetDefault(logger)
+
+	// Configure token signing; rotated-out keys stay valid for verification
+	keys, err := loadSigningKeys(cfg.Auth)
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+	encryptionKey, err := loadEncryptionKey(cfg.Auth)
+	if err != nil {
+		log.Fatalf("Failed to load encryption key: %v", err)
+	}
+	auth.Configure(auth.Settings{
+		Keys:            keys,
+		Issuer:          cfg.Auth.Issuer,
+		Audience:        cfg.Auth.Audience,
+		AccessTokenTTL:  time.Duration(cfg.Auth.AccessTokenTTL) * time.Second,
+		RefreshTokenTTL: time.Duration(cfg.Auth.RefreshTokenTTL) * time.Second,
+		EncryptionKey:   encryptionKey,
+	})
+
+	// Open the configured database
+	db, err := store.InitDB(context.Background(), cfg.DB)
+	if errors.Is(err, store.ErrSchemaBehind) {
+		log.Fatalf("Failed to initialize database: %v; run \"%s migrate up\" first", err, os.Args[0])
+	}
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
+	defer db.Close()
+
+	// Load exchange rates; the server can run without them, but cross-currency transfers will fail
+	rates := fx.NewTable()
+	if err := loadRates(context.Background(), db, rates, cfg.FX.RatesFile); err != nil {
+		log.Fatalf("Failed to load FX rates: %v", err)
+	}
+
+	// Bootstrap the first operators from existing users; once an admin exists, roles are
+	// only changed over the admin API or with "admin grant"
+	if len(cfg.Auth.AdminUserIDs) > 0 {
+		granted, err := db.BootstrapAdmins(context.Background(), cfg.Auth.AdminUserIDs)
+		if err != nil {
+			log.Fatalf("Failed to bootstrap admins: %v", err)
+		}
+		for _, userID := range granted {
+			log.Printf("Granted admin role to %s", userID)
+		}
+	}
+
+	// Restore revoked access tokens so that logouts survive a restart
+	revocations := auth.NewRevocations(db)
+	if err := revocations.Load(context.Background()); err != nil {
+		log.Fatalf("Failed to load token revocations: %v", err)
+	}
+
+	passwords, err := auth.LoadPasswordPolicy(cfg.Password.MinLength, cfg.Password.BreachedFile)
+	if err != nil {
+		log.Fatalf("Failed to load breached password list: %v", err)
+	}
+	if cfg.Password.BreachedFile != "" {
+		log.Printf("Loaded %d breached passwords from %s", passwords.BreachedCount(), cfg.Password.BreachedFile)
+	}
+	notifier, err := notify.New(cfg.Notify.Kind, cfg.Notify.File)
+	if err != nil {
+		log.Fatalf("Failed to set up notifier: %v", err)
+	}
 
 	// Create a new chi router for handling HTTP requests
 	r := chi.NewRouter()
@@ -35,7 +116,7 @@ func main() {
 	r.Use(chimiddleware.StripSlashes)
 
 	// Register all routes with database
-	handler.Routes(r, db)
+	handler.Routes(r, db, cfg, rates, revocations, passwords, notifier, logger)
 
 	// Configure the HTTP server
 	server := &http.Server{
@@ -47,6 +128,68 @@ func main() {
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	// Metrics are served on their own address, so that they can be kept off the public network
+	var metricsServer *http.Server
+	if cfg.Server.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsServer = &http.Server{
+			Addr:         cfg.Server.MetricsAddr,
+			Handler:      mux,
+			ReadTimeout:  time.Duration(cfg.Server.ReadTimeout) * time.Second,
+			WriteTimeout: time.Duration(cfg.Server.WriteTimeout) * time.Second,
+			IdleTimeout:  time.Duration(cfg.Server.IdleTimeout) * time.Second,
+		}
+	}
+
+	// Background maintenance runs until shutdown begins
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	purgeInterval := time.Duration(cfg.Idempotency.PurgeInterval) * time.Second
+	go runPeriodically(bgCtx, purgeInterval, func(ctx context.Context) {
+		if n, err := db.PurgeExpiredIdempotencyKeys(ctx); err != nil {
+			log.Printf("Failed to purge idempotency keys: %v", err)
+		} else if n > 0 {
+			log.Printf("Purged %d expired idempotency keys", n)
+		}
+		if n, err := db.PurgeExpiredRefreshTokens(ctx); err != nil {
+			log.Printf("Failed to purge refresh tokens: %v", err)
+		} else if n > 0 {
+			log.Printf("Purged %d expired refresh tokens", n)
+		}
+		if n, err := db.PurgeExpiredPasswordResetTokens(ctx); err != nil {
+			log.Printf("Failed to purge password reset tokens: %v", err)
+		} else if n > 0 {
+			log.Printf("Purged %d expired password reset tokens", n)
+		}
+		if n, err := revocations.Purge(ctx); err != nil {
+			log.Printf("Failed to purge token revocations: %v", err)
+		} else if n > 0 {
+			log.Printf("Purged %d expired token revocations", n)
+		}
+	})
+
+	// Other instances write their revocations to the same table; reload it so that a
+	// logout or password change takes effect everywhere within the refresh interval
+	refreshInterval := time.Duration(cfg.Auth.RevocationRefresh) * time.Second
+	go runPeriodically(bgCtx, refreshInterval, func(ctx context.Context) {
+		if err := revocations.Load(ctx); err != nil {
+			log.Printf("Failed to refresh token revocations: %v", err)
+		}
+	})
+
+	// Admins replace the rates on one instance; the others pick them up from the database
+	ratesInterval := time.Duration(cfg.FX.RatesRefresh) * time.Second
+	go runPeriodically(bgCtx, ratesInterval, func(ctx context.Context) {
+		stored, err := db.ListFXRates(ctx)
+		if err == nil {
+			err = rates.Replace(stored)
+		}
+		if err != nil {
+			log.Printf("Failed to refresh FX rates: %v", err)
+		}
+	})
+
 	// Create a channel to receive OS signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -58,10 +201,19 @@ func main() {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
+	if metricsServer != nil {
+		go func() {
+			log.Printf("Metrics server started on %s", cfg.Server.MetricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Metrics server error: %v", err)
+			}
+		}()
+	}
 
 	// Wait for shutdown signal
 	sig := <-sigChan
 	log.Printf("\nReceived signal: %v, starting graceful shutdown...", sig)
+	stopBackground()
 
 	// Create a context with 10-second timeout for graceful shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -71,6 +223,100 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		log.Fatalf("Graceful shutdown failed: %v", err)
 	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			log.Fatalf("Metrics server shutdown failed: %v", err)
+		}
+	}
 
 	log.Println("Server gracefully shut down")
 }
+
+// newLogger creates the logger writing to stderr in the configured format and level
+// The settings have been checked by config.Validate
+func newLogger(cfg config.LogConfig) *slog.Logger {
+	level, _ := cfg.ParseLevel()
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == config.LogFormatText {
+		return slog.New(slog.NewTextHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+}
+
+// loadSigningKeys returns the key set configured for signing tokens
+// A secret set next to a key file only verifies the tokens it signed before the switch
+// Without a key file or secret (only allowed outside production) a random secret is
+// generated, so tokens do not survive a restart
+func loadSigningKeys(cfg config.AuthConfig) (*auth.KeySet, error) {
+	if cfg.SigningKeyFile != "" {
+		keys, err := auth.LoadKeySet(cfg.SigningKeyFile, cfg.VerificationKeyFiles)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Secret != "" {
+			keys.AcceptHMAC([]byte(cfg.Secret))
+		}
+		return keys, nil
+	}
+	if cfg.Secret != "" {
+		return auth.NewHMACKeySet([]byte(cfg.Secret)), nil
+	}
+
+	slog.Warn("JWT_SECRET is not set; using a random secret, tokens will be invalid after a restart")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return auth.NewHMACKeySet(secret), nil
+}
+
+// loadEncryptionKey returns the key protecting secrets at rest
+// Without a configured key (only allowed outside production) a random key is generated,
+// so secrets stored by one run, such as TOTP enrollments, cannot be read by the next
+func loadEncryptionKey(cfg config.AuthConfig) ([]byte, error) {
+	if cfg.EncryptionKey != "" {
+		return cfg.DecodeEncryptionKey()
+	}
+
+	slog.Warn("AUTH_ENCRYPTION_KEY is not set; using a random key, 2FA enrollments will be unusable after a restart")
+	key := make([]byte, auth.EncryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadRates fills the rate table from the database
+// While the database has no rates, they are taken from the rates file and stored, so
+// that the file seeds a new deployment; later changes go through PUT /admin/fx/rates
+func loadRates(ctx context.Context, db store.Repository, rates *fx.Table, path string) error {
+	stored, err := db.ListFXRates(ctx)
+	if err != nil {
+		return err
+	}
+	if len(stored) > 0 {
+		return rates.Replace(stored)
+	}
+	if err := rates.LoadFile(path); err != nil {
+		log.Printf("FX rates not loaded from %s: %v", path, err)
+		return nil
+	}
+	return db.ReplaceFXRates(ctx, rates.Rates())
+}
+
+// runPeriodically calls fn every interval until ctx is cancelled
+func runPeriodically(ctx context.Context, interval time.Duration, fn func(context.Context)) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn(ctx)
+		}
+	}
+}
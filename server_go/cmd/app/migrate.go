@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"server/internal/config"
+	"server/internal/store"
+)
+
+// migrateUsage describes the arguments of the migrate subcommand
+const migrateUsage = `usage: %s migrate <command>
+
+commands:
+  up        apply every pending migration
+  down [N]  roll back the latest N applied migrations (default 1)
+  status    list the migrations and when they were applied
+`
+
+// runMigrate applies, rolls back or lists the schema migrations of the configured
+// database and returns the exit code of the process
+func runMigrate(cfg config.DBConfig, args []string) int {
+	if len(args) == 0 || (args[0] != "down" && len(args) > 1) || len(args) > 2 {
+		fmt.Fprintf(os.Stderr, migrateUsage, os.Args[0])
+		return 2
+	}
+	steps := 1
+	if args[0] == "down" && len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, migrateUsage, os.Args[0])
+			return 2
+		}
+		steps = n
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Printf("Invalid configuration: %v", err)
+		return 1
+	}
+	db, err := store.Open(cfg)
+	if err != nil {
+		log.Printf("Failed to open database: %v", err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(ctx)
+		for _, m := range applied {
+			log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Printf("Migration failed: %v", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			log.Printf("Schema is up to date")
+		}
+
+	case "down":
+		rolledBack, err := db.MigrateDown(ctx, steps)
+		for _, m := range rolledBack {
+			log.Printf("Rolled back migration %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Printf("Rollback failed: %v", err)
+			return 1
+		}
+		if len(rolledBack) == 0 {
+			log.Printf("No migrations are applied")
+		}
+
+	case "status":
+		states, err := db.MigrationStatus(ctx)
+		if err != nil {
+			log.Printf("Failed to read migration status: %v", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, state := range states {
+			applied := "pending"
+			if state.AppliedAt != nil {
+				applied = state.AppliedAt.UTC().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", state.Version, state.Name, applied)
+		}
+		w.Flush()
+
+	default:
+		fmt.Fprintf(os.Stderr, migrateUsage, os.Args[0])
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// EncryptionKeySize is the size of the key protecting secrets at rest (AES-256)
+const EncryptionKeySize = 32
+
+// ErrDecrypt is returned when a stored secret cannot be decrypted with the configured key
+var ErrDecrypt = errors.New("failed to decrypt secret")
+
+// EncryptSecret encrypts a secret for storage with the configured encryption key
+// context (e.g. the user ID) is authenticated but not stored, so a ciphertext copied to
+// another record fails to decrypt
+func EncryptSecret(plaintext, context string) (string, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(context))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret reverses EncryptSecret
+func DecryptSecret(ciphertext, context string) (string, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", ErrDecrypt
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(context))
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plaintext), nil
+}
+
+// secretCipher returns AES-GCM keyed with the configured encryption key
+func secretCipher() (cipher.AEAD, error) {
+	key := current().EncryptionKey
+	if len(key) != EncryptionKeySize {
+		return nil, ErrNotConfigured
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
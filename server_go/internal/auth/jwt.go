@@ -2,47 +2,135 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
+// ErrNotConfigured is returned when keys are used before Configure is called
+var ErrNotConfigured = errors.New("signing or encryption keys are not configured")
+
+// ChallengeTokenTTL is how long a user has to complete the second login step
+const ChallengeTokenTTL = 5 * time.Minute
+
+// challengeAudienceSuffix distinguishes challenge tokens from access tokens, so that a
+// challenge token is never accepted where an access token is required
+const challengeAudienceSuffix = "/2fa"
+
 // JWTClaims represents the claims stored in a JWT token
 type JWTClaims struct {
-	UserID string `json:"userID"`
+	UserID string   `json:"userID"`
+	Roles  []string `json:"roles,omitempty"`
 	jwt.RegisteredClaims
 }
 
-var jwtSecret []byte
+// Settings control how tokens are signed and verified
+type Settings struct {
+	Keys            *KeySet
+	Issuer          string        // "iss" claim set on and required of access tokens
+	Audience        string        // "aud" claim set on and required of access tokens
+	AccessTokenTTL  time.Duration // lifetime of access tokens; clients renew them with a refresh token
+	RefreshTokenTTL time.Duration // how long a refresh token can be exchanged for new tokens
+	EncryptionKey   []byte        // AES-256 key protecting secrets at rest, such as TOTP secrets
+}
+
+// defaultSettings apply until Configure is called; without keys no token can be issued
+var defaultSettings = Settings{
+	AccessTokenTTL:  15 * time.Minute,
+	RefreshTokenTTL: 30 * 24 * time.Hour,
+}
+
+var settings atomic.Pointer[Settings]
+
+// Configure replaces the settings used to sign and verify tokens
+// It is called once at startup, before the server accepts requests
+func Configure(s Settings) {
+	settings.Store(&s)
+}
 
-// init initializes the JWT secret from environment variable or uses default
-func init() {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "max03"
+// current returns the active settings
+func current() *Settings {
+	if s := settings.Load(); s != nil {
+		return s
 	}
-	jwtSecret = []byte(secret)
+	return &defaultSettings
+}
+
+// Keys returns the key set used to sign and verify tokens
+func Keys() *KeySet {
+	return current().Keys
+}
+
+// AccessTokenTTL returns the lifetime of access tokens
+func AccessTokenTTL() time.Duration {
+	return current().AccessTokenTTL
+}
+
+// RefreshTokenTTL returns the lifetime of refresh tokens
+func RefreshTokenTTL() time.Duration {
+	return current().RefreshTokenTTL
+}
+
+// GenerateJWT creates a new short-lived access token for a user with the given roles (see AccessTokenTTL)
+// Token is self-contained; its unique ID (jti) allows revoking it before it expires
+func GenerateJWT(userID string, roles []string) (string, error) {
+	s := current()
+	return signToken(s, userID, roles, s.Audience, s.AccessTokenTTL)
+}
+
+// VerifyJWT validates a JWT token and returns the claims if valid
+// The token must be unexpired and carry the configured issuer and audience
+// Does not require database lookup; revocation is checked separately (see Revocations)
+func VerifyJWT(tokenString string) (*JWTClaims, error) {
+	s := current()
+	return verifyToken(s, tokenString, s.Audience)
+}
+
+// GenerateChallengeToken creates a token proving that a user with two-factor
+// authentication passed the password step; it cannot be used as an access token
+func GenerateChallengeToken(userID string) (string, error) {
+	s := current()
+	return signToken(s, userID, nil, s.Audience+challengeAudienceSuffix, ChallengeTokenTTL)
+}
+
+// VerifyChallengeToken validates a token created by GenerateChallengeToken
+func VerifyChallengeToken(tokenString string) (*JWTClaims, error) {
+	s := current()
+	return verifyToken(s, tokenString, s.Audience+challengeAudienceSuffix)
 }
 
-// GenerateJWT creates a new JWT token for a user with 24 hour expiration
-// Token is self-contained and does not require database storage
-func GenerateJWT(userID string) (string, error) {
+// signToken creates a token for userID with the given roles, audience and lifetime
+func signToken(s *Settings, userID string, roles []string, audience string, ttl time.Duration) (string, error) {
+	if s.Keys == nil {
+		return "", ErrNotConfigured
+	}
+
 	now := time.Now()
-	expiresAt := now.Add(24 * time.Hour)
+	expiresAt := now.Add(ttl)
 
 	claims := JWTClaims{
 		UserID: userID,
+		Roles:  roles,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    s.Issuer,
+			Audience:  jwt.ClaimStrings{audience},
 			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
+	key := s.Keys.signing
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	tokenString, err := token.SignedString(key.signer)
 	if err != nil {
 		return "", fmt.Errorf("failed to sign token: %w", err)
 	}
@@ -50,18 +138,30 @@ func GenerateJWT(userID string) (string, error) {
 	return tokenString, nil
 }
 
-// VerifyJWT validates a JWT token and returns the claims if valid
-// Does not require database lookup (stateless authentication)
-func VerifyJWT(tokenString string) (*JWTClaims, error) {
+// verifyToken validates a token and requires the given audience
+func verifyToken(s *Settings, tokenString, audience string) (*JWTClaims, error) {
+	if s.Keys == nil {
+		return nil, ErrNotConfigured
+	}
 	claims := &JWTClaims{}
 
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		// Verify signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		// The key is chosen by the "kid" header; tokens without one need the HMAC key
+		kid, _ := token.Header["kid"].(string)
+		key, err := s.Keys.verificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// Verify signing method, so that a public key is never used as an HMAC secret
+		if token.Method.Alg() != key.Method.Alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return jwtSecret, nil
-	})
+		return key.public, nil
+	},
+		jwt.WithIssuer(s.Issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+	)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
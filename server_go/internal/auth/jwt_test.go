@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testSecret signs the tokens of configureTest
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// configureTest makes the package sign and verify with testSecret until the test ends
+func configureTest(t *testing.T) {
+	t.Helper()
+	previous := settings.Load()
+	t.Cleanup(func() { settings.Store(previous) })
+	s := keySettings(NewHMACKeySet(testSecret))
+	Configure(*s)
+}
+
+func TestVerifyJWTClaims(t *testing.T) {
+	configureTest(t)
+
+	tests := []struct {
+		name   string
+		change func(*JWTClaims)
+		err    error // expected error, checked with errors.Is; nil if the token is valid
+	}{
+		{
+			name:   "valid",
+			change: func(*JWTClaims) {},
+		},
+		{
+			name:   "wrong issuer",
+			change: func(c *JWTClaims) { c.Issuer = "other-api" },
+			err:    jwt.ErrTokenInvalidIssuer,
+		},
+		{
+			name:   "missing issuer",
+			change: func(c *JWTClaims) { c.Issuer = "" },
+			err:    jwt.ErrTokenRequiredClaimMissing,
+		},
+		{
+			name:   "wrong audience",
+			change: func(c *JWTClaims) { c.Audience = jwt.ClaimStrings{"other-api"} },
+			err:    jwt.ErrTokenInvalidAudience,
+		},
+		{
+			name:   "challenge audience",
+			change: func(c *JWTClaims) { c.Audience = jwt.ClaimStrings{"bank-api" + challengeAudienceSuffix} },
+			err:    jwt.ErrTokenInvalidAudience,
+		},
+		{
+			name:   "missing audience",
+			change: func(c *JWTClaims) { c.Audience = nil },
+			err:    jwt.ErrTokenRequiredClaimMissing,
+		},
+		{
+			name:   "missing expiry",
+			change: func(c *JWTClaims) { c.ExpiresAt = nil },
+			err:    jwt.ErrTokenRequiredClaimMissing,
+		},
+		{
+			name:   "expired",
+			change: func(c *JWTClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) },
+			err:    jwt.ErrTokenExpired,
+		},
+		{
+			name:   "not valid yet",
+			change: func(c *JWTClaims) { c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour)) },
+			err:    jwt.ErrTokenNotValidYet,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			tt.change(&claims)
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testSecret)
+			if err != nil {
+				t.Fatalf("SignedString: %v", err)
+			}
+
+			got, err := VerifyJWT(token)
+			if tt.err == nil {
+				if err != nil {
+					t.Fatalf("VerifyJWT: %v", err)
+				}
+				if got.UserID != "alice" {
+					t.Errorf("user = %q, want alice", got.UserID)
+				}
+				return
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("VerifyJWT = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestChallengeTokensAreNotAccessTokens(t *testing.T) {
+	configureTest(t)
+
+	access, err := GenerateJWT("alice", []string{"admin"})
+	if err != nil {
+		t.Fatalf("GenerateJWT: %v", err)
+	}
+	challenge, err := GenerateChallengeToken("alice")
+	if err != nil {
+		t.Fatalf("GenerateChallengeToken: %v", err)
+	}
+
+	claims, err := VerifyJWT(access)
+	if err != nil {
+		t.Fatalf("VerifyJWT: %v", err)
+	}
+	if claims.UserID != "alice" || len(claims.Roles) != 1 || claims.Roles[0] != "admin" || claims.ID == "" {
+		t.Errorf("claims = %+v, want alice with the admin role and a token ID", claims)
+	}
+	if _, err := VerifyChallengeToken(challenge); err != nil {
+		t.Fatalf("VerifyChallengeToken: %v", err)
+	}
+	if _, err := VerifyJWT(challenge); !errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		t.Errorf("VerifyJWT(challenge token) = %v, want an audience error", err)
+	}
+	if _, err := VerifyChallengeToken(access); !errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		t.Errorf("VerifyChallengeToken(access token) = %v, want an audience error", err)
+	}
+}
+
+func TestTokensNeedKeys(t *testing.T) {
+	previous := settings.Load()
+	t.Cleanup(func() { settings.Store(previous) })
+	Configure(Settings{Issuer: "bank-api", Audience: "bank-api"})
+
+	if _, err := GenerateJWT("alice", nil); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("GenerateJWT = %v, want ErrNotConfigured", err)
+	}
+	if _, err := VerifyJWT("a.b.c"); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("VerifyJWT = %v, want ErrNotConfigured", err)
+	}
+}
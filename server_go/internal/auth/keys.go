@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minRSABits is the smallest RSA modulus accepted for signing or verification
+const minRSABits = 2048
+
+// ErrUnknownKey is returned when a token names a key that is not in the key set
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// Key is a single key used to sign or verify tokens
+// ID is the "kid" header of tokens signed with it; HMAC keys have no ID
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	signer any // private key or secret; nil for verification-only keys
+	public any // public key or secret
+}
+
+// KeySet holds the key new tokens are signed with and every key tokens may be verified with
+// Rotating keys means signing with a new key while the previous public keys stay in the
+// verification set until the tokens they signed have expired
+type KeySet struct {
+	signing      *Key
+	verification map[string]*Key
+}
+
+// NewHMACKeySet creates a key set that signs and verifies tokens with a shared secret
+// HMAC keys are never published, so the JWKS of such a set is empty
+func NewHMACKeySet(secret []byte) *KeySet {
+	key := &Key{Method: jwt.SigningMethodHS256, signer: secret, public: secret}
+	return &KeySet{signing: key, verification: map[string]*Key{key.ID: key}}
+}
+
+// LoadKeySet reads the signing private key and any additional verification keys from PEM files
+// Verification files may hold public or private keys; only the public part is used
+func LoadKeySet(signingKeyFile string, verificationKeyFiles []string) (*KeySet, error) {
+	signing, err := loadKey(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if signing.signer == nil {
+		return nil, fmt.Errorf("%s: signing key must be a private key", signingKeyFile)
+	}
+
+	ks := &KeySet{signing: signing, verification: map[string]*Key{signing.ID: signing}}
+	for _, path := range verificationKeyFiles {
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, err
+		}
+		key.signer = nil
+		ks.verification[key.ID] = key
+	}
+	return ks, nil
+}
+
+// AcceptHMAC adds a verification-only HMAC secret, so that tokens signed with the secret
+// before a switch to key files stay valid until they expire
+// Such tokens carry no "kid" header; the signing method check keeps the secret from
+// verifying anything but HS256 tokens
+func (ks *KeySet) AcceptHMAC(secret []byte) {
+	ks.verification[""] = &Key{Method: jwt.SigningMethodHS256, public: secret}
+}
+
+// loadKey reads a single RSA or Ed25519 key from a PEM file
+func loadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// parseKeyPEM decodes a PKCS#8, PKCS#1 or PKIX encoded key
+func parseKeyPEM(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{public: parsed}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.signer = signer
+		key.public = signer.Public()
+	}
+
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA key must be at least %d bits", minRSABits)
+		}
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key.public)
+	}
+
+	key.ID = thumbprint(publicJWK(key.public))
+	return key, nil
+}
+
+// verificationKey returns the key a token with the given "kid" header must verify against
+func (ks *KeySet) verificationKey(kid string) (*Key, error) {
+	key, ok := ks.verification[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public verification keys so that other services can verify tokens
+func (ks *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	if ks == nil {
+		return set
+	}
+	for _, key := range ks.verification {
+		if key.ID == "" {
+			continue
+		}
+		jwk := publicJWK(key.public)
+		jwk.Kid = key.ID
+		jwk.Use = "sig"
+		jwk.Alg = key.Method.Alg()
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// publicJWK converts an RSA or Ed25519 public key to its required JWK members
+func publicJWK(public any) JWK {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(public),
+		}
+	}
+	return JWK{}
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint used as the key ID
+// The members are marshalled in lexicographic order, as the RFC requires
+func thumbprint(jwk JWK) string {
+	var members any
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
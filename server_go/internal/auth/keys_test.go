@@ -0,0 +1,456 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testEd25519Key is the Ed25519 key of RFC 8037, appendix A.1
+// Its RFC 7638 thumbprint, and so its key ID, is given in appendix A.3
+var testEd25519Key = func() ed25519.PrivateKey {
+	seed, _ := base64.RawURLEncoding.DecodeString("nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A")
+	return ed25519.NewKeyFromSeed(seed)
+}()
+
+const testEd25519KeyID = "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"
+
+// testRSAKey is generated once, since generating RSA keys is slow
+var testRSAKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, minRSABits)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+// writePEM stores a single PEM block in a temporary file and returns its path
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+// pkcs8 encodes a private key as PKCS#8
+func pkcs8(t *testing.T, key any) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	return der
+}
+
+// pkix encodes a public key as PKIX
+func pkix(t *testing.T, key any) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %v", err)
+	}
+	return der
+}
+
+// keySettings returns settings that sign and verify with ks
+func keySettings(ks *KeySet) *Settings {
+	return &Settings{Keys: ks, Issuer: "bank-api", Audience: "bank-api", AccessTokenTTL: time.Minute}
+}
+
+// validClaims returns claims that pass verification under keySettings
+func validClaims() JWTClaims {
+	now := time.Now()
+	return JWTClaims{
+		UserID: "alice",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "bank-api",
+			Audience:  jwt.ClaimStrings{"bank-api"},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+}
+
+func TestParseKeyPEM(t *testing.T) {
+	smallRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		pem       []byte
+		method    jwt.SigningMethod
+		canSign   bool
+		wantKeyID string // checked if set
+		err       string // part of the expected error; empty if the key is accepted
+	}{
+		{
+			name:      "Ed25519 PKCS#8 private key",
+			pem:       pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8(t, testEd25519Key)}),
+			method:    jwt.SigningMethodEdDSA,
+			canSign:   true,
+			wantKeyID: testEd25519KeyID,
+		},
+		{
+			name:      "Ed25519 PKIX public key",
+			pem:       pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix(t, testEd25519Key.Public())}),
+			method:    jwt.SigningMethodEdDSA,
+			wantKeyID: testEd25519KeyID,
+		},
+		{
+			name:    "RSA PKCS#8 private key",
+			pem:     pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8(t, testRSAKey())}),
+			method:  jwt.SigningMethodRS256,
+			canSign: true,
+		},
+		{
+			name:    "RSA PKCS#1 private key",
+			pem:     pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testRSAKey())}),
+			method:  jwt.SigningMethodRS256,
+			canSign: true,
+		},
+		{
+			name:   "RSA PKIX public key",
+			pem:    pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix(t, &testRSAKey().PublicKey)}),
+			method: jwt.SigningMethodRS256,
+		},
+		{
+			name:   "RSA PKCS#1 public key",
+			pem:    pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&testRSAKey().PublicKey)}),
+			method: jwt.SigningMethodRS256,
+		},
+		{
+			name: "RSA key below 2048 bits",
+			pem:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8(t, smallRSA)}),
+			err:  "at least 2048 bits",
+		},
+		{
+			name: "ECDSA key",
+			pem:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8(t, ecKey)}),
+			err:  "unsupported key type",
+		},
+		{
+			name: "certificate",
+			pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not a key")}),
+			err:  "unsupported PEM block",
+		},
+		{
+			name: "corrupt key",
+			pem:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("not a key")}),
+			err:  "asn1",
+		},
+		{
+			name: "not PEM",
+			pem:  []byte("-----BEGIN nothing"),
+			err:  "no PEM data",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parseKeyPEM(tt.pem)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseKeyPEM = %v, want an error about %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseKeyPEM: %v", err)
+			}
+			if key.Method != tt.method {
+				t.Errorf("method = %v, want %v", key.Method.Alg(), tt.method.Alg())
+			}
+			if got := key.signer != nil; got != tt.canSign {
+				t.Errorf("can sign = %v, want %v", got, tt.canSign)
+			}
+			if tt.wantKeyID != "" && key.ID != tt.wantKeyID {
+				t.Errorf("key ID = %q, want %q", key.ID, tt.wantKeyID)
+			}
+		})
+	}
+}
+
+func TestLoadKeySet(t *testing.T) {
+	private := writePEM(t, "PRIVATE KEY", pkcs8(t, testEd25519Key))
+	public := writePEM(t, "PUBLIC KEY", pkix(t, testEd25519Key.Public()))
+
+	if _, err := LoadKeySet(public, nil); err == nil || !strings.Contains(err.Error(), "must be a private key") {
+		t.Fatalf("public signing key: got %v, want an error", err)
+	}
+	if _, err := LoadKeySet(filepath.Join(t.TempDir(), "missing.pem"), nil); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing signing key: got %v, want os.ErrNotExist", err)
+	}
+	if _, err := LoadKeySet(private, []string{writePEM(t, "CERTIFICATE", nil)}); err == nil {
+		t.Fatal("unsupported verification key was accepted")
+	}
+
+	// A private key given for verification only contributes its public part
+	ks, err := LoadKeySet(private, []string{writePEM(t, "PRIVATE KEY", pkcs8(t, testRSAKey()))})
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	if ks.signing.ID != testEd25519KeyID {
+		t.Errorf("signing key ID = %q, want %q", ks.signing.ID, testEd25519KeyID)
+	}
+	for kid, key := range ks.verification {
+		if kid != ks.signing.ID && key.signer != nil {
+			t.Errorf("verification key %s kept its private part", kid)
+		}
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	ks, err := LoadKeySet(
+		writePEM(t, "PRIVATE KEY", pkcs8(t, testEd25519Key)),
+		[]string{writePEM(t, "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&testRSAKey().PublicKey))},
+	)
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	rsaKeyID := thumbprint(publicJWK(&testRSAKey().PublicKey))
+
+	want := map[string]JWK{
+		testEd25519KeyID: {
+			Kty: "OKP",
+			Kid: testEd25519KeyID,
+			Use: "sig",
+			Alg: "EdDSA",
+			Crv: "Ed25519",
+			X:   "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo",
+		},
+		rsaKeyID: {
+			Kty: "RSA",
+			Kid: rsaKeyID,
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(testRSAKey().N.Bytes()),
+			E:   "AQAB",
+		},
+	}
+	set := ks.JWKS()
+	if len(set.Keys) != len(want) {
+		t.Fatalf("JWKS has %d keys, want %d", len(set.Keys), len(want))
+	}
+	for i, jwk := range set.Keys {
+		if jwk != want[jwk.Kid] {
+			t.Errorf("JWK %s = %+v, want %+v", jwk.Kid, jwk, want[jwk.Kid])
+		}
+		if i > 0 && set.Keys[i-1].Kid >= jwk.Kid {
+			t.Errorf("JWKS is not sorted by key ID")
+		}
+	}
+
+	if keys := NewHMACKeySet([]byte("secret")).JWKS().Keys; keys == nil || len(keys) != 0 {
+		t.Errorf("HMAC JWKS = %#v, want an empty list", keys)
+	}
+	var unconfigured *KeySet
+	if keys := unconfigured.JWKS().Keys; keys == nil || len(keys) != 0 {
+		t.Errorf("JWKS without keys = %#v, want an empty list", keys)
+	}
+}
+
+func TestVerifyWithRotatedKeys(t *testing.T) {
+	oldKey := writePEM(t, "PRIVATE KEY", pkcs8(t, testRSAKey()))
+	newKey := writePEM(t, "PRIVATE KEY", pkcs8(t, testEd25519Key))
+
+	before, err := LoadKeySet(oldKey, nil)
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	oldToken, err := signToken(keySettings(before), "alice", nil, "bank-api", time.Minute)
+	if err != nil {
+		t.Fatalf("signToken: %v", err)
+	}
+
+	// After the rotation new tokens carry the new key ID, and the old key still verifies
+	// the tokens it signed
+	rotated, err := LoadKeySet(newKey, []string{oldKey})
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	newToken, err := signToken(keySettings(rotated), "alice", nil, "bank-api", time.Minute)
+	if err != nil {
+		t.Fatalf("signToken: %v", err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, &JWTClaims{})
+	if err != nil {
+		t.Fatalf("ParseUnverified: %v", err)
+	}
+	if parsed.Header["kid"] != testEd25519KeyID || parsed.Header["alg"] != "EdDSA" {
+		t.Errorf("new token header = %v, want kid %s and alg EdDSA", parsed.Header, testEd25519KeyID)
+	}
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		claims, err := verifyToken(keySettings(rotated), token, "bank-api")
+		if err != nil {
+			t.Fatalf("%s token: %v", name, err)
+		}
+		if claims.UserID != "alice" {
+			t.Errorf("%s token user = %q, want alice", name, claims.UserID)
+		}
+	}
+
+	// Once the old key is dropped from the verification set, its tokens are rejected
+	retired, err := LoadKeySet(newKey, nil)
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	if _, err := verifyToken(keySettings(retired), oldToken, "bank-api"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("token of a retired key: got %v, want ErrUnknownKey", err)
+	}
+	if _, err := verifyToken(keySettings(retired), newToken, "bank-api"); err != nil {
+		t.Fatalf("new token after retiring the old key: %v", err)
+	}
+}
+
+func TestVerifyWithFormerHMACSecret(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	oldToken, err := signToken(keySettings(NewHMACKeySet(secret)), "alice", nil, "bank-api", time.Minute)
+	if err != nil {
+		t.Fatalf("signToken: %v", err)
+	}
+
+	// After switching to a key file the secret only verifies the tokens it signed
+	ks, err := LoadKeySet(writePEM(t, "PRIVATE KEY", pkcs8(t, testEd25519Key)), nil)
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	if _, err := verifyToken(keySettings(ks), oldToken, "bank-api"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("HMAC token without the secret: got %v, want ErrUnknownKey", err)
+	}
+	ks.AcceptHMAC(secret)
+	claims, err := verifyToken(keySettings(ks), oldToken, "bank-api")
+	if err != nil {
+		t.Fatalf("HMAC token: %v", err)
+	}
+	if claims.UserID != "alice" {
+		t.Errorf("HMAC token user = %q, want alice", claims.UserID)
+	}
+
+	newToken, err := signToken(keySettings(ks), "alice", nil, "bank-api", time.Minute)
+	if err != nil {
+		t.Fatalf("signToken: %v", err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, &JWTClaims{})
+	if err != nil {
+		t.Fatalf("ParseUnverified: %v", err)
+	}
+	if parsed.Header["alg"] != "EdDSA" {
+		t.Errorf("new token alg = %v, want EdDSA", parsed.Header["alg"])
+	}
+	if keys := ks.JWKS().Keys; len(keys) != 1 || keys[0].Kid != testEd25519KeyID {
+		t.Errorf("JWKS = %+v, want only the signing key", keys)
+	}
+}
+
+func TestVerifyRejectsForeignTokens(t *testing.T) {
+	ks, err := LoadKeySet(writePEM(t, "PRIVATE KEY", pkcs8(t, testRSAKey())), nil)
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	kid := ks.signing.ID
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix(t, &testRSAKey().PublicKey)})
+	otherKey, err := parseKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8(t, testEd25519Key)}))
+	if err != nil {
+		t.Fatalf("parseKeyPEM: %v", err)
+	}
+
+	// sign creates a token with the given header values, signed with key
+	sign := func(t *testing.T, method jwt.SigningMethod, kid string, key any) string {
+		t.Helper()
+		token := jwt.NewWithClaims(method, validClaims())
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("SignedString: %v", err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name  string
+		token func(t *testing.T) string
+		err   error  // checked with errors.Is if set
+		msg   string // part of the expected error, if set
+	}{
+		{
+			name:  "unknown key ID",
+			token: func(t *testing.T) string { return sign(t, jwt.SigningMethodEdDSA, otherKey.ID, testEd25519Key) },
+			err:   ErrUnknownKey,
+		},
+		{
+			name:  "no key ID",
+			token: func(t *testing.T) string { return sign(t, jwt.SigningMethodRS256, "", testRSAKey()) },
+			err:   ErrUnknownKey,
+		},
+		{
+			name:  "key ID of another key",
+			token: func(t *testing.T) string { return sign(t, jwt.SigningMethodEdDSA, kid, testEd25519Key) },
+			msg:   "unexpected signing method",
+		},
+		{
+			// The public key, which is published, must not work as an HMAC secret
+			name:  "HMAC signed with the public key",
+			token: func(t *testing.T) string { return sign(t, jwt.SigningMethodHS256, kid, publicPEM) },
+			msg:   "unexpected signing method",
+		},
+		{
+			name: "alg none",
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodNone, kid, jwt.UnsafeAllowNoneSignatureType)
+			},
+			msg: "unexpected signing method",
+		},
+		{
+			name: "tampered claims",
+			token: func(t *testing.T) string {
+				token := sign(t, jwt.SigningMethodRS256, kid, testRSAKey())
+				parts := strings.Split(token, ".")
+				parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"userID":"mallory","iss":"bank-api","aud":["bank-api"],"exp":4102444800}`))
+				return strings.Join(parts, ".")
+			},
+			err: jwt.ErrTokenSignatureInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifyToken(keySettings(ks), tt.token(t), "bank-api")
+			if err == nil {
+				t.Fatalf("verifyToken accepted the token for %q", claims.UserID)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("verifyToken = %v, want %v", err, tt.err)
+			}
+			if tt.msg != "" && !strings.Contains(err.Error(), tt.msg) {
+				t.Fatalf("verifyToken = %v, want an error about %s", err, tt.msg)
+			}
+		})
+	}
+
+	// The same token verifies when signed properly, so the cases above fail for the reason given
+	if _, err := verifyToken(keySettings(ks), sign(t, jwt.SigningMethodRS256, kid, testRSAKey()), "bank-api"); err != nil {
+		t.Fatalf("verifyToken: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// maxPasswordBytes is the longest password bcrypt can hash
+const maxPasswordBytes = 72
+
+// Password policy violations
+var (
+	ErrPasswordTooShort  = errors.New("password is too short")
+	ErrPasswordTooLong   = fmt.Errorf("password must not exceed %d bytes", maxPasswordBytes)
+	ErrPasswordBreached  = errors.New("password appears in a list of breached passwords")
+	ErrPasswordIsUserID  = errors.New("password must not match the userId")
+	ErrPasswordUnchanged = errors.New("new password must differ from the current one")
+)
+
+// PasswordPolicy decides which passwords users may choose
+type PasswordPolicy struct {
+	MinLength int
+	breached  map[string]struct{}
+}
+
+// LoadPasswordPolicy creates a policy requiring minLength characters
+// breachedFile lists one known-breached password per line; empty disables the check
+func LoadPasswordPolicy(minLength int, breachedFile string) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{MinLength: minLength, breached: make(map[string]struct{})}
+	if breachedFile == "" {
+		return policy, nil
+	}
+
+	f, err := os.Open(breachedFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		policy.breached[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", breachedFile, err)
+	}
+	return policy, nil
+}
+
+// Check returns the first rule password violates for the given user, or nil
+// Breached passwords are matched case-insensitively
+func (p *PasswordPolicy) Check(userID, password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("%w: at least %d characters are required", ErrPasswordTooShort, p.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return ErrPasswordTooLong
+	}
+	if strings.EqualFold(password, userID) {
+		return ErrPasswordIsUserID
+	}
+	if _, ok := p.breached[strings.ToLower(password)]; ok {
+		return ErrPasswordBreached
+	}
+	return nil
+}
+
+// BreachedCount returns how many breached passwords the policy knows
+func (p *PasswordPolicy) BreachedCount() int {
+	return len(p.breached)
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// GenerateRefreshToken creates a new opaque refresh token
+// Only the hash is stored on the server; the token itself is handed to the client once
+func GenerateRefreshToken() (token string, hash string, err error) {
+	return generateToken()
+}
+
+// GenerateResetToken creates a new opaque password reset token and the hash to store for it
+func GenerateResetToken() (token string, hash string, err error) {
+	return generateToken()
+}
+
+// HashResetToken returns the value stored for a password reset token
+func HashResetToken(token string) string {
+	return hashToken(token)
+}
+
+// generateToken creates a random URL-safe token and its hash
+func generateToken() (token string, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+// HashRefreshToken returns the value stored for a refresh token
+func HashRefreshToken(token string) string {
+	return hashToken(token)
+}
+
+// hashToken returns the hex SHA-256 of a high-entropy secret
+// A fast hash is sufficient because the secrets are random, unlike passwords
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"server/internal/models"
+)
+
+// RevocationStore is the persistent storage behind Revocations
+type RevocationStore interface {
+	CreateTokenRevocation(ctx context.Context, revocation *models.TokenRevocation) error
+	ListTokenRevocations(ctx context.Context) ([]models.TokenRevocation, error)
+	PurgeExpiredTokenRevocations(ctx context.Context) (int64, error)
+}
+
+// Revocations tracks access tokens revoked before their expiry
+// Every revocation is written to the store and kept in memory, so checking a token
+// never touches the database; Load restores the cache after a restart and, called
+// periodically, picks up revocations made by other instances
+type Revocations struct {
+	store RevocationStore
+
+	mu      sync.RWMutex
+	tokens  map[string]time.Time // JTI -> when the token expires
+	cutoffs map[string]time.Time // user ID -> tokens issued before this time are revoked
+}
+
+// NewRevocations creates an empty revocation cache backed by store
+func NewRevocations(store RevocationStore) *Revocations {
+	return &Revocations{
+		store:   store,
+		tokens:  make(map[string]time.Time),
+		cutoffs: make(map[string]time.Time),
+	}
+}
+
+// Load adds the unexpired revocations from the store to the cache
+// Revocations are never lifted, so entries already cached are kept; one made here while
+// the store was being read stays in effect even if the read missed it. Purge drops
+// entries once their tokens have expired
+func (r *Revocations) Load(ctx context.Context) error {
+	revocations, err := r.store.ListTokenRevocations(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, revocation := range revocations {
+		if revocation.JTI != "" {
+			r.tokens[revocation.JTI] = revocation.ExpiresAt
+		}
+		if revocation.IssuedBefore != nil && revocation.IssuedBefore.After(r.cutoffs[revocation.UserID]) {
+			r.cutoffs[revocation.UserID] = *revocation.IssuedBefore
+		}
+	}
+	return nil
+}
+
+// IsRevoked reports whether a verified token has been revoked
+func (r *Revocations) IsRevoked(claims *JWTClaims) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if claims.ID != "" {
+		if _, ok := r.tokens[claims.ID]; ok {
+			return true
+		}
+	}
+	cutoff, ok := r.cutoffs[claims.UserID]
+	if !ok {
+		return false
+	}
+	// Tokens without an issue time cannot be shown to postdate the cutoff
+	return claims.IssuedAt == nil || claims.IssuedAt.Time.Before(cutoff)
+}
+
+// RevokeToken revokes a single access token
+func (r *Revocations) RevokeToken(ctx context.Context, userID, jti string) error {
+	expiresAt := time.Now().UTC().Add(AccessTokenTTL())
+	err := r.store.CreateTokenRevocation(ctx, &models.TokenRevocation{
+		JTI:       jti,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.tokens[jti] = expiresAt
+	r.mu.Unlock()
+	return nil
+}
+
+// RevokeUser revokes every access token issued to a user so far
+// Issue times have a resolution of one second, so a token issued in the same second
+// as the revocation is revoked as well
+func (r *Revocations) RevokeUser(ctx context.Context, userID string) error {
+	cutoff := time.Now().UTC().Truncate(time.Second).Add(time.Second)
+	err := r.store.CreateTokenRevocation(ctx, &models.TokenRevocation{
+		UserID:       userID,
+		IssuedBefore: &cutoff,
+		ExpiresAt:    cutoff.Add(AccessTokenTTL()),
+	})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if cutoff.After(r.cutoffs[userID]) {
+		r.cutoffs[userID] = cutoff
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// Purge drops revocations whose tokens have all expired, from the store and the cache
+func (r *Revocations) Purge(ctx context.Context) (int64, error) {
+	n, err := r.store.PurgeExpiredTokenRevocations(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	r.mu.Lock()
+	for jti, expiresAt := range r.tokens {
+		if !expiresAt.After(now) {
+			delete(r.tokens, jti)
+		}
+	}
+	for userID, cutoff := range r.cutoffs {
+		if !cutoff.Add(AccessTokenTTL()).After(now) {
+			delete(r.cutoffs, userID)
+		}
+	}
+	r.mu.Unlock()
+	return n, nil
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"server/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// sharedRevocations is a RevocationStore shared by several instances
+type sharedRevocations struct {
+	mu          sync.Mutex
+	revocations []models.TokenRevocation
+}
+
+func (s *sharedRevocations) CreateTokenRevocation(_ context.Context, revocation *models.TokenRevocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revocations = append(s.revocations, *revocation)
+	return nil
+}
+
+func (s *sharedRevocations) ListTokenRevocations(context.Context) ([]models.TokenRevocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]models.TokenRevocation(nil), s.revocations...), nil
+}
+
+func (s *sharedRevocations) PurgeExpiredTokenRevocations(context.Context) (int64, error) {
+	return 0, nil
+}
+
+func TestRevocationsReachOtherInstances(t *testing.T) {
+	ctx := context.Background()
+	store := &sharedRevocations{}
+	here, there := NewRevocations(store), NewRevocations(store)
+
+	issued := time.Now().Add(-time.Minute)
+	claims := func(userID, jti string) *JWTClaims {
+		c := &JWTClaims{UserID: userID}
+		c.ID = jti
+		c.IssuedAt = jwt.NewNumericDate(issued)
+		return c
+	}
+
+	if err := here.RevokeToken(ctx, "alice", "token-1"); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	if err := here.RevokeUser(ctx, "bob"); err != nil {
+		t.Fatalf("RevokeUser: %v", err)
+	}
+	if !here.IsRevoked(claims("alice", "token-1")) || !here.IsRevoked(claims("bob", "token-2")) {
+		t.Fatal("revocations do not apply on the instance that made them")
+	}
+	if there.IsRevoked(claims("alice", "token-1")) {
+		t.Fatal("revocation applied elsewhere before a reload")
+	}
+
+	if err := there.Load(ctx); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !there.IsRevoked(claims("alice", "token-1")) || !there.IsRevoked(claims("bob", "token-2")) {
+		t.Fatal("revocations missing after a reload")
+	}
+	if there.IsRevoked(claims("alice", "token-3")) {
+		t.Fatal("unrelated token of alice is revoked")
+	}
+
+	// A reload keeps what is cached, even if the store has not caught up with it
+	if err := there.RevokeToken(ctx, "carol", "token-4"); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	store.revocations = store.revocations[:len(store.revocations)-1]
+	if err := there.Load(ctx); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !there.IsRevoked(claims("carol", "token-4")) {
+		t.Fatal("reload dropped a cached revocation")
+	}
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"server/internal/models"
+)
+
+// throttlePurgeInterval is how often idle entries are dropped from a Throttle
+const throttlePurgeInterval = time.Minute
+
+// Throttle counts consecutive failed logins per key (a user ID or a client IP) in memory
+// and refuses further attempts for the delay given by its policy
+// Keys are tracked whether or not the user exists, so the responses for unknown users
+// are indistinguishable from those for real ones
+type Throttle struct {
+	policy models.LoginPolicy
+
+	mu        sync.Mutex
+	entries   map[string]*throttleEntry
+	lastPurge time.Time
+}
+
+// throttleEntry is the failure state of a single key
+type throttleEntry struct {
+	failures     int
+	blockedUntil time.Time
+	lastFailure  time.Time
+}
+
+// NewThrottle creates an empty throttle applying policy
+func NewThrottle(policy models.LoginPolicy) *Throttle {
+	return &Throttle{policy: policy, entries: make(map[string]*throttleEntry)}
+}
+
+// Wait returns how long attempts for key are still refused, or 0 if they are allowed
+func (t *Throttle) Wait(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[key]
+	if !ok {
+		return 0
+	}
+	return max(time.Until(entry.blockedUntil), 0)
+}
+
+// Failure records a failed attempt for key and returns how long further attempts are refused
+func (t *Throttle) Failure(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.purge(now)
+
+	entry, ok := t.entries[key]
+	if !ok {
+		entry = &throttleEntry{}
+		t.entries[key] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+	delay := t.policy.Delay(entry.failures)
+	entry.blockedUntil = now.Add(delay)
+	return delay
+}
+
+// Success forgets the failures recorded for key
+func (t *Throttle) Success(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+// purge drops keys whose last failure is older than the lockout, at most once per interval
+// Must be called with t.mu held
+func (t *Throttle) purge(now time.Time) {
+	if now.Sub(t.lastPurge) < throttlePurgeInterval {
+		return
+	}
+	t.lastPurge = now
+	for key, entry := range t.entries {
+		if now.Sub(entry.lastFailure) > t.policy.Lockout && !entry.blockedUntil.After(now) {
+			delete(t.entries, key)
+		}
+	}
+}
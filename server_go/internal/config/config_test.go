@@ -0,0 +1,176 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// productionConfig returns a production configuration that passes Validate
+func productionConfig() *Config {
+	return &Config{
+		Env:    EnvProduction,
+		Server: ServerConfig{Addr: ":8080", MetricsAddr: "127.0.0.1:9090"},
+		Log:    LogConfig{Level: "info", Format: LogFormatJSON},
+		DB:     DBConfig{Driver: DriverPostgres, DSN: "postgres://bank@db/bank", MaxOpenConns: 20, MaxIdleConns: 10},
+		Auth: AuthConfig{
+			Secret:          strings.Repeat("s3cr3t-", 8),
+			Issuer:          "bank-api",
+			Audience:        "bank-api",
+			AccessTokenTTL:  900,
+			RefreshTokenTTL: 86400,
+			EncryptionKey:   "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		},
+		Login:    LoginConfig{MaxAttempts: 5, IPMaxAttempts: 50},
+		Password: PasswordConfig{MinLength: 10, ResetTTL: 3600},
+		FX:       FXConfig{QuoteTTL: 30, SpreadBps: 50},
+		Notify:   NotifyConfig{Kind: "none"},
+	}
+}
+
+// validateTest changes a valid production configuration and checks what Validate says
+type validateTest struct {
+	name   string
+	change func(*Config)
+	err    string // part of the expected error; empty if the configuration is valid
+}
+
+func TestValidate(t *testing.T) {
+	tests := []validateTest{
+		{
+			name:   "valid production configuration",
+			change: func(*Config) {},
+		},
+		{
+			name:   "missing secret",
+			change: func(c *Config) { c.Auth.Secret = "" },
+			err:    "JWT_SIGNING_KEY_FILE or JWT_SECRET",
+		},
+		{
+			name:   "short secret",
+			change: func(c *Config) { c.Auth.Secret = strings.Repeat("x", minSecretLength-1) },
+			err:    "JWT_SECRET must be at least 32 characters",
+		},
+		{
+			name:   "secret of minimum length",
+			change: func(c *Config) { c.Auth.Secret = strings.Repeat("x", minSecretLength) },
+		},
+		{
+			name:   "signing key file instead of a secret",
+			change: func(c *Config) { c.Auth.Secret, c.Auth.SigningKeyFile = "", "/etc/bank/jwt.pem" },
+		},
+		{
+			name:   "secret kept next to a signing key file",
+			change: func(c *Config) { c.Auth.SigningKeyFile = "/etc/bank/jwt.pem" },
+		},
+		{
+			name: "short secret next to a signing key file",
+			change: func(c *Config) {
+				c.Auth.Secret, c.Auth.SigningKeyFile = strings.Repeat("x", minSecretLength-1), "/etc/bank/jwt.pem"
+			},
+			err: "JWT_SECRET must be at least 32 characters",
+		},
+		{
+			name:   "verification keys without a signing key file",
+			change: func(c *Config) { c.Auth.VerificationKeyFiles = []string{"/etc/bank/old.pem"} },
+			err:    "JWT_VERIFICATION_KEY_FILES",
+		},
+		{
+			name: "short secret in development",
+			change: func(c *Config) {
+				c.Env = EnvDevelopment
+				c.Auth.Secret = "dev"
+			},
+		},
+		{
+			name:   "negative revocation refresh interval",
+			change: func(c *Config) { c.Auth.RevocationRefresh = -1 },
+			err:    "JWT_REVOCATION_REFRESH_INTERVAL",
+		},
+		{
+			name:   "missing issuer",
+			change: func(c *Config) { c.Auth.Issuer = "" },
+			err:    "JWT_ISSUER and JWT_AUDIENCE",
+		},
+		{
+			name:   "missing audience",
+			change: func(c *Config) { c.Auth.Audience = "" },
+			err:    "JWT_ISSUER and JWT_AUDIENCE",
+		},
+		{
+			name:   "missing encryption key",
+			change: func(c *Config) { c.Auth.EncryptionKey = "" },
+			err:    "AUTH_ENCRYPTION_KEY must be set",
+		},
+		{
+			name:   "encryption key of the wrong size",
+			change: func(c *Config) { c.Auth.EncryptionKey = "c2hvcnQ=" },
+			err:    "AUTH_ENCRYPTION_KEY must be 32 bytes",
+		},
+		{
+			name:   "unknown environment",
+			change: func(c *Config) { c.Env = "staging" },
+			err:    "APP_ENV",
+		},
+		{
+			name:   "zero quote TTL",
+			change: func(c *Config) { c.FX.QuoteTTL = 0 },
+			err:    "FX_QUOTE_TTL",
+		},
+		{
+			name:   "negative rates refresh interval",
+			change: func(c *Config) { c.FX.RatesRefresh = -1 },
+			err:    "FX_RATES_REFRESH_INTERVAL",
+		},
+		{
+			name:   "negative spread",
+			change: func(c *Config) { c.FX.SpreadBps = -1 },
+			err:    "FX_SPREAD_BPS",
+		},
+		{
+			name:   "spread of the whole amount",
+			change: func(c *Config) { c.FX.SpreadBps = 10000 },
+			err:    "FX_SPREAD_BPS",
+		},
+		{
+			name:   "no spread",
+			change: func(c *Config) { c.FX.SpreadBps = 0 },
+		},
+		{
+			name:   "log notifier in production",
+			change: func(c *Config) { c.Notify.Kind = "log" },
+			err:    "NOTIFIER",
+		},
+		{
+			name:   "file notifier in production",
+			change: func(c *Config) { c.Notify.Kind = "file" },
+			err:    "NOTIFIER",
+		},
+		{
+			name: "file notifier in development",
+			change: func(c *Config) {
+				c.Env = EnvDevelopment
+				c.Notify.Kind = "file"
+			},
+		},
+	}
+	for _, secret := range insecureSecrets {
+		tests = append(tests, validateTest{
+			name:   "well-known secret " + secret,
+			change: func(c *Config) { c.Auth.Secret = secret },
+			err:    "well-known default",
+		})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := productionConfig()
+			tt.change(cfg)
+			err := cfg.Validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("Validate: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("Validate = %v, want an error about %s", err, tt.err)
+			}
+		})
+	}
+}
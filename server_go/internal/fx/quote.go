@@ -0,0 +1,88 @@
+package fx
+
+import (
+	"math/big"
+	"time"
+
+	"server/internal/models"
+)
+
+// Quoter issues quotes that lock the current rate, less the bank's spread, for a fixed time
+type Quoter struct {
+	table     *Table
+	spreadBps int
+	ttl       time.Duration
+}
+
+// NewQuoter creates a Quoter charging spreadBps basis points on the mid-market rate
+func NewQuoter(table *Table, spreadBps int, ttl time.Duration) *Quoter {
+	return &Quoter{table: table, spreadBps: spreadBps, ttl: ttl}
+}
+
+// Quote prices a conversion between two currencies for a user
+// The returned quote is not persisted yet
+func (q *Quoter) Quote(userID, from, to string) (*models.FXQuote, error) {
+	if !models.ValidCurrency(from) || !models.ValidCurrency(to) {
+		return nil, models.ErrUnknownCurrency
+	}
+	if from == to {
+		return nil, models.ErrQuoteMismatch
+	}
+
+	mid, err := q.table.Rate(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &models.FXQuote{
+		UserID:       userID,
+		FromCurrency: from,
+		ToCurrency:   to,
+		Rate:         FormatRate(ApplySpread(mid, q.spreadBps)),
+		MidRate:      FormatRate(mid),
+		SpreadBps:    q.spreadBps,
+		ExpiresAt:    time.Now().UTC().Add(q.ttl),
+	}, nil
+}
+
+// ApplySpread lowers a mid-market rate by spreadBps basis points, truncated to RateDecimals
+func ApplySpread(mid *big.Rat, spreadBps int) *big.Rat {
+	rate := new(big.Rat).Mul(mid, big.NewRat(int64(10000-spreadBps), 10000))
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(RateDecimals), nil)
+	truncated := new(big.Int).Quo(new(big.Int).Mul(rate.Num(), scale), rate.Denom())
+	return new(big.Rat).SetFrac(truncated, scale)
+}
+
+// Convert converts amount into another currency at rate, rounding down to whole minor units
+func Convert(amount models.Money, rate *big.Rat, to string) (models.Money, error) {
+	fromDigits, err := models.MinorUnits(amount.Currency)
+	if err != nil {
+		return models.Money{}, err
+	}
+	toDigits, err := models.MinorUnits(to)
+	if err != nil {
+		return models.Money{}, err
+	}
+
+	// minor_to = minor_from * rate * 10^(toDigits - fromDigits)
+	value := new(big.Rat).Mul(new(big.Rat).SetInt64(amount.Amount), rate)
+	shift := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(toDigits-fromDigits))), nil))
+	if toDigits >= fromDigits {
+		value.Mul(value, shift)
+	} else {
+		value.Quo(value, shift)
+	}
+
+	converted := new(big.Int).Quo(value.Num(), value.Denom())
+	if !converted.IsInt64() {
+		return models.Money{}, models.ErrAmountOverflow
+	}
+	return models.Money{Amount: converted.Int64(), Currency: to}, nil
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,168 @@
+// Package fx provides exchange rates, rate quotes and currency conversion
+package fx
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+
+	"server/internal/models"
+)
+
+// RateDecimals is the precision, in decimal places, at which rates are stored and applied
+const RateDecimals = 10
+
+// ErrInvalidRate is returned for rates that are not positive decimal numbers
+var ErrInvalidRate = errors.New("rate must be a positive decimal number")
+
+// Rate is one entry of the rate table: 1 unit of From buys Rate units of To
+type Rate struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Rate string `json:"rate"`
+}
+
+// Table holds mid-market exchange rates and is safe for concurrent use
+type Table struct {
+	mu    sync.RWMutex
+	rates map[string]*big.Rat
+}
+
+// NewTable creates an empty rate table
+func NewTable() *Table {
+	return &Table{rates: make(map[string]*big.Rat)}
+}
+
+// pairKey identifies a currency pair in the table
+func pairKey(from, to string) string {
+	return from + "/" + to
+}
+
+// ParseRate parses a decimal rate such as "1.0850"
+func ParseRate(s string) (*big.Rat, error) {
+	rate, ok := new(big.Rat).SetString(s)
+	if !ok || rate.Sign() <= 0 {
+		return nil, ErrInvalidRate
+	}
+	return rate, nil
+}
+
+// FormatRate formats a rate with RateDecimals decimal places
+func FormatRate(rate *big.Rat) string {
+	return rate.FloatString(RateDecimals)
+}
+
+// parseRates validates a list of rates and converts it into table form
+func parseRates(list []Rate) (map[string]*big.Rat, error) {
+	rates := make(map[string]*big.Rat, len(list))
+	for _, r := range list {
+		if !models.ValidCurrency(r.From) || !models.ValidCurrency(r.To) {
+			return nil, fmt.Errorf("%s/%s: %w", r.From, r.To, models.ErrUnknownCurrency)
+		}
+		if r.From == r.To {
+			return nil, fmt.Errorf("%s/%s: currencies must differ", r.From, r.To)
+		}
+		rate, err := ParseRate(r.Rate)
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", r.From, r.To, err)
+		}
+		rates[pairKey(r.From, r.To)] = rate
+	}
+	return rates, nil
+}
+
+// Replace swaps the whole table for the given rates
+// Either all rates are valid and applied, or the table is left unchanged
+func (t *Table) Replace(list []Rate) error {
+	rates, err := parseRates(list)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.rates = rates
+	t.mu.Unlock()
+	return nil
+}
+
+// ReplaceFunc swaps the whole table for the given rates once record has accepted the
+// change, such as by storing it in the audit log; record gets the rates before and
+// after the change, sorted as by Rates
+// Either all rates are valid and record succeeds, or the table is left unchanged
+// Other replacements wait for record, so that before is the table it replaces
+func (t *Table) ReplaceFunc(list []Rate, record func(before, after []Rate) error) error {
+	rates, err := parseRates(list)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := record(sortedRates(t.rates), sortedRates(rates)); err != nil {
+		return err
+	}
+	t.rates = rates
+	return nil
+}
+
+// Load replaces the table with rates read from a JSON document of the form
+// {"rates":[{"from":"USD","to":"EUR","rate":"0.92"}]}
+func (t *Table) Load(r io.Reader) error {
+	var doc struct {
+		Rates []Rate `json:"rates"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return fmt.Errorf("failed to parse rates: %w", err)
+	}
+	return t.Replace(doc.Rates)
+}
+
+// LoadFile replaces the table with rates read from a local JSON file
+func (t *Table) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return t.Load(f)
+}
+
+// Rate returns the mid-market rate for converting from one currency into another
+// If only the opposite pair is listed, its inverse is used
+func (t *Table) Rate(from, to string) (*big.Rat, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if rate, ok := t.rates[pairKey(from, to)]; ok {
+		return new(big.Rat).Set(rate), nil
+	}
+	if rate, ok := t.rates[pairKey(to, from)]; ok {
+		return new(big.Rat).Inv(rate), nil
+	}
+	return nil, models.ErrRateUnavailable
+}
+
+// Rates lists the table sorted by currency pair
+func (t *Table) Rates() []Rate {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return sortedRates(t.rates)
+}
+
+// sortedRates lists rates in table form sorted by currency pair
+func sortedRates(rates map[string]*big.Rat) []Rate {
+	list := make([]Rate, 0, len(rates))
+	for key, rate := range rates {
+		var r Rate
+		r.From, r.To = key[:3], key[4:]
+		r.Rate = FormatRate(rate)
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return pairKey(list[i].From, list[i].To) < pairKey(list[j].From, list[j].To)
+	})
+	return list
+}
@@ -0,0 +1,372 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"server/internal/auth"
+	"server/internal/models"
+	"server/internal/store"
+
+	"github.com/go-chi/chi"
+	"gorm.io/gorm"
+)
+
+// ============= Admin Handlers =============
+
+// setUserRoles handles PUT /admin/users/{userId}/roles
+// Replaces the user's roles; the user's tokens are revoked so that the change applies immediately
+func setUserRoles(db store.Repository, revocations *auth.Revocations) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, "userId")
+
+		var req userRolesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Roles == nil {
+			req.Roles = []string{}
+		}
+		slices.Sort(req.Roles)
+		req.Roles = slices.Compact(req.Roles)
+
+		err := db.WithTx(r.Context(), func(tx store.Repository) error {
+			before, err := tx.GetUserByID(r.Context(), userID)
+			if err != nil {
+				return err
+			}
+			if err := tx.SetUserRoles(r.Context(), userID, req.Roles); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, r.Header.Get("X-User-ID"), models.AuditUserRoles, models.AuditTargetUser, userID)
+			event.SetChange(map[string]any{"roles": before.RoleList()}, map[string]any{"roles": req.Roles})
+			return tx.RecordAuditEvent(r.Context(), event)
+		})
+		switch {
+		case errors.Is(err, models.ErrInvalidRole):
+			sendErrorCode(w, http.StatusBadRequest, "invalid_role", err.Error())
+			return
+		case err == gorm.ErrRecordNotFound:
+			sendErrorCode(w, http.StatusNotFound, "user_not_found", "user not found")
+			return
+		case err != nil:
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		if err := revocations.RevokeUser(r.Context(), userID); err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		sendSuccess(w, http.StatusOK, userRolesResponse{UserId: userID, Roles: req.Roles})
+	}
+}
+
+// searchUsers handles GET /admin/users
+// Query parameters: q (part of the user ID) and limit
+func searchUsers(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("q")
+		limit := defaultPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > maxPageSize {
+				sendError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+				return
+			}
+			limit = n
+		}
+
+		var users []models.User
+		err := db.WithTx(r.Context(), func(tx store.Repository) error {
+			event := newAuditEvent(r, r.Header.Get("X-User-ID"), models.AuditUserSearch, models.AuditTargetUser, "")
+			event.SetDetails(map[string]any{"query": query})
+			if err := tx.RecordAuditEvent(r.Context(), event); err != nil {
+				return err
+			}
+			var err error
+			users, err = tx.SearchUsers(r.Context(), query, limit)
+			return err
+		})
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		resp := adminUsersResponse{Users: []adminUserResponse{}}
+		for _, user := range users {
+			resp.Users = append(resp.Users, newAdminUserResponse(user))
+		}
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// getUser handles GET /admin/users/{userId}
+// Returns the user's login state together with all of their accounts
+func getUser(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, "userId")
+
+		var resp adminUserResponse
+		err := db.WithTx(r.Context(), func(tx store.Repository) error {
+			user, err := tx.GetUserByID(r.Context(), userID)
+			if err != nil {
+				return err
+			}
+			accounts, err := tx.GetAccountsByUserID(r.Context(), userID)
+			if err != nil {
+				return err
+			}
+			resp = newAdminUserResponse(*user)
+			resp.Accounts = []adminAccountResponse{}
+			for _, account := range accounts {
+				resp.Accounts = append(resp.Accounts, newAdminAccountResponse(account))
+			}
+			event := newAuditEvent(r, r.Header.Get("X-User-ID"), models.AuditUserView, models.AuditTargetUser, userID)
+			return tx.RecordAuditEvent(r.Context(), event)
+		})
+		if err != nil {
+			sendAdminError(w, err, "user_not_found", "user not found")
+			return
+		}
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// unlockUser handles POST /admin/users/{userId}/unlock
+// Clears the user's failed logins and lockout; a reason is optional
+func unlockUser(db store.Repository, limits *loginLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, "userId")
+		var req adminReasonRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				sendError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+		}
+
+		var resp adminUserResponse
+		err := db.WithTx(r.Context(), func(tx store.Repository) error {
+			before, err := tx.GetUserByID(r.Context(), userID)
+			if err != nil {
+				return err
+			}
+			if err := tx.ResetLoginFailures(r.Context(), userID); err != nil {
+				return err
+			}
+			user, err := tx.GetUserByID(r.Context(), userID)
+			if err != nil {
+				return err
+			}
+			resp = newAdminUserResponse(*user)
+			event := newAuditEvent(r, r.Header.Get("X-User-ID"), models.AuditUserUnlock, models.AuditTargetUser, userID)
+			event.Reason = auditString(req.Reason)
+			event.SetChange(
+				map[string]any{"failedLoginAttempts": before.FailedLoginAttempts, "lockedUntil": before.LockedUntil},
+				map[string]any{"failedLoginAttempts": user.FailedLoginAttempts, "lockedUntil": user.LockedUntil},
+			)
+			return tx.RecordAuditEvent(r.Context(), event)
+		})
+		if err != nil {
+			sendAdminError(w, err, "user_not_found", "user not found")
+			return
+		}
+
+		// Also forget the in-memory backoff so the user can log in right away
+		limits.users.Success(userID)
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// getAccount handles GET /admin/accounts/{accountId}
+func getAccount(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID := chi.URLParam(r, "accountId")
+
+		var account *models.Account
+		err := db.WithTx(r.Context(), func(tx store.Repository) error {
+			var err error
+			if account, err = tx.GetAccount(r.Context(), accountID); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, r.Header.Get("X-User-ID"), models.AuditAccountView, models.AuditTargetAccount, accountID)
+			return tx.RecordAuditEvent(r.Context(), event)
+		})
+		if err != nil {
+			sendAdminError(w, err, "account_not_found", "account not found")
+			return
+		}
+		sendSuccess(w, http.StatusOK, newAdminAccountResponse(*account))
+	}
+}
+
+// listAccountTransactions handles GET /admin/accounts/{accountId}/transactions
+// Accepts the same query parameters as GET /account/transactions
+func listAccountTransactions(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID := chi.URLParam(r, "accountId")
+		filter, err := parseTransactionFilter(r)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var resp transactionsResponse
+		err = db.WithTx(r.Context(), func(tx store.Repository) error {
+			if _, err := tx.GetAccount(r.Context(), accountID); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, r.Header.Get("X-User-ID"), models.AuditAccountHistory, models.AuditTargetAccount, accountID)
+			if err := tx.RecordAuditEvent(r.Context(), event); err != nil {
+				return err
+			}
+			resp, err = transactionPage(r.Context(), tx, accountID, filter)
+			return err
+		})
+		if err != nil {
+			sendAdminError(w, err, "account_not_found", "account not found")
+			return
+		}
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// setAccountStatus handles POST /admin/accounts/{accountId}/freeze and /unfreeze
+// Moves the account to status if the transition is allowed; a reason is required
+func setAccountStatus(db store.Repository, status string) http.HandlerFunc {
+	action := models.AuditAccountFreeze
+	if status == models.AccountActive {
+		action = models.AuditAccountUnfreeze
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID := chi.URLParam(r, "accountId")
+		var req adminReasonRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if strings.TrimSpace(req.Reason) == "" {
+			sendErrorCode(w, http.StatusBadRequest, "reason_required", "reason is required")
+			return
+		}
+
+		var account *models.Account
+		err := db.WithTx(r.Context(), func(tx store.Repository) error {
+			before, err := tx.GetAccount(r.Context(), accountID)
+			if err != nil {
+				return err
+			}
+			if account, err = tx.SetAccountStatus(r.Context(), accountID, status); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, r.Header.Get("X-User-ID"), action, models.AuditTargetAccount, accountID)
+			event.Reason = auditString(req.Reason)
+			event.SetChange(map[string]any{"status": before.Status}, map[string]any{"status": account.Status})
+			return tx.RecordAuditEvent(r.Context(), event)
+		})
+		if err != nil {
+			sendBalanceError(w, err)
+			return
+		}
+		sendSuccess(w, http.StatusOK, newAdminAccountResponse(*account))
+	}
+}
+
+// adminCloseAccount handles POST /admin/accounts/{accountId}/close
+// Closes any customer's account, frozen ones included, paying out the remaining balance
+// to payoutAccountId; a reason is required
+func adminCloseAccount(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID := chi.URLParam(r, "accountId")
+		var req closeAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if strings.TrimSpace(req.Reason) == "" {
+			sendErrorCode(w, http.StatusBadRequest, "reason_required", "reason is required")
+			return
+		}
+
+		var resp closeAccountResponse
+		err := db.WithTx(r.Context(), func(tx store.Repository) error {
+			before, err := tx.GetAccount(r.Context(), accountID)
+			if err != nil {
+				return err
+			}
+			account, payout, err := tx.CloseAccount(r.Context(), accountID, req.PayoutAccountId, true)
+			if err != nil {
+				return err
+			}
+			resp = newCloseAccountResponse(*account, payout)
+			event := newAuditEvent(r, r.Header.Get("X-User-ID"), models.AuditAccountClose, models.AuditTargetAccount, accountID)
+			event.Reason = auditString(req.Reason)
+			setClosure(event, before, account, payout)
+			return tx.RecordAuditEvent(r.Context(), event)
+		})
+		if err != nil {
+			sendBalanceError(w, err)
+			return
+		}
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// adjustBalance handles POST /admin/accounts/{accountId}/adjustments
+// Credits (positive amount) or debits (negative amount) the account to correct its
+// balance; a reason is required
+func adjustBalance(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID := chi.URLParam(r, "accountId")
+		var req adjustmentRequest
+		if !decodeMoneyRequest(w, r, &req) {
+			return
+		}
+		if strings.TrimSpace(req.Reason) == "" {
+			sendErrorCode(w, http.StatusBadRequest, "reason_required", "reason is required")
+			return
+		}
+
+		var record *models.Transaction
+		err := db.WithTx(r.Context(), func(tx store.Repository) error {
+			var err error
+			if record, err = tx.AdjustBalance(r.Context(), accountID, req.Amount); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, r.Header.Get("X-User-ID"), models.AuditAccountAdjustment, models.AuditTargetAccount, accountID)
+			event.Reason = auditString(req.Reason)
+			setBalanceChange(event, record.GetBalanceAfter(), record.Amount)
+			event.SetDetails(map[string]any{"amount": record.GetAmount(), "reference": record.Reference})
+			return tx.RecordAuditEvent(r.Context(), event)
+		})
+		if err != nil {
+			sendBalanceError(w, err)
+			return
+		}
+
+		sendSuccess(w, http.StatusOK, adjustmentResponse{
+			AccountId: accountID,
+			Amount:    record.GetAmount(),
+			Balance:   record.GetBalanceAfter(),
+			Reference: record.Reference,
+		})
+	}
+}
+
+// sendAdminError reports a failed admin lookup, naming the missing record with code and message
+func sendAdminError(w http.ResponseWriter, err error, code, message string) {
+	if err == gorm.ErrRecordNotFound {
+		sendErrorCode(w, http.StatusNotFound, code, message)
+		return
+	}
+	sendError(w, http.StatusInternalServerError, "database error")
+}
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"server/internal/middleware"
+	"server/internal/models"
+	"server/internal/store"
+)
+
+// maxAuditFieldLength bounds client-controlled values copied into audit events
+const maxAuditFieldLength = 255
+
+// ============= Audit Handlers =============
+
+// listAuditEvents handles GET /admin/audit
+// Query parameters: actorId, action, targetType, targetId, from, to (RFC 3339), limit and cursor
+func listAuditEvents(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseAuditFilter(r)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Fetch one extra event to find out whether another page exists
+		limit := filter.Limit
+		filter.Limit++
+		var events []models.AuditEvent
+		err = db.WithTx(r.Context(), func(tx store.Repository) error {
+			var err error
+			if events, err = tx.ListAuditEvents(r.Context(), filter); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, r.Header.Get("X-User-ID"), models.AuditLogView, models.AuditTargetAudit, "")
+			event.SetDetails(map[string]any{"query": r.URL.RawQuery})
+			return tx.RecordAuditEvent(r.Context(), event)
+		})
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		resp := auditEventsResponse{Events: []auditEventResponse{}}
+		if len(events) > limit {
+			events = events[:limit]
+			resp.NextCursor = encodeCursor(events[limit-1].ID)
+		}
+		for _, event := range events {
+			resp.Events = append(resp.Events, newAuditEventResponse(event))
+		}
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// verifyAuditLog handles GET /admin/audit/verify
+// Checks the hash chain of the whole audit log; a broken chain is reported in the
+// response rather than as an error status, so that monitoring can tell it apart
+func verifyAuditLog(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		count, head, err := db.VerifyAuditChain(r.Context())
+		resp := auditVerifyResponse{Valid: err == nil, Events: count, HeadHash: head}
+		if errors.Is(err, models.ErrAuditChainBroken) {
+			resp.Error = err.Error()
+		} else if err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		event := newAuditEvent(r, r.Header.Get("X-User-ID"), models.AuditLogVerify, models.AuditTargetAudit, "")
+		event.SetDetails(map[string]any{"valid": resp.Valid, "events": resp.Events, "headHash": resp.HeadHash})
+		if err := db.RecordAuditEvent(r.Context(), event); err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// parseAuditFilter builds a store filter from the query string of an audit log request
+func parseAuditFilter(r *http.Request) (store.AuditFilter, error) {
+	q := r.URL.Query()
+	filter := store.AuditFilter{
+		ActorID:    q.Get("actorId"),
+		Action:     q.Get("action"),
+		TargetType: q.Get("targetType"),
+		TargetID:   q.Get("targetId"),
+		Limit:      defaultPageSize,
+	}
+
+	if v := q.Get("from"); v != "" {
+		from, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, errors.New("from must be an RFC 3339 timestamp")
+		}
+		filter.From = from
+	}
+	if v := q.Get("to"); v != "" {
+		to, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, errors.New("to must be an RFC 3339 timestamp")
+		}
+		filter.To = to
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		filter.Limit = limit
+	}
+	if v := q.Get("cursor"); v != "" {
+		id, err := decodeCursor(v)
+		if err != nil {
+			return filter, errors.New("invalid cursor")
+		}
+		filter.BeforeID = id
+	}
+	return filter, nil
+}
+
+// newAuditEvent describes an action on a target taken during request r
+// actorID is the authenticated caller, or empty for anonymous requests; it is never
+// taken from r itself, since public routes do not verify the X-User-ID header
+func newAuditEvent(r *http.Request, actorID, action, targetType, targetID string) *models.AuditEvent {
+	return &models.AuditEvent{
+		ActorID:    actorID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   auditString(targetID),
+		IP:         middleware.ClientIP(r),
+		UserAgent:  auditString(r.UserAgent()),
+		RequestID:  r.Header.Get(middleware.RequestIDHeader),
+	}
+}
+
+// recordAudit stores an event that is not part of any other change, such as a failed
+// login; a failure is logged rather than reported, since the response is already decided
+// A client disconnecting does not cancel the record
+func recordAudit(ctx context.Context, db store.Repository, event *models.AuditEvent) {
+	if err := db.RecordAuditEvent(context.WithoutCancel(ctx), event); err != nil {
+		middleware.Logger(ctx).Error("failed to record audit event", slog.String("action", event.Action), slog.Any("error", err))
+	}
+}
+
+// setBalanceChange records on event a balance change of delta that left the balance at after
+func setBalanceChange(event *models.AuditEvent, after models.Money, delta int64) {
+	before := models.Money{Amount: after.Amount - delta, Currency: after.Currency}
+	event.SetChange(map[string]any{"balance": before}, map[string]any{"balance": after})
+}
+
+// setClosure records on event the closure of an account and its payout, which may be nil
+func setClosure(event *models.AuditEvent, before, after *models.Account, payout *models.Transaction) {
+	event.SetChange(
+		map[string]any{"status": before.Status, "balance": before.GetBalance()},
+		map[string]any{"status": after.Status, "balance": after.GetBalance()},
+	)
+	if payout != nil {
+		event.SetDetails(map[string]any{
+			"payoutAccountId": payout.CounterpartyAccountID,
+			"payoutAmount":    payout.GetAmount(),
+			"reference":       payout.Reference,
+		})
+	}
+}
+
+// auditString makes a client-controlled value safe to store: valid UTF-8 of at most
+// maxAuditFieldLength bytes
+func auditString(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	if len(s) <= maxAuditFieldLength {
+		return s
+	}
+	n := maxAuditFieldLength
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// rawJSON turns a stored JSON object into a response field, leaving absent objects out
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return nil
+	}
+	return json.RawMessage(s)
+}
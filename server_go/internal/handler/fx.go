@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"server/internal/fx"
+	"server/internal/models"
+	"server/internal/store"
+)
+
+// ============= FX Handlers =============
+
+// listRates handles GET /fx/rates
+func listRates(rates *fx.Table) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sendSuccess(w, http.StatusOK, ratesPayload{Rates: rates.Rates()})
+	}
+}
+
+// replaceRates handles PUT /admin/fx/rates
+// Replaces the whole rate table; quotes issued earlier keep their locked rate
+// The table is only changed once the audit event holding the old and new rates is stored
+func replaceRates(db store.Repository, rates *fx.Table) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ratesPayload
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		var auditErr error
+		err := rates.ReplaceFunc(req.Rates, func(before, after []fx.Rate) error {
+			auditErr = db.WithTx(r.Context(), func(tx store.Repository) error {
+				if err := tx.ReplaceFXRates(r.Context(), after); err != nil {
+					return err
+				}
+				event := newAuditEvent(r, r.Header.Get("X-User-ID"), models.AuditFXRates, models.AuditTargetFX, "")
+				event.SetChange(map[string]any{"rates": before}, map[string]any{"rates": after})
+				return tx.RecordAuditEvent(r.Context(), event)
+			})
+			return auditErr
+		})
+		switch {
+		case auditErr != nil:
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		case err != nil:
+			sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		sendSuccess(w, http.StatusOK, ratesPayload{Rates: rates.Rates()})
+	}
+}
+
+// createQuote handles POST /fx/quotes
+// Locks the current rate for the caller; the quote ID is passed to /account/transfer
+func createQuote(db store.Repository, quoter *fx.Quoter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req quoteRequest
+		if !decodeMoneyRequest(w, r, &req) {
+			return
+		}
+		if !req.Amount.IsPositive() {
+			sendErrorCode(w, http.StatusBadRequest, "invalid_amount", models.ErrInvalidAmount.Error())
+			return
+		}
+
+		quote, err := quoter.Quote(r.Header.Get("X-User-ID"), req.Amount.Currency, req.ToCurrency)
+		if err != nil {
+			sendFXError(w, err)
+			return
+		}
+
+		rate, _ := fx.ParseRate(quote.Rate)
+		converted, err := fx.Convert(req.Amount, rate, quote.ToCurrency)
+		if err != nil {
+			sendFXError(w, err)
+			return
+		}
+
+		if err := db.CreateFXQuote(r.Context(), quote); err != nil {
+			sendError(w, http.StatusInternalServerError, "failed to create quote")
+			return
+		}
+
+		sendSuccess(w, http.StatusCreated, quoteResponse{
+			QuoteId:         quote.ID,
+			Amount:          req.Amount,
+			ConvertedAmount: converted,
+			Rate:            quote.Rate,
+			MidRate:         quote.MidRate,
+			SpreadBps:       quote.SpreadBps,
+			ExpiresAt:       quote.ExpiresAt,
+		})
+	}
+}
+
+// sendFXError maps errors from quoting and conversion to HTTP responses
+func sendFXError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrRateUnavailable):
+		sendErrorCode(w, http.StatusUnprocessableEntity, "rate_unavailable", err.Error())
+	case errors.Is(err, models.ErrUnknownCurrency), errors.Is(err, models.ErrQuoteMismatch):
+		sendErrorCode(w, http.StatusBadRequest, "invalid_currency", err.Error())
+	default:
+		sendBalanceError(w, err)
+	}
+}
@@ -3,44 +3,133 @@ package handler
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"server/internal/auth"
+	"server/internal/config"
+	"server/internal/fx"
+	"server/internal/metrics"
 	"server/internal/middleware"
 	"server/internal/models"
+	"server/internal/notify"
 	"server/internal/store"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi"
 	"gorm.io/gorm"
 )
 
 // Routes registers all account-related API routes
-func Routes(r *chi.Mux, db *store.DB) {
+func Routes(r *chi.Mux, db store.Repository, cfg *config.Config, rates *fx.Table, revocations *auth.Revocations,
+	passwords *auth.PasswordPolicy, notifier notify.Notifier, logger *slog.Logger) {
+	// Every request gets an ID that is echoed back and stored with its audit events
+	r.Use(middleware.RequestID)
+	// Every request is logged with its ID and counted, including CORS preflights and unmatched routes
+	r.Use(middleware.Logging(logger))
+	r.Use(middleware.Metrics)
 	// Apply CORS middleware globally
 	r.Use(middleware.CORS)
-	
+
 	// Login route (no auth required)
-	r.Post("/login", login(db))
-	r.Post("/register", register(db))
+	limits := newLoginLimits(cfg.Login)
+	keyTTL := time.Duration(cfg.Idempotency.KeyTTL) * time.Second
+	r.Post("/login", login(db, limits))
+	r.Post("/login/2fa", loginTwoFactor(db, limits))
+	r.Post("/register", register(db, passwords, cfg.Auth.AdminUserIDs))
+	// Password reset needs a way to send users their token; without a notifier it is off
+	// Reset requests have throttles of their own, so that they cannot lock users out of logging in
+	if notifier != nil {
+		resetTTL := time.Duration(cfg.Password.ResetTTL) * time.Second
+		r.Post("/password/reset", requestPasswordReset(db, notifier, newLoginLimits(cfg.Login), resetTTL))
+		r.Post("/password/reset/confirm", confirmPasswordReset(db, passwords, revocations))
+	}
+	r.Post("/token/refresh", refreshToken(db))
+	r.Get("/.well-known/jwks.json", jwks())
+
+	// Logout routes revoke the presented access token (or all of the user's tokens)
+	r.Group(func(router chi.Router) {
+		router.Use(middleware.Auth(revocations))
+		router.Post("/logout", logout(db, revocations))
+		router.Post("/logout-all", logoutAll(db, revocations))
+	})
 
 	r.Route("/account", func(router chi.Router) {
 		// Apply auth middleware to all /account routes
-		router.Use(middleware.Auth)
-		// Apply logging middleware to all /account routes
-		router.Use(middleware.Logging)
+		router.Use(middleware.Auth(revocations))
 		router.Get("/", getBalance(db))
-		router.Post("/deposit", deposit(db))
-		router.Post("/withdraw", withdraw(db))
+
+		// Money-moving routes honor the Idempotency-Key header so clients can retry safely
+		router.Group(func(router chi.Router) {
+			router.Use(middleware.Idempotency(db, keyTTL))
+			router.Post("/deposit", deposit(db))
+			router.Post("/withdraw", withdraw(db))
+			router.Post("/transfer", transfer(db))
+		})
+		router.Get("/transactions", listTransactions(db))
+		router.Post("/password", changePassword(db, limits, passwords, revocations))
+
+		// Two-factor enrollment; takes effect from the next login
+		router.Post("/2fa/enroll", enrollTwoFactor(db, limits, cfg.Auth.Issuer))
+		router.Post("/2fa/confirm", confirmTwoFactor(db, limits))
+	})
+
+	r.Route("/accounts", func(router chi.Router) {
+		router.Use(middleware.Auth(revocations))
+		router.Get("/", listAccounts(db))
+		router.Post("/", openAccount(db))
+		router.With(middleware.Idempotency(db, keyTTL)).Post("/{accountId}/close", closeAccount(db))
+	})
+
+	// Operator routes for support staff; every call is recorded in the audit trail
+	// Role management, rates, balance adjustments, closures and the audit log are admin-only
+	r.Route("/admin", func(router chi.Router) {
+		router.Use(middleware.Auth(revocations))
+		router.Use(middleware.RequireRole(models.RoleAdmin, models.RoleSupport))
+		router.Get("/users", searchUsers(db))
+		router.Get("/users/{userId}", getUser(db))
+		router.Post("/users/{userId}/unlock", unlockUser(db, limits))
+		router.Get("/accounts/{accountId}", getAccount(db))
+		router.Get("/accounts/{accountId}/transactions", listAccountTransactions(db))
+		router.Post("/accounts/{accountId}/freeze", setAccountStatus(db, models.AccountFrozen))
+		router.Post("/accounts/{accountId}/unfreeze", setAccountStatus(db, models.AccountActive))
+		router.Group(func(router chi.Router) {
+			router.Use(middleware.RequireRole(models.RoleAdmin))
+			router.Put("/users/{userId}/roles", setUserRoles(db, revocations))
+			router.Put("/fx/rates", replaceRates(db, rates))
+			router.Group(func(router chi.Router) {
+				router.Use(middleware.Idempotency(db, keyTTL))
+				router.Post("/accounts/{accountId}/adjustments", adjustBalance(db))
+				router.Post("/accounts/{accountId}/close", adminCloseAccount(db))
+			})
+			router.Get("/audit", listAuditEvents(db))
+			router.Get("/audit/verify", verifyAuditLog(db))
+		})
+	})
+
+	quoter := fx.NewQuoter(rates, cfg.FX.SpreadBps, time.Duration(cfg.FX.QuoteTTL)*time.Second)
+	r.Route("/fx", func(router chi.Router) {
+		// Rates are replaced by admins through /admin/fx/rates
+		router.Use(middleware.Auth(revocations))
+		router.Get("/rates", listRates(rates))
+		router.Post("/quotes", createQuote(db, quoter))
 	})
 }
 
 // ============= Handlers =============
 
 // getBalance handles GET /account
-func getBalance(db *store.DB) http.HandlerFunc {
+// The account is selected with the "id" query parameter, defaulting to the user's primary account
+func getBalance(db store.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := r.Header.Get("X-User-ID")
-		account, err := getAccountForUser(r.Context(), db, userID)
+		account, err := resolveAccount(r.Context(), db, userID, r.URL.Query().Get("id"))
 		if err != nil {
 			if err == gorm.ErrRecordNotFound {
 				sendError(w, http.StatusNotFound, "account not found")
@@ -58,18 +147,15 @@ func getBalance(db *store.DB) http.HandlerFunc {
 }
 
 // deposit handles POST /account/deposit
-func deposit(db *store.DB) http.HandlerFunc {
+func deposit(db store.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Amount int `json:"amount"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			sendError(w, http.StatusBadRequest, "invalid request body")
+		var req depositRequest
+		if !decodeMoneyRequest(w, r, &req) {
 			return
 		}
 
 		userID := r.Header.Get("X-User-ID")
-		account, err := getAccountForUser(r.Context(), db, userID)
+		account, err := resolveAccount(r.Context(), db, userID, req.AccountId)
 		if err != nil {
 			if err == gorm.ErrRecordNotFound {
 				sendError(w, http.StatusNotFound, "account not found")
@@ -79,36 +165,85 @@ func deposit(db *store.DB) http.HandlerFunc {
 			return
 		}
 
-		if err := account.Deposit(req.Amount); err != nil {
-			sendError(w, http.StatusBadRequest, err.Error())
+		// Validation and balance change happen atomically inside the store
+		err = db.WithTx(r.Context(), func(tx store.Repository) error {
+			var err error
+			if account, err = tx.Deposit(r.Context(), userID, account.ID, req.Amount); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, userID, models.AuditDeposit, models.AuditTargetAccount, account.ID)
+			setBalanceChange(event, account.GetBalance(), req.Amount.Amount)
+			return tx.RecordAuditEvent(r.Context(), event)
+		})
+		if err != nil {
+			sendBalanceError(w, err)
 			return
 		}
 
-		if err := db.UpdateBalance(r.Context(), account.ID, account.GetBalance()); err != nil {
-			sendError(w, http.StatusInternalServerError, "failed to update balance")
+		metrics.MoneyMoved(metrics.OperationDeposit, req.Amount)
+		sendSuccess(w, http.StatusOK, depositResponse{
+			AccountId: account.ID,
+			Balance:   account.GetBalance(),
+		})
+	}
+}
+
+// withdraw handles POST /account/withdraw
+func withdraw(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req withdrawRequest
+		if !decodeMoneyRequest(w, r, &req) {
 			return
 		}
 
-		sendSuccess(w, http.StatusOK, depositResponse{
+		userID := r.Header.Get("X-User-ID")
+		account, err := resolveAccount(r.Context(), db, userID, req.AccountId)
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				sendError(w, http.StatusNotFound, "account not found")
+			} else {
+				sendError(w, http.StatusInternalServerError, "database error")
+			}
+			return
+		}
+
+		// Validation and balance change happen atomically inside the store
+		err = db.WithTx(r.Context(), func(tx store.Repository) error {
+			var err error
+			if account, err = tx.Withdraw(r.Context(), userID, account.ID, req.Amount); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, userID, models.AuditWithdrawal, models.AuditTargetAccount, account.ID)
+			setBalanceChange(event, account.GetBalance(), -req.Amount.Amount)
+			return tx.RecordAuditEvent(r.Context(), event)
+		})
+		if err != nil {
+			sendBalanceError(w, err)
+			return
+		}
+
+		metrics.MoneyMoved(metrics.OperationWithdraw, req.Amount)
+		sendSuccess(w, http.StatusOK, withdrawResponse{
 			AccountId: account.ID,
 			Balance:   account.GetBalance(),
 		})
 	}
 }
 
-// withdraw handles POST /account/withdraw
-func withdraw(db *store.DB) http.HandlerFunc {
+// transfer handles POST /account/transfer
+func transfer(db store.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Amount int `json:"amount"`
+		var req transferRequest
+		if !decodeMoneyRequest(w, r, &req) {
+			return
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			sendError(w, http.StatusBadRequest, "invalid request body")
+		if req.ToAccountId == "" && req.ToUserId == "" {
+			sendError(w, http.StatusBadRequest, "toAccountId or toUserId is required")
 			return
 		}
 
 		userID := r.Header.Get("X-User-ID")
-		account, err := getAccountForUser(r.Context(), db, userID)
+		account, err := resolveAccount(r.Context(), db, userID, req.FromAccountId)
 		if err != nil {
 			if err == gorm.ErrRecordNotFound {
 				sendError(w, http.StatusNotFound, "account not found")
@@ -118,28 +253,216 @@ func withdraw(db *store.DB) http.HandlerFunc {
 			return
 		}
 
-		if err := account.Withdraw(req.Amount); err != nil {
+		// Resolve the recipient user to their account; unknown account IDs are
+		// reported by the store inside the transfer transaction
+		toAccountID := req.ToAccountId
+		if toAccountID == "" {
+			recipient, err := getAccountForUser(r.Context(), db, req.ToUserId)
+			if err == gorm.ErrRecordNotFound {
+				err = models.ErrRecipientNotFound
+			}
+			if err != nil {
+				sendBalanceError(w, err)
+				return
+			}
+			toAccountID = recipient.ID
+		}
+
+		var record *models.Transaction
+		err = db.WithTx(r.Context(), func(tx store.Repository) error {
+			var err error
+			record, err = tx.Transfer(r.Context(), userID, account.ID, toAccountID, req.Amount, req.QuoteId)
+			if err != nil {
+				return err
+			}
+			event := newAuditEvent(r, userID, models.AuditTransfer, models.AuditTargetAccount, account.ID)
+			setBalanceChange(event, record.GetBalanceAfter(), -record.Amount)
+			details := map[string]any{"toAccountId": toAccountID, "amount": record.GetAmount(), "reference": record.Reference}
+			if converted, ok := record.GetCounterAmount(); ok {
+				details["convertedAmount"] = converted
+				details["fxRate"] = record.FXRate
+			}
+			event.SetDetails(details)
+			return tx.RecordAuditEvent(r.Context(), event)
+		})
+		if err != nil {
+			sendBalanceError(w, err)
+			return
+		}
+
+		resp := transferResponse{
+			AccountId:   account.ID,
+			ToAccountId: toAccountID,
+			Amount:      record.GetAmount(),
+			FXRate:      record.FXRate,
+			Balance:     record.GetBalanceAfter(),
+			Reference:   record.Reference,
+		}
+		if converted, ok := record.GetCounterAmount(); ok {
+			resp.ConvertedAmount = &converted
+		}
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// listTransactions handles GET /account/transactions
+// Query parameters: accountId, type, from, to (RFC 3339), limit and cursor (from a previous page)
+func listTransactions(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseTransactionFilter(r)
+		if err != nil {
 			sendError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		if err := db.UpdateBalance(r.Context(), account.ID, account.GetBalance()); err != nil {
-			sendError(w, http.StatusInternalServerError, "failed to update balance")
+		userID := r.Header.Get("X-User-ID")
+		account, err := resolveAccount(r.Context(), db, userID, r.URL.Query().Get("accountId"))
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				sendError(w, http.StatusNotFound, "account not found")
+			} else {
+				sendError(w, http.StatusInternalServerError, "database error")
+			}
 			return
 		}
 
-		sendSuccess(w, http.StatusOK, withdrawResponse{
-			AccountId: account.ID,
-			Balance:   account.GetBalance(),
+		resp, err := transactionPage(r.Context(), db, account.ID, filter)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// transactionPage loads one page of an account's history
+func transactionPage(ctx context.Context, db store.Repository, accountID string, filter store.TransactionFilter) (transactionsResponse, error) {
+	// Fetch one extra record to find out whether another page exists
+	limit := filter.Limit
+	filter.Limit++
+	transactions, err := db.ListTransactions(ctx, accountID, filter)
+	if err != nil {
+		return transactionsResponse{}, err
+	}
+
+	resp := transactionsResponse{Transactions: []transactionResponse{}}
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+		resp.NextCursor = encodeCursor(transactions[limit-1].ID)
+	}
+	for _, t := range transactions {
+		resp.Transactions = append(resp.Transactions, newTransactionResponse(t))
+	}
+	return resp, nil
+}
+
+// listAccounts handles GET /accounts
+func listAccounts(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Header.Get("X-User-ID")
+		accounts, err := db.GetAccountsByUserID(r.Context(), userID)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		resp := accountsResponse{Accounts: []accountResponse{}}
+		for _, account := range accounts {
+			resp.Accounts = append(resp.Accounts, newAccountResponse(account))
+		}
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// openAccount handles POST /accounts
+func openAccount(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req openAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Type == "" {
+			req.Type = models.AccountChecking
+		}
+		if !models.ValidAccountType(req.Type) {
+			sendError(w, http.StatusBadRequest, models.ErrInvalidAccountType.Error())
+			return
+		}
+		if req.Currency == "" {
+			req.Currency = models.DefaultCurrency
+		}
+		if !models.ValidCurrency(req.Currency) {
+			sendError(w, http.StatusBadRequest, models.ErrUnknownCurrency.Error())
+			return
+		}
+
+		account := &models.Account{
+			UserID:   r.Header.Get("X-User-ID"),
+			Type:     req.Type,
+			Currency: req.Currency,
+		}
+		if err := db.CreateAccount(r.Context(), account); err != nil {
+			sendError(w, http.StatusInternalServerError, "failed to create account")
+			return
+		}
+
+		sendSuccess(w, http.StatusCreated, newAccountResponse(*account))
+	}
+}
+
+// closeAccount handles POST /accounts/{accountId}/close
+// Any remaining balance is paid out to payoutAccountId, otherwise it must be zero
+// Frozen accounts stay frozen; only operators can close them
+func closeAccount(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req closeAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		userID := r.Header.Get("X-User-ID")
+		account, err := db.GetAccountForUser(r.Context(), userID, chi.URLParam(r, "accountId"))
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				sendError(w, http.StatusNotFound, "account not found")
+			} else {
+				sendError(w, http.StatusInternalServerError, "database error")
+			}
+			return
+		}
+
+		var resp closeAccountResponse
+		err = db.WithTx(r.Context(), func(tx store.Repository) error {
+			closed, payout, err := tx.CloseAccount(r.Context(), account.ID, req.PayoutAccountId, false)
+			if err != nil {
+				return err
+			}
+			resp = newCloseAccountResponse(*closed, payout)
+			event := newAuditEvent(r, userID, models.AuditAccountClose, models.AuditTargetAccount, account.ID)
+			setClosure(event, account, closed, payout)
+			return tx.RecordAuditEvent(r.Context(), event)
 		})
+		if err != nil {
+			sendBalanceError(w, err)
+			return
+		}
+		sendSuccess(w, http.StatusOK, resp)
 	}
 }
 
 // sendError sends an error response in JSON format
 func sendError(w http.ResponseWriter, statusCode int, message string) {
+	sendErrorCode(w, statusCode, "", message)
+}
+
+// sendErrorCode sends an error response carrying a machine-readable error code
+func sendErrorCode(w http.ResponseWriter, statusCode int, code, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(errorResponse{Error: message})
+	json.NewEncoder(w).Encode(errorResponse{Error: message, Code: code})
 }
 
 // sendSuccess sends a successful response in JSON format
@@ -149,20 +472,90 @@ func sendSuccess(w http.ResponseWriter, statusCode int, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
-// getAccountForUser retrieves the account for an authenticated user
-func getAccountForUser(ctx context.Context, db *store.DB, userID string) (*models.Account, error) {
+// decodeMoneyRequest parses the JSON body of a money-moving request into v
+// Problems with an amount are reported verbatim so clients can correct them
+func decodeMoneyRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, models.ErrUnknownCurrency), errors.Is(err, models.ErrInvalidMoneyFormat):
+		sendErrorCode(w, http.StatusBadRequest, "invalid_amount", err.Error())
+	case errors.Is(err, models.ErrAmountOverflow):
+		sendErrorCode(w, http.StatusBadRequest, "amount_out_of_range", err.Error())
+	default:
+		sendError(w, http.StatusBadRequest, "invalid request body")
+	}
+	return false
+}
+
+// sendBalanceError maps errors returned by balance-changing store operations to HTTP responses
+func sendBalanceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidAmount):
+		sendErrorCode(w, http.StatusBadRequest, "invalid_amount", err.Error())
+	case errors.Is(err, models.ErrInsufficientBalance):
+		sendErrorCode(w, http.StatusBadRequest, "insufficient_funds", err.Error())
+	case errors.Is(err, models.ErrCurrencyMismatch):
+		sendErrorCode(w, http.StatusBadRequest, "currency_mismatch", err.Error())
+	case errors.Is(err, models.ErrAmountOverflow):
+		sendErrorCode(w, http.StatusBadRequest, "amount_out_of_range", err.Error())
+	case errors.Is(err, models.ErrQuoteRequired):
+		sendErrorCode(w, http.StatusBadRequest, "quote_required", err.Error())
+	case errors.Is(err, models.ErrQuoteNotFound):
+		sendErrorCode(w, http.StatusNotFound, "quote_not_found", err.Error())
+	case errors.Is(err, models.ErrQuoteExpired):
+		sendErrorCode(w, http.StatusConflict, "quote_expired", err.Error())
+	case errors.Is(err, models.ErrQuoteMismatch):
+		sendErrorCode(w, http.StatusBadRequest, "quote_mismatch", err.Error())
+	case errors.Is(err, models.ErrSelfTransfer):
+		sendErrorCode(w, http.StatusBadRequest, "self_transfer", err.Error())
+	case errors.Is(err, models.ErrZeroAdjustment):
+		sendErrorCode(w, http.StatusBadRequest, "invalid_amount", err.Error())
+	case errors.Is(err, models.ErrAccountFrozen):
+		sendErrorCode(w, http.StatusConflict, "account_frozen", err.Error())
+	case errors.Is(err, models.ErrAccountClosed):
+		sendErrorCode(w, http.StatusConflict, "account_closed", err.Error())
+	case errors.Is(err, models.ErrAccountNotEmpty):
+		sendErrorCode(w, http.StatusConflict, "account_not_empty", err.Error())
+	case errors.Is(err, models.ErrInvalidTransition):
+		sendErrorCode(w, http.StatusConflict, "invalid_status_transition", err.Error())
+	case errors.Is(err, models.ErrRecipientNotFound):
+		sendErrorCode(w, http.StatusNotFound, "recipient_not_found", err.Error())
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		sendErrorCode(w, http.StatusNotFound, "account_not_found", "account not found")
+	default:
+		sendError(w, http.StatusInternalServerError, "failed to update balance")
+	}
+}
+
+// resolveAccount returns the account a request operates on: the given account if the
+// user owns it, or the user's primary account when no account ID was supplied
+func resolveAccount(ctx context.Context, db store.Repository, userID, accountID string) (*models.Account, error) {
+	if accountID == "" {
+		return getAccountForUser(ctx, db, userID)
+	}
+	return db.GetAccountForUser(ctx, userID, accountID)
+}
+
+// getAccountForUser retrieves the primary (oldest open) account for an authenticated user
+func getAccountForUser(ctx context.Context, db store.Repository, userID string) (*models.Account, error) {
 	accounts, err := db.GetAccountsByUserID(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
-	if len(accounts) == 0 {
-		return nil, gorm.ErrRecordNotFound
+	for i := range accounts {
+		if accounts[i].Status != models.AccountClosed {
+			return &accounts[i], nil
+		}
 	}
-	return &accounts[0], nil
+	return nil, gorm.ErrRecordNotFound
 }
 
 // register handles POST /register
-func register(db *store.DB) http.HandlerFunc {
+// The IDs in reserved bootstrap the admin role, so they cannot be taken by registering;
+// they are answered like existing users to keep the list private
+func register(db store.Repository, passwords *auth.PasswordPolicy, reserved []string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Parse incoming JSON request body
 		var req registerRequest
@@ -176,9 +569,13 @@ func register(db *store.DB) http.HandlerFunc {
 			sendError(w, http.StatusBadRequest, "userId and password are required")
 			return
 		}
+		if err := passwords.Check(req.UserId, req.Password); err != nil {
+			sendErrorCode(w, http.StatusBadRequest, "weak_password", err.Error())
+			return
+		}
 
-		_, err := db.GetUserByID(req.UserId)
-		if err == nil {
+		_, err := db.GetUserByID(r.Context(), req.UserId)
+		if err == nil || slices.Contains(reserved, req.UserId) {
 			sendError(w, http.StatusBadRequest, "user already exists")
 			return
 		}
@@ -194,24 +591,28 @@ func register(db *store.DB) http.HandlerFunc {
 		}
 
 		// Use transaction to ensure atomicity: both User and Account created together
-		err = db.WithTx(func(txDB *store.DB) error {
+		err = db.WithTx(r.Context(), func(txDB store.Repository) error {
 			user := &models.User{
 				ID:       req.UserId,
 				Password: hashedPassword,
 			}
-			if err := txDB.CreateUser(user); err != nil {
+			if err := txDB.CreateUser(r.Context(), user); err != nil {
 				return err
 			}
 
 			account := &models.Account{
-				UserID:  req.UserId,
-				Balance: 0,
+				UserID:   req.UserId,
+				Type:     models.AccountChecking,
+				Currency: models.DefaultCurrency,
+				Balance:  0,
 			}
-			if err := txDB.CreateAccount(account); err != nil {
+			if err := txDB.CreateAccount(r.Context(), account); err != nil {
 				return err
 			}
 
-			return nil
+			event := newAuditEvent(r, user.ID, models.AuditRegister, models.AuditTargetUser, user.ID)
+			event.SetDetails(map[string]any{"accountId": account.ID})
+			return txDB.RecordAuditEvent(r.Context(), event)
 		})
 		if err != nil {
 			sendError(w, http.StatusInternalServerError, "failed to create user and account")
@@ -227,7 +628,7 @@ func register(db *store.DB) http.HandlerFunc {
 
 // login handles POST /login
 // Authenticates user with userId and password, returns a JWT token
-func login(db *store.DB) http.HandlerFunc {
+func login(db store.Repository, limits *loginLimits) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Parse incoming JSON request body
 		var req loginRequest
@@ -236,32 +637,360 @@ func login(db *store.DB) http.HandlerFunc {
 			return
 		}
 
+		// Refuse attempts while the user ID or the client IP is backing off
+		ip := middleware.ClientIP(r)
+		if wait := max(limits.users.Wait(req.UserId), limits.ips.Wait(ip)); wait > 0 {
+			sendTooManyAttempts(w, wait)
+			return
+		}
+
 		// Find user by ID
-		user, err := db.GetUserByID(req.UserId)
+		user, err := db.GetUserByID(r.Context(), req.UserId)
+		if err != nil && err != gorm.ErrRecordNotFound {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		// Verify password; unknown and locked users cost a bcrypt comparison too, so that
+		// response times do not reveal which user IDs exist
+		authenticated := false
 		if err != nil {
-			if err == gorm.ErrRecordNotFound {
-				sendError(w, http.StatusUnauthorized, "invalid userId or password")
+			models.CheckDummyPassword(req.Password)
+			user = nil
+		} else {
+			authenticated = models.CheckPassword(user.Password, req.Password) == nil
+		}
+
+		// A persisted lockout is answered like a wrong password and counted as one, since
+		// unknown user IDs are only throttled in memory and a distinct answer would tell
+		// the two apart after a restart
+		reason := "invalid_credentials"
+		if user != nil && user.IsLocked(time.Now()) {
+			authenticated = false
+			reason = "locked"
+		}
+
+		if !authenticated {
+			if err := limits.failure(r.Context(), db, req.UserId, ip); err != nil {
+				sendError(w, http.StatusInternalServerError, "database error")
 				return
 			}
+			event := newAuditEvent(r, "", models.AuditLoginFailure, models.AuditTargetUser, req.UserId)
+			event.SetDetails(map[string]any{"reason": reason})
+			recordAudit(r.Context(), db, event)
+			metrics.AuthFailure(reason)
+			sendError(w, http.StatusUnauthorized, "invalid userId or password")
+			return
+		}
+
+		// Users with two-factor authentication get a challenge instead of tokens;
+		// their failure count is only reset once the second step succeeds
+		if user.TOTPEnabled {
+			challenge, err := auth.GenerateChallengeToken(user.ID)
+			if err != nil {
+				sendError(w, http.StatusInternalServerError, "failed to generate token")
+				return
+			}
+			sendSuccess(w, http.StatusOK, challengeResponse{
+				TwoFactorRequired: true,
+				ChallengeToken:    challenge,
+				ExpiresIn:         int(auth.ChallengeTokenTTL.Seconds()),
+			})
+			return
+		}
+
+		if err := limits.success(r.Context(), db, user, ip); err != nil {
 			sendError(w, http.StatusInternalServerError, "database error")
 			return
 		}
 
-		// Verify password
-		if err := models.CheckPassword(user.Password, req.Password); err != nil {
-			sendError(w, http.StatusUnauthorized, "invalid userId or password")
+		resp, err := completeLogin(r, db, user, "password")
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "failed to generate token")
 			return
 		}
 
-		// Generate JWT token (no database storage required - stateless)
-		token, err := auth.GenerateJWT(req.UserId)
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// loginLimits holds the brute-force protection state shared by login requests
+type loginLimits struct {
+	policy models.LoginPolicy // per-user policy, also persisted on models.User
+	users  *auth.Throttle     // failures per submitted user ID, known or not
+	ips    *auth.Throttle     // failures per client IP
+}
+
+// newLoginLimits creates the login throttles from configuration
+func newLoginLimits(cfg config.LoginConfig) *loginLimits {
+	policy := models.LoginPolicy{
+		MaxAttempts: cfg.MaxAttempts,
+		BackoffBase: time.Duration(cfg.BackoffBase) * time.Second,
+		BackoffMax:  time.Duration(cfg.BackoffMax) * time.Second,
+		Lockout:     time.Duration(cfg.LockoutDuration) * time.Second,
+	}
+	ipPolicy := policy
+	ipPolicy.FreeAttempts = cfg.IPFreeAttempts
+	ipPolicy.MaxAttempts = cfg.IPMaxAttempts
+	return &loginLimits{
+		policy: policy,
+		users:  auth.NewThrottle(policy),
+		ips:    auth.NewThrottle(ipPolicy),
+	}
+}
+
+// failure records a failed login attempt for userID from ip
+// Known users also get the lockout persisted, so that it survives a restart; the write
+// is attempted for unknown user IDs as well, where it changes nothing, so that both
+// cost the same database round trip and fail alike if the database is down
+// The failure is stored even if the client disconnects, which would otherwise let it
+// avoid the lockout by dropping the connection as soon as the password was checked
+func (l *loginLimits) failure(ctx context.Context, db store.Repository, userID, ip string) error {
+	l.users.Failure(userID)
+	l.ips.Failure(ip)
+	_, err := db.RecordLoginFailure(context.WithoutCancel(ctx), userID, l.policy)
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	return err
+}
+
+// success forgets the failed attempts of a user who completed the login, and those of
+// the client IP it came from
+func (l *loginLimits) success(ctx context.Context, db store.Repository, user *models.User, ip string) error {
+	l.users.Success(user.ID)
+	l.ips.Success(ip)
+	if user.FailedLoginAttempts > 0 || user.LockedUntil != nil {
+		return db.ResetLoginFailures(ctx, user.ID)
+	}
+	return nil
+}
+
+// sendTooManyAttempts rejects a login that arrives while attempts are refused
+func sendTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	metrics.AuthFailure("too_many_attempts")
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	sendErrorCode(w, http.StatusTooManyRequests, "too_many_attempts", "too many failed login attempts, try again later")
+}
+
+// refreshToken handles POST /token/refresh
+// Exchanges a refresh token for a new access token and a new refresh token
+func refreshToken(db store.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req refreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			sendError(w, http.StatusBadRequest, "refreshToken is required")
+			return
+		}
+
+		token, hash, err := auth.GenerateRefreshToken()
 		if err != nil {
 			sendError(w, http.StatusInternalServerError, "failed to generate token")
 			return
 		}
+		next := &models.RefreshToken{
+			TokenHash: hash,
+			ExpiresAt: time.Now().UTC().Add(auth.RefreshTokenTTL()),
+		}
+
+		current, err := db.RotateRefreshToken(r.Context(), auth.HashRefreshToken(req.RefreshToken), next)
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrRefreshTokenReused):
+				middleware.Logger(r.Context()).Warn("refresh token reuse detected, token family revoked")
+				metrics.AuthFailure("refresh_token_reused")
+				sendErrorCode(w, http.StatusUnauthorized, "refresh_token_reused", err.Error())
+			case errors.Is(err, models.ErrRefreshTokenInvalid):
+				metrics.AuthFailure("refresh_token_invalid")
+				sendErrorCode(w, http.StatusUnauthorized, "refresh_token_invalid", err.Error())
+			default:
+				sendError(w, http.StatusInternalServerError, "database error")
+			}
+			return
+		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(loginResponse{Token: token})
+		// Roles are read again so that changes take effect with the next refresh
+		user, err := db.GetUserByID(r.Context(), current.UserID)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		accessToken, err := auth.GenerateJWT(user.ID, user.RoleList())
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "failed to generate token")
+			return
+		}
+
+		sendSuccess(w, http.StatusOK, loginResponse{
+			Token:        accessToken,
+			RefreshToken: token,
+			ExpiresIn:    int(auth.AccessTokenTTL().Seconds()),
+		})
+	}
+}
+
+// jwks handles GET /.well-known/jwks.json
+// Publishes the public keys access tokens are verified with
+func jwks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		sendSuccess(w, http.StatusOK, auth.Keys().JWKS())
+	}
+}
+
+// logout handles POST /logout
+// Revokes the access token used for the request and, if given, the refresh token family
+func logout(db store.Repository, revocations *auth.Revocations) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Header.Get("X-User-ID")
+		tokenID := r.Header.Get("X-Token-ID")
+
+		// The body is optional; it only carries the refresh token to revoke
+		var req refreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		if req.RefreshToken != "" {
+			if err := db.RevokeRefreshToken(r.Context(), userID, auth.HashRefreshToken(req.RefreshToken)); err != nil {
+				sendError(w, http.StatusInternalServerError, "database error")
+				return
+			}
+		}
+
+		var err error
+		if tokenID != "" {
+			err = revocations.RevokeToken(r.Context(), userID, tokenID)
+		} else {
+			// Tokens issued without an ID can only be revoked together with the rest
+			err = revocations.RevokeUser(r.Context(), userID)
+		}
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// logoutAll handles POST /logout-all
+// Revokes every access token and refresh token issued to the user
+func logoutAll(db store.Repository, revocations *auth.Revocations) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Header.Get("X-User-ID")
+
+		if err := db.RevokeUserRefreshTokens(r.Context(), userID); err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		if err := revocations.RevokeUser(r.Context(), userID); err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// completeLogin starts a new refresh token family for an authenticated user and records
+// the login, naming the method used to authenticate
+func completeLogin(r *http.Request, db store.Repository, user *models.User, method string) (loginResponse, error) {
+	var resp loginResponse
+	err := db.WithTx(r.Context(), func(tx store.Repository) error {
+		var err error
+		if resp, err = issueTokens(r.Context(), tx, user); err != nil {
+			return err
+		}
+		event := newAuditEvent(r, user.ID, models.AuditLogin, models.AuditTargetUser, user.ID)
+		event.SetDetails(map[string]any{"method": method})
+		return tx.RecordAuditEvent(r.Context(), event)
+	})
+	return resp, err
+}
+
+// issueTokens creates an access token and a refresh token starting a new token family
+func issueTokens(ctx context.Context, db store.Repository, user *models.User) (loginResponse, error) {
+	accessToken, err := auth.GenerateJWT(user.ID, user.RoleList())
+	if err != nil {
+		return loginResponse{}, err
+	}
+
+	token, hash, err := auth.GenerateRefreshToken()
+	if err != nil {
+		return loginResponse{}, err
+	}
+	err = db.CreateRefreshToken(ctx, &models.RefreshToken{
+		UserID:    user.ID,
+		TokenHash: hash,
+		ExpiresAt: time.Now().UTC().Add(auth.RefreshTokenTTL()),
+	})
+	if err != nil {
+		return loginResponse{}, err
+	}
+
+	return loginResponse{
+		Token:        accessToken,
+		RefreshToken: token,
+		ExpiresIn:    int(auth.AccessTokenTTL().Seconds()),
+	}, nil
+}
+
+// parseTransactionFilter builds a store filter from the query string of a history request
+func parseTransactionFilter(r *http.Request) (store.TransactionFilter, error) {
+	q := r.URL.Query()
+	filter := store.TransactionFilter{Type: q.Get("type"), Limit: defaultPageSize}
+
+	if filter.Type != "" && !models.ValidTransactionType(filter.Type) {
+		return filter, models.ErrInvalidTransactionType
+	}
+	if v := q.Get("from"); v != "" {
+		from, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, errors.New("from must be an RFC 3339 timestamp")
+		}
+		filter.From = from
+	}
+	if v := q.Get("to"); v != "" {
+		to, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, errors.New("to must be an RFC 3339 timestamp")
+		}
+		filter.To = to
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		filter.Limit = limit
+	}
+	if v := q.Get("cursor"); v != "" {
+		id, err := decodeCursor(v)
+		if err != nil {
+			return filter, errors.New("invalid cursor")
+		}
+		filter.BeforeID = id
+	}
+	return filter, nil
+}
+
+// encodeCursor turns the ID of the last returned record into an opaque page cursor
+func encodeCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(id), 10)))
+}
+
+// decodeCursor reverses encodeCursor
+func decodeCursor(cursor string) (uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil || id == 0 {
+		return 0, errors.New("invalid cursor")
 	}
+	return uint(id), nil
 }
@@ -0,0 +1,1559 @@
+package handler
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"server/internal/auth"
+	"server/internal/config"
+	"server/internal/fx"
+	"server/internal/metrics"
+	"server/internal/middleware"
+	"server/internal/models"
+	"server/internal/notify"
+	"server/internal/store"
+
+	"github.com/go-chi/chi"
+	"gorm.io/gorm"
+)
+
+// testPassword satisfies the password policy of the test server
+const testPassword = "correct horse battery"
+
+// testPasswordHash is the bcrypt hash of testPassword, computed once since hashing is slow
+var testPasswordHash string
+
+func TestMain(m *testing.M) {
+	auth.Configure(auth.Settings{
+		Keys:            auth.NewHMACKeySet([]byte("handler-test-secret-handler-test-secret")),
+		Issuer:          "bank-test",
+		Audience:        "bank-test-api",
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+		EncryptionKey:   make([]byte, auth.EncryptionKeySize),
+	})
+	hash, err := models.HashPassword(testPassword)
+	if err != nil {
+		panic(err)
+	}
+	testPasswordHash = hash
+	os.Exit(m.Run())
+}
+
+// ==================== Test Server ====================
+
+// testServer is the API backed by an in-memory store; requests reach the store through
+// a faultyRepository, so individual operations can be made to fail
+// refs names the accounts created by a test; "{name}" in request paths and bodies
+// stands for the ID of the account named name
+type testServer struct {
+	mem     *store.Memory
+	faults  *faultyRepository
+	handler http.Handler
+	rates   *fx.Table
+	refs    map[string]string
+	logs    *bytes.Buffer // JSON records written by the request logger
+}
+
+// newTestServer starts the API on an empty in-memory store
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	cfg := &config.Config{
+		Idempotency: config.IdempotencyConfig{KeyTTL: 3600},
+		Login: config.LoginConfig{
+			MaxAttempts:     5,
+			IPFreeAttempts:  10,
+			IPMaxAttempts:   50,
+			BackoffBase:     1,
+			BackoffMax:      60,
+			LockoutDuration: 900,
+		},
+		Password: config.PasswordConfig{MinLength: 10, ResetTTL: 3600},
+		Auth:     config.AuthConfig{AdminUserIDs: []string{"root"}},
+	}
+	passwords, err := auth.LoadPasswordPolicy(cfg.Password.MinLength, "")
+	if err != nil {
+		t.Fatalf("LoadPasswordPolicy: %v", err)
+	}
+
+	mem := store.NewMemory()
+	faults := &faultyRepository{Repository: mem, failing: &sync.Map{}}
+	logs := &bytes.Buffer{}
+	logger := slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	rates := fx.NewTable()
+	r := chi.NewRouter()
+	Routes(r, faults, cfg, rates, auth.NewRevocations(faults), passwords, notify.LogNotifier{}, logger)
+	return &testServer{mem: mem, faults: faults, handler: r, rates: rates, refs: map[string]string{}, logs: logs}
+}
+
+// addUser stores a user with the test password and a USD checking account holding
+// balance, named after the user
+func (s *testServer) addUser(t *testing.T, userID string, balance int64) {
+	t.Helper()
+	if err := s.mem.CreateUser(context.Background(), &models.User{ID: userID, Password: testPasswordHash}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	s.addAccount(t, userID, userID, balance)
+}
+
+// addAccount opens another USD account named name for an existing user
+func (s *testServer) addAccount(t *testing.T, userID, name string, balance int64) {
+	t.Helper()
+	account := &models.Account{UserID: userID, Balance: balance, Currency: "USD"}
+	if err := s.mem.CreateAccount(context.Background(), account); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	s.refs[name] = account.ID
+}
+
+// ref returns the ID of the account named name
+func (s *testServer) ref(t *testing.T, name string) string {
+	t.Helper()
+	id, ok := s.refs[name]
+	if !ok {
+		t.Fatalf("no account named %s", name)
+	}
+	return id
+}
+
+// expand replaces the account names in text by their IDs
+func (s *testServer) expand(text string) string {
+	for name, id := range s.refs {
+		text = strings.ReplaceAll(text, "{"+name+"}", id)
+	}
+	return text
+}
+
+// setStatus moves the account named name to status
+func (s *testServer) setStatus(t *testing.T, name, status string) {
+	t.Helper()
+	if _, err := s.mem.SetAccountStatus(context.Background(), s.ref(t, name), status); err != nil {
+		t.Fatalf("SetAccountStatus: %v", err)
+	}
+}
+
+// balance reads the current balance of the account named name
+func (s *testServer) balance(t *testing.T, name string) int64 {
+	t.Helper()
+	account, err := s.mem.GetAccount(context.Background(), s.ref(t, name))
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	return account.Balance
+}
+
+// do sends a request as userID, or anonymously if userID is empty
+// The token carries the roles of the stored user, if there is one
+func (s *testServer) do(t *testing.T, method, path, userID, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, s.expand(path), strings.NewReader(s.expand(body)))
+	req.Header.Set("Content-Type", "application/json")
+	if userID != "" {
+		var roles []string
+		if user, err := s.mem.GetUserByID(context.Background(), userID); err == nil {
+			roles = user.RoleList()
+		}
+		token, err := auth.GenerateJWT(userID, roles)
+		if err != nil {
+			t.Fatalf("GenerateJWT: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// lastLog decodes the most recent record of the request logger
+func (s *testServer) lastLog(t *testing.T) map[string]any {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(s.logs.String()), "\n")
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &record); err != nil {
+		t.Fatalf("decoding log record %q: %v", lines[len(lines)-1], err)
+	}
+	return record
+}
+
+// auditActions lists the actions in the audit log, oldest first
+func (s *testServer) auditActions(t *testing.T) []string {
+	t.Helper()
+	events, err := s.mem.ListAuditEvents(context.Background(), store.AuditFilter{})
+	if err != nil {
+		t.Fatalf("ListAuditEvents: %v", err)
+	}
+	var actions []string
+	for _, event := range slices.Backward(events) {
+		actions = append(actions, event.Action)
+	}
+	return actions
+}
+
+// addAdmin stores a user holding the admin role
+func (s *testServer) addAdmin(t *testing.T, userID string) {
+	t.Helper()
+	user := &models.User{ID: userID, Password: testPasswordHash, Roles: models.RoleAdmin}
+	if err := s.mem.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+}
+
+// ==================== Fault Injection ====================
+
+// errInjected is the error returned by operations a test made fail
+var errInjected = errors.New("injected failure")
+
+// faultyRepository wraps a Repository and fails the operations named in failing
+// Transactions hand out wrapped repositories too, so faults apply inside WithTx
+// failing is a sync.Map, as some handlers keep using the store after their response
+type faultyRepository struct {
+	store.Repository
+	failing *sync.Map
+}
+
+// fault returns errInjected if op is set to fail
+func (f *faultyRepository) fault(op string) error {
+	if _, ok := f.failing.Load(op); ok {
+		return errInjected
+	}
+	return nil
+}
+
+func (f *faultyRepository) WithTx(ctx context.Context, fn func(store.Repository) error) error {
+	if err := f.fault("WithTx"); err != nil {
+		return err
+	}
+	return f.Repository.WithTx(ctx, func(tx store.Repository) error {
+		return fn(&faultyRepository{Repository: tx, failing: f.failing})
+	})
+}
+
+func (f *faultyRepository) CreateUser(ctx context.Context, user *models.User) error {
+	if err := f.fault("CreateUser"); err != nil {
+		return err
+	}
+	return f.Repository.CreateUser(ctx, user)
+}
+
+func (f *faultyRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	if err := f.fault("GetUserByID"); err != nil {
+		return nil, err
+	}
+	return f.Repository.GetUserByID(ctx, id)
+}
+
+func (f *faultyRepository) RecordLoginFailure(ctx context.Context, userID string, policy models.LoginPolicy) (*models.User, error) {
+	if err := f.fault("RecordLoginFailure"); err != nil {
+		return nil, err
+	}
+	return f.Repository.RecordLoginFailure(ctx, userID, policy)
+}
+
+func (f *faultyRepository) ResetLoginFailures(ctx context.Context, userID string) error {
+	if err := f.fault("ResetLoginFailures"); err != nil {
+		return err
+	}
+	return f.Repository.ResetLoginFailures(ctx, userID)
+}
+
+func (f *faultyRepository) CreateAccount(ctx context.Context, account *models.Account) error {
+	if err := f.fault("CreateAccount"); err != nil {
+		return err
+	}
+	return f.Repository.CreateAccount(ctx, account)
+}
+
+func (f *faultyRepository) GetAccountForUser(ctx context.Context, userID, accountID string) (*models.Account, error) {
+	if err := f.fault("GetAccountForUser"); err != nil {
+		return nil, err
+	}
+	return f.Repository.GetAccountForUser(ctx, userID, accountID)
+}
+
+func (f *faultyRepository) GetAccountsByUserID(ctx context.Context, userID string) ([]models.Account, error) {
+	if err := f.fault("GetAccountsByUserID"); err != nil {
+		return nil, err
+	}
+	return f.Repository.GetAccountsByUserID(ctx, userID)
+}
+
+func (f *faultyRepository) Deposit(ctx context.Context, userID, accountID string, amount models.Money) (*models.Account, error) {
+	if err := f.fault("Deposit"); err != nil {
+		return nil, err
+	}
+	return f.Repository.Deposit(ctx, userID, accountID, amount)
+}
+
+func (f *faultyRepository) Withdraw(ctx context.Context, userID, accountID string, amount models.Money) (*models.Account, error) {
+	if err := f.fault("Withdraw"); err != nil {
+		return nil, err
+	}
+	return f.Repository.Withdraw(ctx, userID, accountID, amount)
+}
+
+func (f *faultyRepository) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	if err := f.fault("CreateRefreshToken"); err != nil {
+		return err
+	}
+	return f.Repository.CreateRefreshToken(ctx, token)
+}
+
+func (f *faultyRepository) RecordAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	if err := f.fault("RecordAuditEvent"); err != nil {
+		return err
+	}
+	return f.Repository.RecordAuditEvent(ctx, event)
+}
+
+// ==================== Test Cases ====================
+
+// handlerTest is a single request against a fresh test server
+// setup seeds the store and may send earlier requests; fail names the store operations
+// that fail while the request is handled; check inspects the outcome further
+type handlerTest struct {
+	name   string
+	setup  func(t *testing.T, s *testServer)
+	fail   []string
+	path   string // overrides the path of the endpoint under test
+	user   string // authenticated caller; empty sends no token
+	body   string
+	status int
+	code   string // expected error code, if any
+	error  string // expected error message, if any
+	check  func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder)
+}
+
+// runHandlerTests sends the request of each test to method and path, on a server of its own
+func runHandlerTests(t *testing.T, method, path string, tests []handlerTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			if tt.setup != nil {
+				tt.setup(t, s)
+			}
+			for _, op := range tt.fail {
+				s.faults.failing.Store(op, true)
+			}
+			rec := s.do(t, method, cmp.Or(tt.path, path), tt.user, tt.body)
+			s.faults.failing.Clear()
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d; body: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.code != "" || tt.error != "" {
+				var resp errorResponse
+				decodeBody(t, rec, &resp)
+				if resp.Code != tt.code {
+					t.Errorf("error code = %q, want %q", resp.Code, tt.code)
+				}
+				if tt.error != "" && resp.Error != tt.error {
+					t.Errorf("error = %q, want %q", resp.Error, tt.error)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, s, rec)
+			}
+		})
+	}
+}
+
+// decodeBody decodes a JSON response into v
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode response %q: %v", rec.Body, err)
+	}
+}
+
+// wantNoUser checks that a registration left no user, account or audit event behind
+func wantNoUser(t *testing.T, s *testServer, _ *httptest.ResponseRecorder) {
+	if _, err := s.mem.GetUserByID(context.Background(), "alice"); err != gorm.ErrRecordNotFound {
+		t.Errorf("GetUserByID(alice) = %v, want gorm.ErrRecordNotFound", err)
+	}
+	if accounts, _ := s.mem.GetAccountsByUserID(context.Background(), "alice"); len(accounts) != 0 {
+		t.Errorf("%d accounts left behind", len(accounts))
+	}
+	if actions := s.auditActions(t); len(actions) != 0 {
+		t.Errorf("audit log = %v, want it empty", actions)
+	}
+}
+
+// Hashing cannot fail for passwords the policy accepts, so that error has no case
+func TestRegister(t *testing.T) {
+	body := `{"userId":"alice","password":"` + testPassword + `"}`
+	runHandlerTests(t, http.MethodPost, "/register", []handlerTest{
+		{
+			name:   "creates user, account and audit event",
+			body:   body,
+			status: http.StatusCreated,
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				var resp registerResponse
+				decodeBody(t, rec, &resp)
+				if resp.UserId != "alice" {
+					t.Errorf("userId = %q, want alice", resp.UserId)
+				}
+				user, err := s.mem.GetUserByID(context.Background(), "alice")
+				if err != nil {
+					t.Fatalf("GetUserByID: %v", err)
+				}
+				if models.CheckPassword(user.Password, testPassword) != nil {
+					t.Error("stored password hash does not match the password")
+				}
+				accounts, _ := s.mem.GetAccountsByUserID(context.Background(), "alice")
+				if len(accounts) != 1 || accounts[0].Currency != models.DefaultCurrency || accounts[0].Balance != 0 {
+					t.Errorf("accounts = %+v, want one empty %s account", accounts, models.DefaultCurrency)
+				}
+				if actions := s.auditActions(t); !slices.Equal(actions, []string{models.AuditRegister}) {
+					t.Errorf("audit log = %v, want [%s]", actions, models.AuditRegister)
+				}
+			},
+		},
+		{
+			name:   "malformed body",
+			body:   `{"userId":`,
+			status: http.StatusBadRequest,
+			error:  "invalid request body",
+		},
+		{
+			name:   "missing password",
+			body:   `{"userId":"alice"}`,
+			status: http.StatusBadRequest,
+			error:  "userId and password are required",
+		},
+		{
+			name:   "missing user ID",
+			body:   `{"password":"` + testPassword + `"}`,
+			status: http.StatusBadRequest,
+			error:  "userId and password are required",
+		},
+		{
+			name:   "password too short",
+			body:   `{"userId":"alice","password":"short"}`,
+			status: http.StatusBadRequest,
+			code:   "weak_password",
+			check:  wantNoUser,
+		},
+		{
+			name:   "password equal to user ID",
+			body:   `{"userId":"alice-in-wonderland","password":"Alice-In-Wonderland"}`,
+			status: http.StatusBadRequest,
+			code:   "weak_password",
+			error:  auth.ErrPasswordIsUserID.Error(),
+		},
+		{
+			name:   "user already exists",
+			setup:  func(t *testing.T, s *testServer) { s.addUser(t, "alice", 0) },
+			body:   body,
+			status: http.StatusBadRequest,
+			error:  "user already exists",
+		},
+		{
+			name:   "reserved admin ID",
+			body:   `{"userId":"root","password":"` + testPassword + `"}`,
+			status: http.StatusBadRequest,
+			error:  "user already exists",
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				if _, err := s.mem.GetUserByID(context.Background(), "root"); err != gorm.ErrRecordNotFound {
+					t.Errorf("GetUserByID(root) = %v, want gorm.ErrRecordNotFound", err)
+				}
+			},
+		},
+		{
+			name:   "user lookup fails",
+			fail:   []string{"GetUserByID"},
+			body:   body,
+			status: http.StatusInternalServerError,
+			error:  "database error",
+			check:  wantNoUser,
+		},
+		{
+			name:   "transaction cannot start",
+			fail:   []string{"WithTx"},
+			body:   body,
+			status: http.StatusInternalServerError,
+			error:  "failed to create user and account",
+			check:  wantNoUser,
+		},
+		{
+			name:   "user cannot be created",
+			fail:   []string{"CreateUser"},
+			body:   body,
+			status: http.StatusInternalServerError,
+			error:  "failed to create user and account",
+			check:  wantNoUser,
+		},
+		{
+			name:   "account cannot be created, the user is rolled back",
+			fail:   []string{"CreateAccount"},
+			body:   body,
+			status: http.StatusInternalServerError,
+			error:  "failed to create user and account",
+			check:  wantNoUser,
+		},
+		{
+			name:   "registration cannot be audited, user and account are rolled back",
+			fail:   []string{"RecordAuditEvent"},
+			body:   body,
+			status: http.StatusInternalServerError,
+			error:  "failed to create user and account",
+			check:  wantNoUser,
+		},
+	})
+}
+
+// Challenge tokens cannot fail to sign once auth is configured, so that error has no case
+func TestLogin(t *testing.T) {
+	validLogin := `{"userId":"alice","password":"` + testPassword + `"}`
+	wrongPassword := `{"userId":"alice","password":"wrong password"}`
+	withUser := func(t *testing.T, s *testServer) { s.addUser(t, "alice", 0) }
+	withFailure := func(t *testing.T, s *testServer) {
+		s.addUser(t, "alice", 0)
+		if _, err := s.mem.RecordLoginFailure(context.Background(), "alice", models.LoginPolicy{MaxAttempts: 5}); err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+	}
+	// failFromIP sends n wrong logins for distinct unknown users named after prefix,
+	// which only the throttle of the client IP counts together
+	failFromIP := func(t *testing.T, s *testServer, prefix string, n int) {
+		t.Helper()
+		for i := range n {
+			body := `{"userId":"` + prefix + strconv.Itoa(i) + `","password":"wrong password"}`
+			if rec := s.do(t, http.MethodPost, "/login", "", body); rec.Code != http.StatusUnauthorized {
+				t.Fatalf("failed login %d: status = %d, want 401", i, rec.Code)
+			}
+		}
+	}
+	wantFailures := func(want int) func(*testing.T, *testServer, *httptest.ResponseRecorder) {
+		return func(t *testing.T, s *testServer, _ *httptest.ResponseRecorder) {
+			user, err := s.mem.GetUserByID(context.Background(), "alice")
+			if err != nil {
+				t.Fatalf("GetUserByID: %v", err)
+			}
+			if user.FailedLoginAttempts != want {
+				t.Errorf("failed login attempts = %d, want %d", user.FailedLoginAttempts, want)
+			}
+		}
+	}
+
+	runHandlerTests(t, http.MethodPost, "/login", []handlerTest{
+		{
+			name:   "issues tokens and records the login",
+			setup:  withUser,
+			body:   validLogin,
+			status: http.StatusOK,
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				var resp loginResponse
+				decodeBody(t, rec, &resp)
+				claims, err := auth.VerifyJWT(resp.Token)
+				if err != nil || claims.UserID != "alice" {
+					t.Fatalf("VerifyJWT = %+v, %v; want a token for alice", claims, err)
+				}
+				if resp.RefreshToken == "" || resp.ExpiresIn != 60 {
+					t.Errorf("refresh token %q, expiresIn %d; want a token and 60", resp.RefreshToken, resp.ExpiresIn)
+				}
+				if actions := s.auditActions(t); !slices.Equal(actions, []string{models.AuditLogin}) {
+					t.Errorf("audit log = %v, want [%s]", actions, models.AuditLogin)
+				}
+			},
+		},
+		{
+			name:   "success clears earlier failures",
+			setup:  withFailure,
+			body:   validLogin,
+			status: http.StatusOK,
+			check:  wantFailures(0),
+		},
+		{
+			// The server allows 10 failures per IP before backing off; without the reset,
+			// the failures before and after the login would add up to 11
+			name: "success clears the failures of the client IP",
+			setup: func(t *testing.T, s *testServer) {
+				s.addUser(t, "alice", 0)
+				failFromIP(t, s, "before-", 9)
+			},
+			body:   validLogin,
+			status: http.StatusOK,
+			check: func(t *testing.T, s *testServer, _ *httptest.ResponseRecorder) {
+				failFromIP(t, s, "after-", 3)
+			},
+		},
+		{
+			name: "two-factor users get a challenge",
+			setup: func(t *testing.T, s *testServer) {
+				s.addUser(t, "alice", 0)
+				enableTwoFactor(t, s, "alice")
+			},
+			body:   validLogin,
+			status: http.StatusOK,
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				var resp challengeResponse
+				decodeBody(t, rec, &resp)
+				if !resp.TwoFactorRequired {
+					t.Fatalf("response = %+v, want a challenge", resp)
+				}
+				if _, err := auth.VerifyChallengeToken(resp.ChallengeToken); err != nil {
+					t.Errorf("VerifyChallengeToken: %v", err)
+				}
+				if actions := s.auditActions(t); len(actions) != 0 {
+					t.Errorf("audit log = %v, want it empty until the second step", actions)
+				}
+			},
+		},
+		{
+			name:   "malformed body",
+			body:   `not json`,
+			status: http.StatusBadRequest,
+			error:  "invalid request body",
+		},
+		{
+			name:   "unknown user",
+			body:   `{"userId":"nobody","password":"` + testPassword + `"}`,
+			status: http.StatusUnauthorized,
+			error:  "invalid userId or password",
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				if actions := s.auditActions(t); !slices.Equal(actions, []string{models.AuditLoginFailure}) {
+					t.Errorf("audit log = %v, want [%s]", actions, models.AuditLoginFailure)
+				}
+			},
+		},
+		{
+			name:   "wrong password is counted",
+			setup:  withUser,
+			body:   wrongPassword,
+			status: http.StatusUnauthorized,
+			error:  "invalid userId or password",
+			check:  wantFailures(1),
+		},
+		{
+			name:   "failed login is answered even if it cannot be audited",
+			setup:  withUser,
+			fail:   []string{"RecordAuditEvent"},
+			body:   wrongPassword,
+			status: http.StatusUnauthorized,
+			error:  "invalid userId or password",
+			check:  wantFailures(1),
+		},
+		{
+			name: "retry during the backoff",
+			setup: func(t *testing.T, s *testServer) {
+				s.addUser(t, "alice", 0)
+				if rec := s.do(t, http.MethodPost, "/login", "", wrongPassword); rec.Code != http.StatusUnauthorized {
+					t.Fatalf("first attempt: status = %d, want 401", rec.Code)
+				}
+			},
+			body:   validLogin,
+			status: http.StatusTooManyRequests,
+			code:   "too_many_attempts",
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				if rec.Header().Get("Retry-After") == "" {
+					t.Error("Retry-After header is missing")
+				}
+			},
+		},
+		{
+			name: "user locked out before a restart",
+			setup: func(t *testing.T, s *testServer) {
+				s.addUser(t, "alice", 0)
+				policy := models.LoginPolicy{MaxAttempts: 1, Lockout: time.Hour}
+				if _, err := s.mem.RecordLoginFailure(context.Background(), "alice", policy); err != nil {
+					t.Fatalf("RecordLoginFailure: %v", err)
+				}
+			},
+			body:   validLogin,
+			status: http.StatusUnauthorized,
+			error:  "invalid userId or password",
+			check:  wantFailures(2),
+		},
+		{
+			name: "locked user with the wrong password",
+			setup: func(t *testing.T, s *testServer) {
+				s.addUser(t, "alice", 0)
+				policy := models.LoginPolicy{MaxAttempts: 1, Lockout: time.Hour}
+				if _, err := s.mem.RecordLoginFailure(context.Background(), "alice", policy); err != nil {
+					t.Fatalf("RecordLoginFailure: %v", err)
+				}
+			},
+			body:   wrongPassword,
+			status: http.StatusUnauthorized,
+			error:  "invalid userId or password",
+			check:  wantFailures(2),
+		},
+		{
+			name:   "user lookup fails",
+			setup:  withUser,
+			fail:   []string{"GetUserByID"},
+			body:   validLogin,
+			status: http.StatusInternalServerError,
+			error:  "database error",
+		},
+		{
+			name:   "failure cannot be recorded",
+			setup:  withUser,
+			fail:   []string{"RecordLoginFailure"},
+			body:   wrongPassword,
+			status: http.StatusInternalServerError,
+			error:  "database error",
+		},
+		{
+			// Unknown users go through the same write, so that an outage does not tell
+			// them apart from real ones
+			name:   "failure of an unknown user cannot be recorded",
+			fail:   []string{"RecordLoginFailure"},
+			body:   `{"userId":"nobody","password":"` + testPassword + `"}`,
+			status: http.StatusInternalServerError,
+			error:  "database error",
+		},
+		{
+			name:   "earlier failures cannot be cleared",
+			setup:  withFailure,
+			fail:   []string{"ResetLoginFailures"},
+			body:   validLogin,
+			status: http.StatusInternalServerError,
+			error:  "database error",
+			check:  wantFailures(1),
+		},
+		{
+			name:   "refresh token cannot be stored",
+			setup:  withUser,
+			fail:   []string{"CreateRefreshToken"},
+			body:   validLogin,
+			status: http.StatusInternalServerError,
+			error:  "failed to generate token",
+		},
+		{
+			name:   "login cannot be audited",
+			setup:  withUser,
+			fail:   []string{"RecordAuditEvent"},
+			body:   validLogin,
+			status: http.StatusInternalServerError,
+			error:  "failed to generate token",
+		},
+	})
+}
+
+// enableTwoFactor turns on two-factor authentication for a user
+func enableTwoFactor(t *testing.T, s *testServer, userID string) {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.mem.StartTOTPEnrollment(ctx, userID, "encrypted-secret"); err != nil {
+		t.Fatalf("StartTOTPEnrollment: %v", err)
+	}
+	if err := s.mem.ConfirmTOTPEnrollment(ctx, userID, 1, nil); err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment: %v", err)
+	}
+}
+
+// wantTwoFactorRefused checks that a refused enrollment request changed nothing but
+// counted as a failed login of alice
+func wantTwoFactorRefused(secret string) func(*testing.T, *testServer, *httptest.ResponseRecorder) {
+	return func(t *testing.T, s *testServer, _ *httptest.ResponseRecorder) {
+		user, err := s.mem.GetUserByID(context.Background(), "alice")
+		if err != nil {
+			t.Fatalf("GetUserByID: %v", err)
+		}
+		if user.TOTPSecret != secret || user.TOTPEnabled {
+			t.Errorf("2FA = %q enabled %v, want %q and disabled", user.TOTPSecret, user.TOTPEnabled, secret)
+		}
+		if user.FailedLoginAttempts != 1 {
+			t.Errorf("failed logins = %d, want 1", user.FailedLoginAttempts)
+		}
+	}
+}
+
+func TestEnrollTwoFactor(t *testing.T) {
+	runHandlerTests(t, http.MethodPost, "/account/2fa/enroll", []handlerTest{
+		{
+			name:   "returns a pending secret",
+			setup:  func(t *testing.T, s *testServer) { s.addUser(t, "alice", 0) },
+			user:   "alice",
+			body:   `{"currentPassword":"` + testPassword + `"}`,
+			status: http.StatusOK,
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				var resp twoFactorEnrollResponse
+				decodeBody(t, rec, &resp)
+				user, err := s.mem.GetUserByID(context.Background(), "alice")
+				if err != nil {
+					t.Fatalf("GetUserByID: %v", err)
+				}
+				if resp.Secret == "" || user.TOTPSecret == "" || user.TOTPEnabled {
+					t.Errorf("secret = %q, stored %q enabled %v; want a pending secret", resp.Secret, user.TOTPSecret, user.TOTPEnabled)
+				}
+			},
+		},
+		{
+			name:   "wrong password",
+			setup:  func(t *testing.T, s *testServer) { s.addUser(t, "alice", 0) },
+			user:   "alice",
+			body:   `{"currentPassword":"wrong password"}`,
+			status: http.StatusForbidden,
+			code:   "invalid_password",
+			check:  wantTwoFactorRefused(""),
+		},
+		{
+			name:   "missing password",
+			setup:  func(t *testing.T, s *testServer) { s.addUser(t, "alice", 0) },
+			user:   "alice",
+			body:   `{}`,
+			status: http.StatusForbidden,
+			code:   "invalid_password",
+			check:  wantTwoFactorRefused(""),
+		},
+	})
+}
+
+func TestConfirmTwoFactor(t *testing.T) {
+	runHandlerTests(t, http.MethodPost, "/account/2fa/confirm", []handlerTest{
+		{
+			name: "wrong password",
+			setup: func(t *testing.T, s *testServer) {
+				s.addUser(t, "alice", 0)
+				if err := s.mem.StartTOTPEnrollment(context.Background(), "alice", "encrypted-secret"); err != nil {
+					t.Fatalf("StartTOTPEnrollment: %v", err)
+				}
+			},
+			user:   "alice",
+			body:   `{"currentPassword":"wrong password","code":"123456"}`,
+			status: http.StatusForbidden,
+			code:   "invalid_password",
+			check:  wantTwoFactorRefused("encrypted-secret"),
+		},
+	})
+}
+
+// wantResetAccepted checks the answer to a password reset request, which must not tell
+// whether the user exists
+func wantResetAccepted(t *testing.T, _ *testServer, rec *httptest.ResponseRecorder) {
+	var resp passwordResetResponse
+	decodeBody(t, rec, &resp)
+	if resp.Message != "if the user exists, a reset token has been sent" {
+		t.Errorf("message = %q", resp.Message)
+	}
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	runHandlerTests(t, http.MethodPost, "/password/reset", []handlerTest{
+		{
+			name:   "known user",
+			setup:  func(t *testing.T, s *testServer) { s.addUser(t, "alice", 0) },
+			body:   `{"userId":"alice"}`,
+			status: http.StatusAccepted,
+			check:  wantResetAccepted,
+		},
+		{
+			name:   "unknown user",
+			body:   `{"userId":"alice"}`,
+			status: http.StatusAccepted,
+			check:  wantResetAccepted,
+		},
+		{
+			name: "repeated for a user",
+			setup: func(t *testing.T, s *testServer) {
+				if rec := s.do(t, http.MethodPost, "/password/reset", "", `{"userId":"alice"}`); rec.Code != http.StatusAccepted {
+					t.Fatalf("first request: status = %d", rec.Code)
+				}
+			},
+			body:   `{"userId":"alice"}`,
+			status: http.StatusTooManyRequests,
+			code:   "too_many_attempts",
+		},
+		{
+			// The server allows 10 free requests per IP; the one after them starts the backoff
+			name: "repeated from an IP",
+			setup: func(t *testing.T, s *testServer) {
+				for i := range 11 {
+					body := `{"userId":"user-` + strconv.Itoa(i) + `"}`
+					if rec := s.do(t, http.MethodPost, "/password/reset", "", body); rec.Code != http.StatusAccepted {
+						t.Fatalf("request %d: status = %d", i, rec.Code)
+					}
+				}
+			},
+			body:   `{"userId":"alice"}`,
+			status: http.StatusTooManyRequests,
+			code:   "too_many_attempts",
+		},
+		{
+			name:   "missing user ID",
+			body:   `{}`,
+			status: http.StatusBadRequest,
+			error:  "userId is required",
+		},
+	})
+}
+
+// withAccounts gives alice a primary account holding 12.34 USD and a savings account
+// holding 0.99 USD, and bob an account holding 5.00 USD
+func withAccounts(t *testing.T, s *testServer) {
+	s.addUser(t, "alice", 1234)
+	s.addAccount(t, "alice", "savings", 99)
+	s.addUser(t, "bob", 500)
+}
+
+// wantBalance checks the account and balance reported by a balance-changing request,
+// and that the named account holds that balance
+func wantBalance(name, amount string, balance int64) func(*testing.T, *testServer, *httptest.ResponseRecorder) {
+	return func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+		var resp balanceResponse
+		decodeBody(t, rec, &resp)
+		if resp.AccountId != s.ref(t, name) || resp.Balance.Decimal() != amount || resp.Balance.Currency != "USD" {
+			t.Errorf("response = %+v, want %s USD on %s", resp, amount, name)
+		}
+		if got := s.balance(t, name); got != balance {
+			t.Errorf("stored balance = %d, want %d", got, balance)
+		}
+	}
+}
+
+// wantUnchanged checks that a failed request left the balance and the audit log alone
+func wantUnchanged(name string, balance int64) func(*testing.T, *testServer, *httptest.ResponseRecorder) {
+	return func(t *testing.T, s *testServer, _ *httptest.ResponseRecorder) {
+		if got := s.balance(t, name); got != balance {
+			t.Errorf("balance = %d, want %d", got, balance)
+		}
+		if actions := s.auditActions(t); len(actions) != 0 {
+			t.Errorf("audit log = %v, want it empty", actions)
+		}
+	}
+}
+
+func TestGetBalance(t *testing.T) {
+	runHandlerTests(t, http.MethodGet, "/account", []handlerTest{
+		{
+			name:   "primary account",
+			setup:  withAccounts,
+			user:   "alice",
+			status: http.StatusOK,
+			check:  wantBalance("alice", "12.34", 1234),
+		},
+		{
+			name:   "primary account skips closed accounts",
+			setup:  func(t *testing.T, s *testServer) { withAccounts(t, s); closeTestAccount(t, s, "alice") },
+			user:   "alice",
+			status: http.StatusOK,
+			check:  wantBalance("savings", "0.99", 99),
+		},
+		{
+			name:   "selected account",
+			setup:  withAccounts,
+			path:   "/account?id={savings}",
+			user:   "alice",
+			status: http.StatusOK,
+			check:  wantBalance("savings", "0.99", 99),
+		},
+		{
+			name:   "missing token",
+			setup:  withAccounts,
+			status: http.StatusUnauthorized,
+			error:  "missing authorization header",
+		},
+		{
+			name:   "user without accounts",
+			setup:  withAccounts,
+			user:   "carol",
+			status: http.StatusNotFound,
+			error:  "account not found",
+		},
+		{
+			name:   "user with only closed accounts",
+			setup:  func(t *testing.T, s *testServer) { withAccounts(t, s); closeTestAccount(t, s, "bob") },
+			user:   "bob",
+			status: http.StatusNotFound,
+			error:  "account not found",
+		},
+		{
+			name:   "selected account of another user",
+			setup:  withAccounts,
+			path:   "/account?id={bob}",
+			user:   "alice",
+			status: http.StatusNotFound,
+			error:  "account not found",
+		},
+		{
+			name:   "selected account does not exist",
+			setup:  withAccounts,
+			path:   "/account?id=no-such-account",
+			user:   "alice",
+			status: http.StatusNotFound,
+			error:  "account not found",
+		},
+		{
+			name:   "accounts cannot be loaded",
+			setup:  withAccounts,
+			fail:   []string{"GetAccountsByUserID"},
+			user:   "alice",
+			status: http.StatusInternalServerError,
+			error:  "database error",
+		},
+		{
+			name:   "selected account cannot be loaded",
+			setup:  withAccounts,
+			fail:   []string{"GetAccountForUser"},
+			path:   "/account?id={savings}",
+			user:   "alice",
+			status: http.StatusInternalServerError,
+			error:  "database error",
+		},
+	})
+}
+
+// closeTestAccount empties and closes the account named name
+func closeTestAccount(t *testing.T, s *testServer, name string) {
+	t.Helper()
+	account, err := s.mem.GetAccount(context.Background(), s.ref(t, name))
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	if _, err := s.mem.AdjustBalance(context.Background(), account.ID, models.Money{Amount: -account.Balance, Currency: "USD"}); err != nil {
+		t.Fatalf("AdjustBalance: %v", err)
+	}
+	s.setStatus(t, name, models.AccountClosed)
+}
+
+// moneyMovementTests are the cases deposits and withdrawals share; both reject the
+// same malformed amounts and unusable accounts
+func moneyMovementTests(operation string) []handlerTest {
+	return []handlerTest{
+		{
+			name:   "missing token",
+			setup:  withAccounts,
+			body:   `{"amount":{"amount":"1.00","currency":"USD"}}`,
+			status: http.StatusUnauthorized,
+			error:  "missing authorization header",
+		},
+		{
+			name:   "malformed body",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"amount":`,
+			status: http.StatusBadRequest,
+			error:  "invalid request body",
+			check:  wantUnchanged("alice", 1234),
+		},
+		{
+			name:   "unknown currency",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"amount":{"amount":"1.00","currency":"XYZ"}}`,
+			status: http.StatusBadRequest,
+			code:   "invalid_amount",
+			error:  models.ErrUnknownCurrency.Error(),
+			check:  wantUnchanged("alice", 1234),
+		},
+		{
+			name:   "too many decimals",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"amount":{"amount":"1.001","currency":"USD"}}`,
+			status: http.StatusBadRequest,
+			code:   "invalid_amount",
+			error:  models.ErrInvalidMoneyFormat.Error(),
+			check:  wantUnchanged("alice", 1234),
+		},
+		{
+			name:   "amount beyond int64",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"amount":{"amount":"99999999999999999999","currency":"USD"}}`,
+			status: http.StatusBadRequest,
+			code:   "amount_out_of_range",
+			check:  wantUnchanged("alice", 1234),
+		},
+		{
+			name:   "zero amount",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"amount":{"amount":"0.00","currency":"USD"}}`,
+			status: http.StatusBadRequest,
+			code:   "invalid_amount",
+			error:  models.ErrInvalidAmount.Error(),
+			check:  wantUnchanged("alice", 1234),
+		},
+		{
+			name:   "negative amount",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"amount":{"amount":"-1.00","currency":"USD"}}`,
+			status: http.StatusBadRequest,
+			code:   "invalid_amount",
+			check:  wantUnchanged("alice", 1234),
+		},
+		{
+			name:   "currency of another account",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"amount":{"amount":"1.00","currency":"EUR"}}`,
+			status: http.StatusBadRequest,
+			code:   "currency_mismatch",
+			check:  wantUnchanged("alice", 1234),
+		},
+		{
+			name:   "frozen account",
+			setup:  func(t *testing.T, s *testServer) { withAccounts(t, s); s.setStatus(t, "alice", models.AccountFrozen) },
+			user:   "alice",
+			body:   `{"amount":{"amount":"1.00","currency":"USD"}}`,
+			status: http.StatusConflict,
+			code:   "account_frozen",
+			check:  wantUnchanged("alice", 1234),
+		},
+		{
+			name:   "closed account",
+			setup:  func(t *testing.T, s *testServer) { withAccounts(t, s); closeTestAccount(t, s, "savings") },
+			user:   "alice",
+			body:   `{"accountId":"{savings}","amount":{"amount":"1.00","currency":"USD"}}`,
+			status: http.StatusConflict,
+			code:   "account_closed",
+		},
+		{
+			name:   "account of another user",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"accountId":"{bob}","amount":{"amount":"1.00","currency":"USD"}}`,
+			status: http.StatusNotFound,
+			error:  "account not found",
+			check:  wantUnchanged("bob", 500),
+		},
+		{
+			name:   "user without accounts",
+			setup:  withAccounts,
+			user:   "carol",
+			body:   `{"amount":{"amount":"1.00","currency":"USD"}}`,
+			status: http.StatusNotFound,
+			error:  "account not found",
+		},
+		{
+			name:   "accounts cannot be loaded",
+			setup:  withAccounts,
+			fail:   []string{"GetAccountsByUserID"},
+			user:   "alice",
+			body:   `{"amount":{"amount":"1.00","currency":"USD"}}`,
+			status: http.StatusInternalServerError,
+			error:  "database error",
+			check:  wantUnchanged("alice", 1234),
+		},
+		{
+			name:   "selected account cannot be loaded",
+			setup:  withAccounts,
+			fail:   []string{"GetAccountForUser"},
+			user:   "alice",
+			body:   `{"accountId":"{savings}","amount":{"amount":"1.00","currency":"USD"}}`,
+			status: http.StatusInternalServerError,
+			error:  "database error",
+			check:  wantUnchanged("savings", 99),
+		},
+		{
+			name:   "balance cannot be updated",
+			setup:  withAccounts,
+			fail:   []string{operation},
+			user:   "alice",
+			body:   `{"amount":{"amount":"1.00","currency":"USD"}}`,
+			status: http.StatusInternalServerError,
+			error:  "failed to update balance",
+			check:  wantUnchanged("alice", 1234),
+		},
+		{
+			name:   "transaction cannot start",
+			setup:  withAccounts,
+			fail:   []string{"WithTx"},
+			user:   "alice",
+			body:   `{"amount":{"amount":"1.00","currency":"USD"}}`,
+			status: http.StatusInternalServerError,
+			error:  "failed to update balance",
+			check:  wantUnchanged("alice", 1234),
+		},
+		{
+			name:   "change cannot be audited, the balance is rolled back",
+			setup:  withAccounts,
+			fail:   []string{"RecordAuditEvent"},
+			user:   "alice",
+			body:   `{"amount":{"amount":"1.00","currency":"USD"}}`,
+			status: http.StatusInternalServerError,
+			error:  "failed to update balance",
+			check:  wantUnchanged("alice", 1234),
+		},
+	}
+}
+
+func TestDeposit(t *testing.T) {
+	tests := []handlerTest{
+		{
+			name:   "into the primary account",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"amount":{"amount":"10.50","currency":"USD"}}`,
+			status: http.StatusOK,
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				wantBalance("alice", "22.84", 2284)(t, s, rec)
+				if actions := s.auditActions(t); !slices.Equal(actions, []string{models.AuditDeposit}) {
+					t.Errorf("audit log = %v, want [%s]", actions, models.AuditDeposit)
+				}
+			},
+		},
+		{
+			name:   "into a selected account",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"accountId":"{savings}","amount":{"amount":"0.01","currency":"USD"}}`,
+			status: http.StatusOK,
+			check:  wantBalance("savings", "1.00", 100),
+		},
+		{
+			name: "balance would overflow",
+			setup: func(t *testing.T, s *testServer) {
+				s.addUser(t, "alice", math.MaxInt64-50)
+			},
+			user:   "alice",
+			body:   `{"amount":{"amount":"1.00","currency":"USD"}}`,
+			status: http.StatusBadRequest,
+			code:   "amount_out_of_range",
+			check:  wantUnchanged("alice", math.MaxInt64-50),
+		},
+	}
+	runHandlerTests(t, http.MethodPost, "/account/deposit", append(tests, moneyMovementTests("Deposit")...))
+}
+
+func TestWithdraw(t *testing.T) {
+	tests := []handlerTest{
+		{
+			name:   "from the primary account",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"amount":{"amount":"2.34","currency":"USD"}}`,
+			status: http.StatusOK,
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				wantBalance("alice", "10.00", 1000)(t, s, rec)
+				if actions := s.auditActions(t); !slices.Equal(actions, []string{models.AuditWithdrawal}) {
+					t.Errorf("audit log = %v, want [%s]", actions, models.AuditWithdrawal)
+				}
+			},
+		},
+		{
+			name:   "the whole balance of a selected account",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"accountId":"{savings}","amount":{"amount":"0.99","currency":"USD"}}`,
+			status: http.StatusOK,
+			check:  wantBalance("savings", "0.00", 0),
+		},
+		{
+			name:   "more than the balance",
+			setup:  withAccounts,
+			user:   "alice",
+			body:   `{"amount":{"amount":"12.35","currency":"USD"}}`,
+			status: http.StatusBadRequest,
+			code:   "insufficient_funds",
+			check:  wantUnchanged("alice", 1234),
+		},
+	}
+	runHandlerTests(t, http.MethodPost, "/account/withdraw", append(tests, moneyMovementTests("Withdraw")...))
+}
+
+// withRates loads a USD/EUR rate and adds an admin named root and a customer named alice
+func withRates(t *testing.T, s *testServer) {
+	if err := s.rates.Replace([]fx.Rate{{From: "USD", To: "EUR", Rate: "0.92"}}); err != nil {
+		t.Fatalf("Replace: %v", err)
+	}
+	s.addAdmin(t, "root")
+	s.addUser(t, "alice", 0)
+}
+
+// wantRates checks the rates in the table as pairs such as "USD/EUR 0.9200000000"
+func wantRates(want ...string) func(*testing.T, *testServer, *httptest.ResponseRecorder) {
+	return func(t *testing.T, s *testServer, _ *httptest.ResponseRecorder) {
+		var got []string
+		for _, rate := range s.rates.Rates() {
+			got = append(got, rate.From+"/"+rate.To+" "+rate.Rate)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("rates = %v, want %v", got, want)
+		}
+	}
+}
+
+// wantStatus checks the status of the account named name
+func wantStatus(name, status string) func(*testing.T, *testServer, *httptest.ResponseRecorder) {
+	return func(t *testing.T, s *testServer, _ *httptest.ResponseRecorder) {
+		account, err := s.mem.GetAccount(context.Background(), s.ref(t, name))
+		if err != nil {
+			t.Fatalf("GetAccount: %v", err)
+		}
+		if account.Status != status {
+			t.Errorf("status of %s = %s, want %s", name, account.Status, status)
+		}
+	}
+}
+
+func TestCloseFrozenAccount(t *testing.T) {
+	withFrozenAccount := func(t *testing.T, s *testServer) {
+		withAccounts(t, s)
+		s.addAdmin(t, "carol")
+		s.setStatus(t, "alice", models.AccountFrozen)
+	}
+	runHandlerTests(t, http.MethodPost, "", []handlerTest{
+		{
+			name:   "refused to the customer",
+			setup:  withFrozenAccount,
+			path:   "/accounts/{alice}/close",
+			user:   "alice",
+			body:   `{"payoutAccountId":"{savings}"}`,
+			status: http.StatusConflict,
+			code:   "account_frozen",
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				wantUnchanged("alice", 1234)(t, s, rec)
+				wantStatus("alice", models.AccountFrozen)(t, s, rec)
+			},
+		},
+		{
+			name:   "operator pays out the frozen balance",
+			setup:  withFrozenAccount,
+			path:   "/admin/accounts/{alice}/close",
+			user:   "carol",
+			body:   `{"payoutAccountId":"{savings}","reason":"customer request"}`,
+			status: http.StatusOK,
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				wantStatus("alice", models.AccountClosed)(t, s, rec)
+				if alice, savings := s.balance(t, "alice"), s.balance(t, "savings"); alice != 0 || savings != 1333 {
+					t.Errorf("balances = %d and %d, want 0 and 1333", alice, savings)
+				}
+				if actions := s.auditActions(t); !slices.Equal(actions, []string{models.AuditAccountClose}) {
+					t.Errorf("audit log = %v, want [%s]", actions, models.AuditAccountClose)
+				}
+			},
+		},
+	})
+}
+
+func TestReplaceRates(t *testing.T) {
+	const gbp = `{"rates":[{"from":"USD","to":"GBP","rate":"0.79"}]}`
+	runHandlerTests(t, http.MethodPut, "/admin/fx/rates", []handlerTest{
+		{
+			name:   "admin replaces the table",
+			setup:  withRates,
+			user:   "root",
+			body:   gbp,
+			status: http.StatusOK,
+			check: func(t *testing.T, s *testServer, rec *httptest.ResponseRecorder) {
+				wantRates("USD/GBP 0.7900000000")(t, s, rec)
+				stored, err := s.mem.ListFXRates(context.Background())
+				if err != nil || !slices.Equal(stored, []fx.Rate{{From: "USD", To: "GBP", Rate: "0.7900000000"}}) {
+					t.Errorf("stored rates = %v, %v; want USD/GBP 0.7900000000", stored, err)
+				}
+				events, err := s.mem.ListAuditEvents(context.Background(), store.AuditFilter{})
+				if err != nil || len(events) != 1 {
+					t.Fatalf("ListAuditEvents = %d events, %v; want 1", len(events), err)
+				}
+				event := events[0]
+				if event.Action != models.AuditFXRates || event.TargetType != models.AuditTargetFX || event.ActorID != "root" {
+					t.Errorf("event = %s %s by %s, want %s %s by root", event.Action, event.TargetType, event.ActorID, models.AuditFXRates, models.AuditTargetFX)
+				}
+				wantBefore := `{"rates":[{"from":"USD","to":"EUR","rate":"0.9200000000"}]}`
+				wantAfter := `{"rates":[{"from":"USD","to":"GBP","rate":"0.7900000000"}]}`
+				if event.Before != wantBefore || event.After != wantAfter {
+					t.Errorf("change = %s -> %s, want %s -> %s", event.Before, event.After, wantBefore, wantAfter)
+				}
+			},
+		},
+		{
+			name:   "invalid rate",
+			setup:  withRates,
+			user:   "root",
+			body:   `{"rates":[{"from":"USD","to":"GBP","rate":"-1"}]}`,
+			status: http.StatusBadRequest,
+			check:  wantRates("USD/EUR 0.9200000000"),
+		},
+		{
+			name:   "customer",
+			setup:  withRates,
+			user:   "alice",
+			body:   gbp,
+			status: http.StatusForbidden,
+			check:  wantRates("USD/EUR 0.9200000000"),
+		},
+		{
+			name:   "audit log unavailable",
+			setup:  withRates,
+			fail:   []string{"RecordAuditEvent"},
+			user:   "root",
+			body:   gbp,
+			status: http.StatusInternalServerError,
+			error:  "database error",
+			check:  wantRates("USD/EUR 0.9200000000"),
+		},
+		{
+			name:   "no route outside admin",
+			setup:  withRates,
+			path:   "/fx/rates",
+			user:   "root",
+			body:   gbp,
+			status: http.StatusMethodNotAllowed,
+			check:  wantRates("USD/EUR 0.9200000000"),
+		},
+	})
+}
+
+func TestRequestLogging(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		user    string
+		reqID   string
+		want    map[string]any
+		wantNew bool // a request ID is generated rather than kept
+	}{
+		{
+			name:   "authenticated request",
+			method: http.MethodGet,
+			path:   "/account",
+			user:   "alice",
+			reqID:  "req-123",
+			want: map[string]any{
+				"level": "INFO", "msg": "request", "request_id": "req-123", "user_id": "alice",
+				"method": "GET", "route": "/account/", "path": "/account", "status": float64(http.StatusOK),
+			},
+		},
+		{
+			name:   "route with parameters",
+			method: http.MethodPost,
+			path:   "/accounts/{alice}/close",
+			user:   "bob",
+			reqID:  "req-456",
+			want: map[string]any{
+				"level": "WARN", "user_id": "bob", "route": "/accounts/{accountId}/close",
+				"status": float64(http.StatusBadRequest), // no Idempotency-Key
+			},
+		},
+		{
+			name:   "unauthenticated request",
+			method: http.MethodGet,
+			path:   "/account",
+			reqID:  "not a valid id",
+			want: map[string]any{
+				"level": "WARN", "user_id": "", "status": float64(http.StatusUnauthorized),
+			},
+			wantNew: true,
+		},
+		{
+			name:   "unknown route",
+			method: http.MethodGet,
+			path:   "/nowhere",
+			want: map[string]any{
+				"route": "", "path": "/nowhere", "status": float64(http.StatusNotFound),
+			},
+			wantNew: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.addUser(t, "alice", 1234)
+			s.addUser(t, "bob", 0)
+
+			req := httptest.NewRequest(tt.method, s.expand(tt.path), nil)
+			if tt.reqID != "" {
+				req.Header.Set(middleware.RequestIDHeader, tt.reqID)
+			}
+			if tt.user != "" {
+				token, err := auth.GenerateJWT(tt.user, nil)
+				if err != nil {
+					t.Fatalf("GenerateJWT: %v", err)
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			rec := httptest.NewRecorder()
+			s.handler.ServeHTTP(rec, req)
+
+			record := s.lastLog(t)
+			for key, want := range tt.want {
+				if got := record[key]; got != want {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+			echoed := rec.Header().Get(middleware.RequestIDHeader)
+			if record["request_id"] != echoed {
+				t.Errorf("request_id = %v, want the echoed %q", record["request_id"], echoed)
+			}
+			if tt.wantNew == (echoed == tt.reqID) {
+				t.Errorf("echoed request ID = %q for %q, want generated %v", echoed, tt.reqID, tt.wantNew)
+			}
+			if record["bytes"] != float64(rec.Body.Len()) {
+				t.Errorf("bytes = %v, want %d", record["bytes"], rec.Body.Len())
+			}
+			for _, key := range []string{"time", "latency_ms", "remote_ip"} {
+				if _, ok := record[key]; !ok {
+					t.Errorf("record has no %s: %v", key, record)
+				}
+			}
+		})
+	}
+}
+
+// scrapeMetrics reads every sample served by the metrics endpoint, keyed by name and labels
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	samples := map[string]float64{}
+	for line := range strings.Lines(rec.Body.String()) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(strings.TrimSpace(line[i+1:]), 64)
+		if err != nil {
+			t.Fatalf("parsing sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t)
+	s.addUser(t, "alice", 1234)
+	before := scrapeMetrics(t)
+
+	s.do(t, http.MethodPost, "/account/deposit", "alice", `{"amount":{"amount":"1.50","currency":"USD"}}`)
+	s.do(t, http.MethodPost, "/account/deposit", "alice", `{"amount":{"amount":"2.25","currency":"USD"}}`)
+	s.do(t, http.MethodPost, "/account/withdraw", "alice", `{"amount":{"amount":"100.00","currency":"USD"}}`)
+	s.do(t, http.MethodGet, "/account", "", "")
+	s.do(t, http.MethodPost, "/login", "", `{"userId":"alice","password":"wrong password"}`)
+	s.do(t, http.MethodGet, "/accounts/{alice}/transactions", "alice", "")
+	s.do(t, http.MethodGet, "/nowhere", "", "")
+
+	after := scrapeMetrics(t)
+	want := map[string]float64{
+		`bank_http_requests_total{method="POST",route="/account/deposit",status="200"}`:                 2,
+		`bank_http_requests_total{method="POST",route="/account/withdraw",status="400"}`:                1,
+		`bank_http_requests_total{method="GET",route="/account",status="401"}`:                          1,
+		`bank_http_requests_total{method="GET",route="/accounts/*",status="404"}`:                       1,
+		`bank_http_requests_total{method="GET",route="unmatched",status="404"}`:                         1,
+		`bank_http_request_duration_seconds_count{method="POST",route="/account/deposit",status="200"}`: 2,
+		`bank_auth_failures_total{reason="missing_token"}`:                                              1,
+		`bank_auth_failures_total{reason="invalid_credentials"}`:                                        1,
+		`bank_money_movements_total{currency="USD",operation="deposit"}`:                                2,
+		`bank_money_movement_volume_total{currency="USD",operation="deposit"}`:                          3.75,
+		`bank_money_movements_total{currency="USD",operation="withdraw"}`:                               0,
+	}
+	for series, delta := range want {
+		if got := after[series] - before[series]; got != delta {
+			t.Errorf("%s increased by %v, want %v", series, got, delta)
+		}
+	}
+	if _, ok := after["go_goroutines"]; !ok {
+		t.Error("Go runtime metrics are missing")
+	}
+}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"server/internal/auth"
+	"server/internal/metrics"
+	"server/internal/middleware"
+	"server/internal/models"
+	"server/internal/notify"
+	"server/internal/store"
+
+	"gorm.io/gorm"
+)
+
+// ============= Password Handlers =============
+
+// changePassword handles POST /account/password
+// Requires the current password; wrong guesses are throttled like failed logins
+// Every token of the user is revoked afterwards, so all sessions have to log in again
+func changePassword(db store.Repository, limits *loginLimits, passwords *auth.PasswordPolicy, revocations *auth.Revocations) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Header.Get("X-User-ID")
+
+		var req changePasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		user := checkCurrentPassword(w, r, db, limits, userID, req.CurrentPassword)
+		if user == nil {
+			return
+		}
+
+		if err := passwords.Check(user.ID, req.NewPassword); err != nil {
+			sendErrorCode(w, http.StatusBadRequest, "weak_password", err.Error())
+			return
+		}
+		if models.CheckPassword(user.Password, req.NewPassword) == nil {
+			sendErrorCode(w, http.StatusBadRequest, "weak_password", auth.ErrPasswordUnchanged.Error())
+			return
+		}
+
+		passwordHash, err := models.HashPassword(req.NewPassword)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "failed to process password")
+			return
+		}
+		if err := db.ChangePassword(r.Context(), user.ID, passwordHash); err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		if err := revocations.RevokeUser(r.Context(), user.ID); err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// checkCurrentPassword confirms a signed-in user with their password before a sensitive
+// change; wrong passwords are throttled and count towards the lockout like failed logins
+// It returns nil once it has sent an error response
+func checkCurrentPassword(w http.ResponseWriter, r *http.Request, db store.Repository, limits *loginLimits, userID, password string) *models.User {
+	ip := middleware.ClientIP(r)
+	if wait := max(limits.users.Wait(userID), limits.ips.Wait(ip)); wait > 0 {
+		sendTooManyAttempts(w, wait)
+		return nil
+	}
+
+	user, err := db.GetUserByID(r.Context(), userID)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "database error")
+		return nil
+	}
+	if models.CheckPassword(user.Password, password) != nil {
+		if err := limits.failure(r.Context(), db, user.ID, ip); err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return nil
+		}
+		metrics.AuthFailure("invalid_password")
+		sendErrorCode(w, http.StatusForbidden, "invalid_password", "current password is incorrect")
+		return nil
+	}
+	return user
+}
+
+// passwordResetTimeout bounds the issuing and sending of a reset token, which runs
+// after the response
+const passwordResetTimeout = 30 * time.Second
+
+// requestPasswordReset handles POST /password/reset
+// Sends a single-use reset token through the notifier; the response is the same whether
+// or not the user exists, so it cannot be used to discover user IDs
+// The token is issued and sent after the response, so that its timing does not tell
+// either; requests are throttled per user ID and per client IP like failed logins
+func requestPasswordReset(db store.Repository, notifier notify.Notifier, limits *loginLimits, ttl time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req passwordResetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserId == "" {
+			sendError(w, http.StatusBadRequest, "userId is required")
+			return
+		}
+
+		ip := middleware.ClientIP(r)
+		if wait := max(limits.users.Wait(req.UserId), limits.ips.Wait(ip)); wait > 0 {
+			sendTooManyAttempts(w, wait)
+			return
+		}
+		limits.users.Failure(req.UserId)
+		limits.ips.Failure(ip)
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), passwordResetTimeout)
+		go func() {
+			defer cancel()
+			if err := sendPasswordReset(ctx, db, notifier, req.UserId, ttl); err != nil {
+				middleware.Logger(ctx).Error("failed to send password reset token", slog.Any("error", err))
+			}
+		}()
+
+		sendSuccess(w, http.StatusAccepted, passwordResetResponse{Message: "if the user exists, a reset token has been sent"})
+	}
+}
+
+// sendPasswordReset issues a reset token for userID and sends it through the notifier
+// Unknown users are skipped without an error
+func sendPasswordReset(ctx context.Context, db store.Repository, notifier notify.Notifier, userID string, ttl time.Duration) error {
+	user, err := db.GetUserByID(ctx, userID)
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, hash, err := auth.GenerateResetToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().UTC().Add(ttl)
+	err = db.CreatePasswordResetToken(ctx, &models.PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: hash,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return notifier.Notify(ctx, notify.Message{
+		To:      user.ID,
+		Subject: "Password reset",
+		Body: fmt.Sprintf("Use this token to set a new password before %s:\n%s",
+			expiresAt.Format(time.RFC3339), token),
+	})
+}
+
+// confirmPasswordReset handles POST /password/reset/confirm
+// Sets a new password with a reset token; every token of the user is revoked afterwards
+func confirmPasswordReset(db store.Repository, passwords *auth.PasswordPolicy, revocations *auth.Revocations) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req confirmPasswordResetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		hash := auth.HashResetToken(req.Token)
+		token, err := db.GetPasswordResetToken(r.Context(), hash)
+		if err != nil {
+			sendPasswordResetError(w, err)
+			return
+		}
+		if err := passwords.Check(token.UserID, req.NewPassword); err != nil {
+			sendErrorCode(w, http.StatusBadRequest, "weak_password", err.Error())
+			return
+		}
+
+		passwordHash, err := models.HashPassword(req.NewPassword)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "failed to process password")
+			return
+		}
+		if _, err := db.ResetPassword(r.Context(), hash, passwordHash); err != nil {
+			sendPasswordResetError(w, err)
+			return
+		}
+		if err := revocations.RevokeUser(r.Context(), token.UserID); err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sendPasswordResetError maps password reset errors to HTTP responses
+func sendPasswordResetError(w http.ResponseWriter, err error) {
+	if errors.Is(err, models.ErrResetTokenInvalid) {
+		metrics.AuthFailure("reset_token_invalid")
+		sendErrorCode(w, http.StatusBadRequest, "reset_token_invalid", err.Error())
+		return
+	}
+	sendError(w, http.StatusInternalServerError, "database error")
+}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"server/internal/auth"
+	"server/internal/metrics"
+	"server/internal/middleware"
+	"server/internal/models"
+	"server/internal/store"
+
+	"gorm.io/gorm"
+)
+
+// ============= Two-Factor Handlers =============
+
+// enrollTwoFactor handles POST /account/2fa/enroll
+// Generates a TOTP secret for the user; it is only enabled once confirmed with a code
+// Both steps need the current password, so a stolen access token cannot set up 2FA
+func enrollTwoFactor(db store.Repository, limits *loginLimits, issuer string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Header.Get("X-User-ID")
+
+		var req twoFactorEnrollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if checkCurrentPassword(w, r, db, limits, userID, req.CurrentPassword) == nil {
+			return
+		}
+
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "failed to generate secret")
+			return
+		}
+		encrypted, err := auth.EncryptSecret(secret, userID)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "failed to protect secret")
+			return
+		}
+
+		if err := db.StartTOTPEnrollment(r.Context(), userID, encrypted); err != nil {
+			sendTwoFactorError(w, err)
+			return
+		}
+
+		sendSuccess(w, http.StatusOK, twoFactorEnrollResponse{
+			Secret:     secret,
+			OtpauthUri: auth.TOTPURI(issuer, userID, secret),
+		})
+	}
+}
+
+// confirmTwoFactor handles POST /account/2fa/confirm
+// Enables two-factor authentication and returns the recovery codes, which are shown only once
+func confirmTwoFactor(db store.Repository, limits *loginLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Header.Get("X-User-ID")
+
+		var req twoFactorCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		user := checkCurrentPassword(w, r, db, limits, userID, req.CurrentPassword)
+		if user == nil {
+			return
+		}
+		if user.TOTPEnabled {
+			sendTwoFactorError(w, models.ErrTwoFactorEnabled)
+			return
+		}
+		if user.TOTPSecret == "" {
+			sendTwoFactorError(w, models.ErrTwoFactorNotPending)
+			return
+		}
+
+		secret, err := auth.DecryptSecret(user.TOTPSecret, user.ID)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "failed to read secret")
+			return
+		}
+		step, ok := auth.ValidateTOTP(secret, req.Code, time.Now())
+		if !ok {
+			sendErrorCode(w, http.StatusBadRequest, "invalid_two_factor_code", models.ErrInvalidTwoFactor.Error())
+			return
+		}
+
+		codes, hashes, err := auth.GenerateRecoveryCodes()
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "failed to generate recovery codes")
+			return
+		}
+		if err := db.ConfirmTOTPEnrollment(r.Context(), user.ID, step, hashes); err != nil {
+			sendTwoFactorError(w, err)
+			return
+		}
+
+		sendSuccess(w, http.StatusOK, twoFactorConfirmResponse{RecoveryCodes: codes})
+	}
+}
+
+// loginTwoFactor handles POST /login/2fa
+// Exchanges the challenge token from /login and a TOTP or recovery code for tokens
+// Wrong codes count as failed logins, so they are throttled like wrong passwords
+func loginTwoFactor(db store.Repository, limits *loginLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req twoFactorLoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		claims, err := auth.VerifyChallengeToken(req.ChallengeToken)
+		if err != nil {
+			metrics.AuthFailure("challenge_invalid")
+			sendErrorCode(w, http.StatusUnauthorized, "challenge_invalid", "challenge expired or invalid, please login again")
+			return
+		}
+
+		ip := middleware.ClientIP(r)
+		if wait := max(limits.users.Wait(claims.UserID), limits.ips.Wait(ip)); wait > 0 {
+			sendTooManyAttempts(w, wait)
+			return
+		}
+
+		user, err := db.GetUserByID(r.Context(), claims.UserID)
+		if err == gorm.ErrRecordNotFound || (err == nil && !user.TOTPEnabled) {
+			metrics.AuthFailure("challenge_invalid")
+			sendErrorCode(w, http.StatusUnauthorized, "challenge_invalid", "challenge expired or invalid, please login again")
+			return
+		}
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		if user.IsLocked(time.Now()) {
+			sendTooManyAttempts(w, time.Until(*user.LockedUntil))
+			return
+		}
+
+		err = verifySecondFactor(r, db, user, req)
+		if errors.Is(err, models.ErrInvalidTwoFactor) {
+			if err := limits.failure(r.Context(), db, user.ID, ip); err != nil {
+				sendError(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			event := newAuditEvent(r, "", models.AuditLoginFailure, models.AuditTargetUser, user.ID)
+			event.SetDetails(map[string]any{"reason": "invalid_two_factor_code"})
+			recordAudit(r.Context(), db, event)
+			metrics.AuthFailure("invalid_two_factor_code")
+			sendErrorCode(w, http.StatusUnauthorized, "invalid_two_factor_code", err.Error())
+			return
+		}
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		if err := limits.success(r.Context(), db, user, ip); err != nil {
+			sendError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		method := "totp"
+		if req.RecoveryCode != "" {
+			method = "recovery_code"
+		}
+		resp, err := completeLogin(r, db, user, method)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "failed to generate token")
+			return
+		}
+
+		sendSuccess(w, http.StatusOK, resp)
+	}
+}
+
+// verifySecondFactor checks the TOTP code or recovery code of a login and marks it used
+// Returns models.ErrInvalidTwoFactor for wrong, replayed or already used codes
+func verifySecondFactor(r *http.Request, db store.Repository, user *models.User, req twoFactorLoginRequest) error {
+	if req.RecoveryCode != "" {
+		return db.UseRecoveryCode(r.Context(), user.ID, auth.HashRecoveryCode(req.RecoveryCode))
+	}
+
+	secret, err := auth.DecryptSecret(user.TOTPSecret, user.ID)
+	if err != nil {
+		return err
+	}
+	step, ok := auth.ValidateTOTP(secret, req.Code, time.Now())
+	if !ok {
+		return models.ErrInvalidTwoFactor
+	}
+	return db.UseTOTPStep(r.Context(), user.ID, step)
+}
+
+// sendTwoFactorError maps enrollment errors to HTTP responses
+func sendTwoFactorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrTwoFactorEnabled):
+		sendErrorCode(w, http.StatusConflict, "two_factor_enabled", err.Error())
+	case errors.Is(err, models.ErrTwoFactorNotPending):
+		sendErrorCode(w, http.StatusConflict, "two_factor_not_pending", err.Error())
+	default:
+		sendError(w, http.StatusInternalServerError, "database error")
+	}
+}
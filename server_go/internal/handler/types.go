@@ -1,30 +1,147 @@
 // Package handler defines HTTP request handlers for the bank API
 package handler
 
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"server/internal/fx"
+	"server/internal/models"
+)
+
+// Page sizes for paginated list endpoints
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
 // ============= Request Types =============
 
 // depositRequest represents the incoming JSON payload for deposit operations
 // Fields:
-//   - AccountId: the account identifier to deposit funds into
-//   - Amount: the amount of money to deposit (must be positive)
+//   - AccountId: the account identifier to deposit funds into (defaults to the user's primary account)
+//   - Amount: the amount of money to deposit (must be positive, in the account currency)
 type depositRequest struct {
-	AccountId string `json:"accountId"`
-	Amount    int    `json:"amount"`
+	AccountId string       `json:"accountId"`
+	Amount    models.Money `json:"amount"`
 }
 
 // withdrawRequest represents the incoming JSON payload for withdrawal operations
 // Fields:
-//   - AccountId: the account identifier to withdraw funds from
-//   - Amount: the amount of money to withdraw (must be positive and not exceed balance)
+//   - AccountId: the account identifier to withdraw funds from (defaults to the user's primary account)
+//   - Amount: the amount of money to withdraw (must be positive, in the account currency and not exceed balance)
 type withdrawRequest struct {
-	AccountId string `json:"accountId"`
-	Amount    int    `json:"amount"`
+	AccountId string       `json:"accountId"`
+	Amount    models.Money `json:"amount"`
+}
+
+// transferRequest represents the incoming JSON payload for transfers
+// Fields:
+//   - FromAccountId: the source account (defaults to the user's primary account)
+//   - ToAccountId: the destination account; takes precedence over ToUserId
+//   - ToUserId: the recipient user, whose account receives the funds
+//   - Amount: the amount of money to transfer (must be positive, in the source account currency and not exceed balance)
+//   - QuoteId: an FX quote from POST /fx/quotes, required when the destination holds another currency
+type transferRequest struct {
+	FromAccountId string       `json:"fromAccountId"`
+	ToAccountId   string       `json:"toAccountId"`
+	ToUserId      string       `json:"toUserId"`
+	Amount        models.Money `json:"amount"`
+	QuoteId       string       `json:"quoteId"`
+}
+
+// openAccountRequest represents the incoming JSON payload for opening an additional account
+type openAccountRequest struct {
+	Type     string `json:"type"`
+	Currency string `json:"currency"`
+}
+
+// closeAccountRequest represents the incoming JSON payload for closing an account
+// Fields:
+//   - PayoutAccountId: the account receiving the remaining balance, required unless it is zero
+//   - Reason: the justification recorded in the audit trail (required for operators)
+type closeAccountRequest struct {
+	PayoutAccountId string `json:"payoutAccountId"`
+	Reason          string `json:"reason"`
+}
+
+// quoteRequest represents the incoming JSON payload for an FX quote
+// Amount is in the currency to convert from
+type quoteRequest struct {
+	Amount     models.Money `json:"amount"`
+	ToCurrency string       `json:"toCurrency"`
+}
+
+// ratesPayload represents the FX rate table, both as a request and a response
+type ratesPayload struct {
+	Rates []fx.Rate `json:"rates"`
 }
 
 // loginRequest represents the incoming JSON payload for login
 type loginRequest struct {
-	UserId    string `json:"userId"`
-	Password  string `json:"password"`
+	UserId   string `json:"userId"`
+	Password string `json:"password"`
+}
+
+// refreshRequest represents the incoming JSON payload for renewing tokens
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// twoFactorEnrollRequest represents the incoming JSON payload for starting 2FA enrollment
+type twoFactorEnrollRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+}
+
+// twoFactorCodeRequest represents the incoming JSON payload for confirming 2FA enrollment
+type twoFactorCodeRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	Code            string `json:"code"`
+}
+
+// twoFactorLoginRequest represents the incoming JSON payload for the second login step
+// Either Code (from the authenticator app) or RecoveryCode must be given
+type twoFactorLoginRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recoveryCode"`
+}
+
+// changePasswordRequest represents the incoming JSON payload for changing the password
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// passwordResetRequest represents the incoming JSON payload for requesting a reset token
+type passwordResetRequest struct {
+	UserId string `json:"userId"`
+}
+
+// confirmPasswordResetRequest represents the incoming JSON payload for setting a new password with a reset token
+type confirmPasswordResetRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// userRolesRequest represents the incoming JSON payload for replacing a user's roles
+type userRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// adminReasonRequest represents the incoming JSON payload of admin actions that take a justification
+type adminReasonRequest struct {
+	Reason string `json:"reason"`
+}
+
+// adjustmentRequest represents the incoming JSON payload for a manual balance adjustment
+// Fields:
+//   - Amount: the correction in the account currency; negative amounts are debited
+//   - Reason: the justification recorded in the audit trail (required)
+type adjustmentRequest struct {
+	Amount models.Money `json:"amount"`
+	Reason string       `json:"reason"`
 }
 
 // registerRequest represents the incoming JSON payload for user registration
@@ -37,36 +154,300 @@ type registerRequest struct {
 
 // balanceResponse represents the JSON response when checking account balance
 type balanceResponse struct {
-	AccountId string `json:"accountId"`
-	Balance   int    `json:"balance"`
+	AccountId string       `json:"accountId"`
+	Balance   models.Money `json:"balance"`
 }
 
 // depositResponse represents the JSON response after a successful deposit
 // Returns the updated balance of the account
 type depositResponse struct {
-	AccountId string `json:"accountId"`
-	Balance   int    `json:"balance"`
+	AccountId string       `json:"accountId"`
+	Balance   models.Money `json:"balance"`
 }
 
 // withdrawResponse represents the JSON response after a successful withdrawal
 // Returns the updated balance of the account
 type withdrawResponse struct {
-	AccountId string `json:"accountId"`
-	Balance   int    `json:"balance"`
+	AccountId string       `json:"accountId"`
+	Balance   models.Money `json:"balance"`
+}
+
+// accountResponse represents a single account owned by the user
+type accountResponse struct {
+	AccountId string       `json:"accountId"`
+	Type      string       `json:"type"`
+	Status    string       `json:"status"`
+	Balance   models.Money `json:"balance"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+// newAccountResponse converts a stored account into its API representation
+func newAccountResponse(a models.Account) accountResponse {
+	return accountResponse{
+		AccountId: a.ID,
+		Type:      a.Type,
+		Status:    a.Status,
+		Balance:   a.GetBalance(),
+		CreatedAt: a.CreatedAt,
+	}
+}
+
+// accountsResponse represents the list of the user's accounts
+type accountsResponse struct {
+	Accounts []accountResponse `json:"accounts"`
+}
+
+// closeAccountResponse represents the JSON response after closing an account
+// The payout fields are set when a remaining balance was transferred out
+type closeAccountResponse struct {
+	AccountId       string        `json:"accountId"`
+	Status          string        `json:"status"`
+	PayoutAccountId string        `json:"payoutAccountId,omitempty"`
+	PayoutAmount    *models.Money `json:"payoutAmount,omitempty"`
+	Reference       string        `json:"reference,omitempty"`
+}
+
+// newCloseAccountResponse describes a closed account and its payout, which may be nil
+func newCloseAccountResponse(a models.Account, payout *models.Transaction) closeAccountResponse {
+	resp := closeAccountResponse{AccountId: a.ID, Status: a.Status}
+	if payout != nil {
+		amount := payout.GetAmount()
+		resp.PayoutAccountId = payout.CounterpartyAccountID
+		resp.PayoutAmount = &amount
+		resp.Reference = payout.Reference
+	}
+	return resp
+}
+
+// transferResponse represents the JSON response after a successful transfer
+// Returns the updated balance of the source account; cross-currency transfers
+// also report the amount credited to the destination and the applied rate
+type transferResponse struct {
+	AccountId       string        `json:"accountId"`
+	ToAccountId     string        `json:"toAccountId"`
+	Amount          models.Money  `json:"amount"`
+	ConvertedAmount *models.Money `json:"convertedAmount,omitempty"`
+	FXRate          string        `json:"fxRate,omitempty"`
+	Balance         models.Money  `json:"balance"`
+	Reference       string        `json:"reference"`
+}
+
+// quoteResponse represents an FX quote locking a rate until ExpiresAt
+type quoteResponse struct {
+	QuoteId         string       `json:"quoteId"`
+	Amount          models.Money `json:"amount"`
+	ConvertedAmount models.Money `json:"convertedAmount"`
+	Rate            string       `json:"rate"`
+	MidRate         string       `json:"midRate"`
+	SpreadBps       int          `json:"spreadBps"`
+	ExpiresAt       time.Time    `json:"expiresAt"`
+}
+
+// transactionResponse represents a single entry of the transaction history
+// Cross-currency transfers also carry the other leg, the applied rate and the spread
+type transactionResponse struct {
+	ID            string        `json:"id"`
+	Type          string        `json:"type"`
+	Amount        models.Money  `json:"amount"`
+	BalanceAfter  models.Money  `json:"balanceAfter"`
+	Reference     string        `json:"reference"`
+	Counterparty  string        `json:"counterpartyAccountId,omitempty"`
+	CounterAmount *models.Money `json:"counterAmount,omitempty"`
+	FXRate        string        `json:"fxRate,omitempty"`
+	FXSpread      *models.Money `json:"fxSpread,omitempty"`
+	CreatedAt     time.Time     `json:"createdAt"`
+}
+
+// newTransactionResponse converts a stored transaction into its API representation
+func newTransactionResponse(t models.Transaction) transactionResponse {
+	resp := transactionResponse{
+		ID:           strconv.FormatUint(uint64(t.ID), 10),
+		Type:         t.Type,
+		Amount:       t.GetAmount(),
+		BalanceAfter: t.GetBalanceAfter(),
+		Reference:    t.Reference,
+		Counterparty: t.CounterpartyAccountID,
+		FXRate:       t.FXRate,
+		CreatedAt:    t.CreatedAt,
+	}
+	if counter, ok := t.GetCounterAmount(); ok {
+		resp.CounterAmount = &counter
+	}
+	if spread, ok := t.GetFXSpread(); ok {
+		resp.FXSpread = &spread
+	}
+	return resp
+}
+
+// transactionsResponse represents one page of the transaction history
+// NextCursor is empty when there are no more pages
+type transactionsResponse struct {
+	Transactions []transactionResponse `json:"transactions"`
+	NextCursor   string                `json:"nextCursor,omitempty"`
 }
 
 // errorResponse represents a generic error response sent when operations fail
+// Code is a stable machine-readable identifier for errors clients need to tell apart
 type errorResponse struct {
 	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
 }
 
-// loginResponse represents the JSON response after successful login
+// loginResponse represents the JSON response after successful login or token refresh
+// Token is the access token; ExpiresIn is its lifetime in seconds
 type loginResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"`
+}
+
+// challengeResponse represents the JSON response of /login for users with 2FA enabled
+// ChallengeToken is exchanged with a code at /login/2fa within ExpiresIn seconds
+type challengeResponse struct {
+	TwoFactorRequired bool   `json:"twoFactorRequired"`
+	ChallengeToken    string `json:"challengeToken"`
+	ExpiresIn         int    `json:"expiresIn"`
+}
+
+// twoFactorEnrollResponse carries the new TOTP secret, for manual entry or as a QR code URI
+type twoFactorEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OtpauthUri string `json:"otpauthUri"`
+}
+
+// twoFactorConfirmResponse carries the single-use recovery codes issued on enrollment
+type twoFactorConfirmResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// passwordResetResponse represents the JSON response after requesting a reset token
+type passwordResetResponse struct {
+	Message string `json:"message"`
+}
+
+// userRolesResponse represents the roles granted to a user
+type userRolesResponse struct {
+	UserId string   `json:"userId"`
+	Roles  []string `json:"roles"`
+}
+
+// adminAccountResponse represents an account as seen by operators
+type adminAccountResponse struct {
+	AccountId string       `json:"accountId"`
+	UserId    string       `json:"userId"`
+	Type      string       `json:"type"`
+	Status    string       `json:"status"`
+	Balance   models.Money `json:"balance"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+// newAdminAccountResponse converts a stored account into its admin API representation
+func newAdminAccountResponse(a models.Account) adminAccountResponse {
+	return adminAccountResponse{
+		AccountId: a.ID,
+		UserId:    a.UserID,
+		Type:      a.Type,
+		Status:    a.Status,
+		Balance:   a.GetBalance(),
+		CreatedAt: a.CreatedAt,
+	}
+}
+
+// adminUserResponse represents a user as seen by operators
+// Accounts is only filled in when a single user is requested
+type adminUserResponse struct {
+	UserId              string                 `json:"userId"`
+	Roles               []string               `json:"roles"`
+	FailedLoginAttempts int                    `json:"failedLoginAttempts"`
+	LockedUntil         *time.Time             `json:"lockedUntil,omitempty"`
+	TwoFactorEnabled    bool                   `json:"twoFactorEnabled"`
+	CreatedAt           time.Time              `json:"createdAt"`
+	Accounts            []adminAccountResponse `json:"accounts,omitempty"`
+}
+
+// newAdminUserResponse converts a stored user into its admin API representation
+func newAdminUserResponse(u models.User) adminUserResponse {
+	return adminUserResponse{
+		UserId:              u.ID,
+		Roles:               u.RoleList(),
+		FailedLoginAttempts: u.FailedLoginAttempts,
+		LockedUntil:         u.LockedUntil,
+		TwoFactorEnabled:    u.TOTPEnabled,
+		CreatedAt:           u.CreatedAt,
+	}
+}
+
+// adminUsersResponse represents the result of a user search
+type adminUsersResponse struct {
+	Users []adminUserResponse `json:"users"`
+}
+
+// adjustmentResponse represents the JSON response after a manual balance adjustment
+type adjustmentResponse struct {
+	AccountId string       `json:"accountId"`
+	Amount    models.Money `json:"amount"`
+	Balance   models.Money `json:"balance"`
+	Reference string       `json:"reference"`
+}
+
+// auditEventResponse represents an entry of the audit log
+type auditEventResponse struct {
+	ID         string          `json:"id"`
+	ActorId    string          `json:"actorId,omitempty"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType"`
+	TargetId   string          `json:"targetId,omitempty"`
+	Ip         string          `json:"ip,omitempty"`
+	UserAgent  string          `json:"userAgent,omitempty"`
+	RequestId  string          `json:"requestId,omitempty"`
+	Reason     string          `json:"reason,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	Details    json.RawMessage `json:"details,omitempty"`
+	PrevHash   string          `json:"prevHash"`
+	Hash       string          `json:"hash"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+// newAuditEventResponse converts a stored audit event into its API representation
+func newAuditEventResponse(e models.AuditEvent) auditEventResponse {
+	return auditEventResponse{
+		ID:         strconv.FormatUint(uint64(e.ID), 10),
+		ActorId:    e.ActorID,
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		TargetId:   e.TargetID,
+		Ip:         e.IP,
+		UserAgent:  e.UserAgent,
+		RequestId:  e.RequestID,
+		Reason:     e.Reason,
+		Before:     rawJSON(e.Before),
+		After:      rawJSON(e.After),
+		Details:    rawJSON(e.Details),
+		PrevHash:   e.PrevHash,
+		Hash:       e.Hash,
+		CreatedAt:  e.CreatedAt,
+	}
+}
+
+// auditEventsResponse represents one page of the audit log
+// NextCursor is empty when there are no more pages
+type auditEventsResponse struct {
+	Events     []auditEventResponse `json:"events"`
+	NextCursor string               `json:"nextCursor,omitempty"`
+}
+
+// auditVerifyResponse represents the result of checking the audit hash chain
+// HeadHash is the hash of the latest event checked
+type auditVerifyResponse struct {
+	Valid    bool   `json:"valid"`
+	Events   int64  `json:"events"`
+	HeadHash string `json:"headHash,omitempty"`
+	Error    string `json:"error,omitempty"`
 }
 
 // registerResponse represents the JSON response after successful registration
 type registerResponse struct {
-	UserId   string `json:"userId"`
-	Message  string `json:"message"`
+	UserId  string `json:"userId"`
+	Message string `json:"message"`
 }
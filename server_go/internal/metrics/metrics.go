@@ -0,0 +1,129 @@
+// Package metrics collects Prometheus metrics of the API and serves them for scraping
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"server/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes the names of the metrics of the API
+const namespace = "bank"
+
+// registry holds every collector served by Handler
+var registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, chi route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time spent serving HTTP requests by method, chi route pattern and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Rejected authentication and authorization attempts by reason.",
+	}, []string{"reason"})
+
+	moneyMovements = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "money_movements_total",
+		Help:      "Completed deposits and withdrawals by operation and currency.",
+	}, []string{"operation", "currency"})
+
+	moneyVolume = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "money_movement_volume_total",
+		Help:      "Amount moved by completed deposits and withdrawals, in major units of the currency.",
+	}, []string{"operation", "currency"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Time spent on database statements by operation and table.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"operation", "table"})
+)
+
+func init() {
+	registry.MustRegister(
+		httpRequests,
+		httpRequestDuration,
+		authFailures,
+		moneyMovements,
+		moneyVolume,
+		dbQueryDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves every metric in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Money movement operations
+const (
+	OperationDeposit  = "deposit"
+	OperationWithdraw = "withdraw"
+)
+
+// knownMethods are the HTTP methods reported as they are; others are reported as
+// "OTHER", so that clients cannot create series at will
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// ObserveRequest records a served request
+// route is the chi route pattern, or empty for requests no route matched; the
+// request path is never used, as IDs in it would create a series per account
+func ObserveRequest(method, route string, status int, elapsed time.Duration) {
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+	if route == "" {
+		route = "unmatched"
+	}
+	labels := prometheus.Labels{"method": method, "route": route, "status": strconv.Itoa(status)}
+	httpRequests.With(labels).Inc()
+	httpRequestDuration.With(labels).Observe(elapsed.Seconds())
+}
+
+// AuthFailure records a rejected authentication or authorization attempt
+// reason is one of a fixed set of codes, such as "invalid_token" or "invalid_credentials"
+func AuthFailure(reason string) {
+	authFailures.WithLabelValues(reason).Inc()
+}
+
+// MoneyMoved records a completed deposit or withdrawal of amount
+func MoneyMoved(operation string, amount models.Money) {
+	digits, err := models.MinorUnits(amount.Currency)
+	if err != nil {
+		return
+	}
+	moneyMovements.WithLabelValues(operation, amount.Currency).Inc()
+	moneyVolume.WithLabelValues(operation, amount.Currency).Add(float64(amount.Amount) / math.Pow10(digits))
+}
+
+// ObserveQuery records a database statement of the given operation (create, query,
+// update, delete, row or raw) on table, which is empty for raw SQL
+func ObserveQuery(operation, table string, elapsed time.Duration) {
+	dbQueryDuration.WithLabelValues(operation, table).Observe(elapsed.Seconds())
+}
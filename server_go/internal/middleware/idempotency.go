@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"server/internal/models"
+)
+
+// IdempotencyKeyHeader is the request header clients use to make retries safe
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength bounds the size of client-supplied keys
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotentBodyBytes bounds the request body read for hashing; larger bodies are
+// rejected rather than hashed in part
+const maxIdempotentBodyBytes = 1 << 20
+
+// IdempotencyStore persists idempotency keys and the responses they produced
+type IdempotencyStore interface {
+	ReserveIdempotencyKey(ctx context.Context, record *models.IdempotencyKey) (*models.IdempotencyKey, error)
+	CompleteIdempotencyKey(ctx context.Context, key, userID string, statusCode int, contentType string, response []byte) error
+	ReleaseIdempotencyKey(ctx context.Context, key, userID string) error
+}
+
+// Idempotency makes requests carrying an Idempotency-Key header safe to retry
+// The first request with a key is executed and its response stored for ttl; a retry
+// with the same key and body replays that response, a retry with a different body
+// is rejected with 422, and a retry while the first request is still running gets 409
+// Must be mounted after Auth, since keys are scoped to the X-User-ID of the caller
+func Idempotency(store IdempotencyStore, ttl time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				sendJSONError(w, http.StatusBadRequest, "invalid_idempotency_key", "idempotency key is too long")
+				return
+			}
+
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodyBytes+1))
+			if err != nil {
+				sendJSONError(w, http.StatusBadRequest, "", "invalid request body")
+				return
+			}
+			if len(body) > maxIdempotentBodyBytes {
+				sendJSONError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body is too large")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			userID := r.Header.Get("X-User-ID")
+			record := &models.IdempotencyKey{
+				Key:         key,
+				UserID:      userID,
+				RequestHash: hashRequest(r, body),
+				ExpiresAt:   time.Now().UTC().Add(ttl),
+			}
+			existing, err := store.ReserveIdempotencyKey(r.Context(), record)
+			if err != nil {
+				sendJSONError(w, http.StatusInternalServerError, "", "database error")
+				return
+			}
+
+			if existing != nil {
+				switch {
+				case existing.RequestHash != record.RequestHash:
+					sendJSONError(w, http.StatusUnprocessableEntity, "idempotency_key_mismatch",
+						"idempotency key was already used with a different request")
+				case !existing.Completed():
+					sendJSONError(w, http.StatusConflict, "idempotency_key_in_progress",
+						"a request with this idempotency key is still being processed")
+				default:
+					w.Header().Set("Content-Type", existing.ContentType)
+					w.Header().Set("Idempotent-Replayed", "true")
+					w.WriteHeader(existing.StatusCode)
+					w.Write(existing.Response)
+				}
+				return
+			}
+
+			// Use a fresh context: the outcome must be stored even if the client has gone away
+			ctx := context.WithoutCancel(r.Context())
+
+			// Server errors and panics leave no state behind, so the client may retry with
+			// the same key; the release is deferred to also run while a panic unwinds
+			completed := false
+			defer func() {
+				if completed {
+					return
+				}
+				if err := store.ReleaseIdempotencyKey(ctx, key, userID); err != nil {
+					Logger(ctx).Error("failed to release idempotency key", slog.String("user_id", userID), slog.Any("error", err))
+				}
+			}()
+
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			if rec.status >= http.StatusInternalServerError {
+				return
+			}
+
+			completed = true
+			err = store.CompleteIdempotencyKey(ctx, key, userID, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes())
+			if err != nil {
+				Logger(ctx).Error("failed to store idempotency key", slog.String("user_id", userID), slog.Any("error", err))
+			}
+		})
+	}
+}
+
+// hashRequest fingerprints a request so that key reuse with a different payload can be detected
+func hashRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy of its status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+// WriteHeader records the status code before sending it
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if !rec.wroteHeader {
+		rec.status = statusCode
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records the body before sending it
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// sendJSONError sends an error response in the same format as the handlers
+func sendJSONError(w http.ResponseWriter, statusCode int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Code  string `json:"code,omitempty"`
+	}{Error: message, Code: code})
+}
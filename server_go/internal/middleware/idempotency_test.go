@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"server/internal/models"
+	"server/internal/store"
+)
+
+// idempotentRequest sends body with an Idempotency-Key to h as alice
+func idempotentRequest(h http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/account/deposit", strings.NewReader(body))
+	req.Header.Set(IdempotencyKeyHeader, "key-1")
+	req.Header.Set("X-User-ID", "alice")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotencyRejectsOversizedBodies(t *testing.T) {
+	mem := store.NewMemory()
+	called := false
+	h := Idempotency(mem, time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	rec := idempotentRequest(h, strings.Repeat("x", 1<<20+1))
+	if rec.Code != http.StatusRequestEntityTooLarge || called {
+		t.Fatalf("status = %d, handler called %v; want 413 without calling the handler", rec.Code, called)
+	}
+	existing, err := mem.ReserveIdempotencyKey(context.Background(), &models.IdempotencyKey{
+		Key: "key-1", UserID: "alice", ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil || existing != nil {
+		t.Fatalf("ReserveIdempotencyKey = %+v, %v; want the key unused", existing, err)
+	}
+}
+
+func TestIdempotencyReleasesKeyOnPanic(t *testing.T) {
+	mem := store.NewMemory()
+	panics := true
+	h := Idempotency(mem, time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if panics {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	func() {
+		defer func() {
+			if p := recover(); p == nil {
+				t.Fatal("the panic did not reach the caller")
+			}
+		}()
+		idempotentRequest(h, `{"amount":"1.00"}`)
+	}()
+
+	// Without the release the retry would be refused as still in progress
+	panics = false
+	if rec := idempotentRequest(h, `{"amount":"1.00"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("retry: status = %d, want 201; body: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+)
+
+// requestLog collects the fields of a request's log record that are only known to
+// middleware running after Logging, such as the authenticated user
+type requestLog struct {
+	logger *slog.Logger // logger carrying the request ID
+	userID string
+}
+
+// requestLogKey is the context key of the *requestLog of a request
+type requestLogKey struct{}
+
+// Logging returns middleware that writes one structured record to logger per request
+// The record carries the request ID, the authenticated user, method, route pattern,
+// status, response size, latency and client IP. Server errors are logged at error
+// level, client errors at warn level and everything else at info level
+// It must run after RequestID and before routing, so that every request is logged
+func Logging(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			entry := &requestLog{logger: logger.With(slog.String("request_id", r.Header.Get(RequestIDHeader)))}
+			r = r.WithContext(context.WithValue(r.Context(), requestLogKey{}, entry))
+			ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			next.ServeHTTP(ww, r)
+
+			status := responseStatus(ww)
+			level := slog.LevelInfo
+			switch {
+			case status >= http.StatusInternalServerError:
+				level = slog.LevelError
+			case status >= http.StatusBadRequest:
+				level = slog.LevelWarn
+			}
+			entry.logger.LogAttrs(r.Context(), level, "request",
+				slog.String("user_id", entry.userID),
+				slog.String("method", r.Method),
+				slog.String("route", routePattern(r)),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", status),
+				slog.Int("bytes", ww.BytesWritten()),
+				slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+				slog.String("remote_ip", ClientIP(r)),
+			)
+		})
+	}
+}
+
+// Logger returns the logger of the request ctx belongs to, which adds the request ID
+// to every record, or the default logger outside of Logging
+func Logger(ctx context.Context) *slog.Logger {
+	if entry, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return entry.logger
+	}
+	return slog.Default()
+}
+
+// setLogUser records the authenticated user of r on its log record
+func setLogUser(r *http.Request, userID string) {
+	if entry, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		entry.userID = userID
+	}
+}
+
+// routePattern returns the chi route pattern r matched, such as /account/{id}, or
+// empty if no route matched
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		return rctx.RoutePattern()
+	}
+	return ""
+}
+
+// responseStatus returns the status code sent through w
+func responseStatus(w chimiddleware.WrapResponseWriter) int {
+	if status := w.Status(); status != 0 {
+		return status
+	}
+	// Nothing was written, net/http answers 200 with an empty body
+	return http.StatusOK
+}
+
+// ClientIP returns the IP address of the client without the port
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
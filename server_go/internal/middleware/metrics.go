@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"server/internal/metrics"
+
+	chimiddleware "github.com/go-chi/chi/middleware"
+)
+
+// Metrics is middleware that counts requests and measures their latency by method,
+// chi route pattern and status
+// It must run before routing, so that requests no route matched are counted too
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		metrics.ObserveRequest(r.Method, routePattern(r), responseStatus(ww), time.Since(start))
+	})
+}
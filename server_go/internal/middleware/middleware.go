@@ -2,14 +2,15 @@
 package middleware
 
 import (
-	"log"
 	"net/http"
+	"slices"
 	"strings"
-	"time"
 
 	"server/internal/auth"
+	"server/internal/metrics"
 
 	chimiddleware "github.com/go-chi/chi/middleware"
+	"github.com/google/uuid"
 )
 
 // CORS middleware allows cross-origin requests from any origin
@@ -17,7 +18,8 @@ func CORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 
 		// Handle preflight requests
@@ -30,17 +32,40 @@ func CORS(next http.Handler) http.Handler {
 	})
 }
 
-// Logging is middleware that logs HTTP request details
-func Logging(next http.Handler) http.Handler {
+// RequestIDHeader carries the ID that ties log lines and audit events to a request
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the size of client-supplied request IDs
+const maxRequestIDLength = 64
+
+// RequestID is middleware that gives every request an ID in the X-Request-ID header
+// A well-formed ID sent by the client (or a proxy in front of the server) is kept,
+// otherwise a new one is generated; the ID is echoed in the response
+func RequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		log.Printf("[%s] %s %s", start.Format("15:04:05"), r.Method, r.RequestURI)
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
 		next.ServeHTTP(w, r)
-		log.Printf("[%s] %s %s - %v", start.Format("15:04:05"), r.Method, r.RequestURI, time.Since(start))
 	})
 }
 
-
+// validRequestID reports whether id is a non-empty, reasonably short token of
+// letters, digits and the separators - _ . :
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
 
 // StripSlashes is chi's built-in middleware that removes trailing slashes from request paths
 var StripSlashes = chimiddleware.StripSlashes
@@ -52,35 +77,73 @@ func sendUnauthorized(w http.ResponseWriter, message string) {
 	w.Write([]byte(`{"error":"` + message + `"}`))
 }
 
-// Auth middleware verifies JWT tokens without database lookup (stateless)
+// Auth returns middleware that verifies JWT tokens and rejects revoked ones
 // Token is expected in "Authorization: Bearer <token>" header
-// Extracted userID is passed via X-User-ID header to handlers
-func Auth(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			sendUnauthorized(w, "missing authorization header")
-			return
-		}
-
-		// Extract token from "Bearer <token>" format
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			sendUnauthorized(w, "invalid authorization format")
-			return
-		}
-
-		// Verify JWT token (no database lookup required)
-		claims, err := auth.VerifyJWT(parts[1])
-		if err != nil {
-			sendUnauthorized(w, "token expired or invalid, please login again")
-			return
-		}
+// Revocations are checked in memory, so no database lookup is required
+// Extracted userID, token ID and roles are passed via X-User-ID, X-Token-ID and
+// X-User-Roles (space-separated) headers to handlers
+func Auth(revocations *auth.Revocations) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" {
+				metrics.AuthFailure("missing_token")
+				sendUnauthorized(w, "missing authorization header")
+				return
+			}
+
+			// Extract token from "Bearer <token>" format
+			parts := strings.Split(authHeader, " ")
+			if len(parts) != 2 || parts[0] != "Bearer" {
+				metrics.AuthFailure("malformed_token")
+				sendUnauthorized(w, "invalid authorization format")
+				return
+			}
+
+			// Verify JWT token (no database lookup required)
+			claims, err := auth.VerifyJWT(parts[1])
+			if err != nil {
+				metrics.AuthFailure("invalid_token")
+				sendUnauthorized(w, "token expired or invalid, please login again")
+				return
+			}
+			if revocations.IsRevoked(claims) {
+				metrics.AuthFailure("revoked_token")
+				sendUnauthorized(w, "token expired or invalid, please login again")
+				return
+			}
+
+			setLogUser(r, claims.UserID)
+
+			// Add UserID, token ID and roles to request headers for handlers to use
+			r.Header.Set("X-User-ID", claims.UserID)
+			r.Header.Set("X-Token-ID", claims.ID)
+			r.Header.Set("X-User-Roles", strings.Join(claims.Roles, " "))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-		log.Printf("Authorized request for user: %s", claims.UserID)
+// RequireRole returns middleware that only admits users holding at least one of roles
+// It must run after Auth, which sets the X-User-Roles header from the verified token
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, granted := range strings.Fields(r.Header.Get("X-User-Roles")) {
+				if slices.Contains(roles, granted) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			metrics.AuthFailure("insufficient_role")
+			sendForbidden(w, "insufficient permissions")
+		})
+	}
+}
 
-		// Add UserID to request header for handlers to use
-		r.Header.Set("X-User-ID", claims.UserID)
-		next.ServeHTTP(w, r)
-	})
+// sendForbidden is a helper that sends standard forbidden response
+func sendForbidden(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(`{"error":"` + message + `"}`))
 }
@@ -2,6 +2,7 @@ package models
 
 import (
 	"errors"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,12 +13,45 @@ import (
 var (
 	ErrInvalidAmount       = errors.New("amount must be greater than 0")
 	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrInvalidAccountType  = errors.New("account type must be checking or savings")
+	ErrAccountFrozen       = errors.New("account is frozen")
+	ErrAccountClosed       = errors.New("account is closed")
+	ErrAccountNotEmpty     = errors.New("account balance must be zero to close it")
+	ErrInvalidTransition   = errors.New("account status change is not allowed")
+	ErrZeroAdjustment      = errors.New("adjustment amount must not be zero")
 )
 
+// Account types a user can open
+const (
+	AccountChecking = "checking"
+	AccountSavings  = "savings"
+)
+
+// Account statuses
+// A frozen account rejects deposits, withdrawals and transfers until an operator
+// unfreezes it; a closed account is permanently out of use
+const (
+	AccountActive = "active"
+	AccountFrozen = "frozen"
+	AccountClosed = "closed"
+)
+
+// accountTransitions lists the statuses each status may change to
+var accountTransitions = map[string][]string{
+	AccountActive: {AccountFrozen, AccountClosed},
+	AccountFrozen: {AccountActive, AccountClosed},
+}
+
+// Account is a customer account; a user may own several
+// Balance is held in minor units of Currency; it is a cached projection of the
+// account's ledger entries and is only changed together with the postings that explain it
 type Account struct {
-	ID        string    `gorm:"primaryKey"`
-	UserID    string    `gorm:"unique;not null"`
-	Balance   int
+	ID        string `gorm:"primaryKey"`
+	UserID    string `gorm:"index;not null"`
+	Type      string `gorm:"not null;default:checking"`
+	Status    string `gorm:"not null;default:active"`
+	Balance   int64
+	Currency  string `gorm:"not null;default:USD"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -27,28 +61,113 @@ func (a *Account) BeforeCreate(tx *gorm.DB) error {
 	if a.ID == "" {
 		a.ID = uuid.New().String()
 	}
+	if a.Status == "" {
+		a.Status = AccountActive
+	}
+	return nil
+}
+
+// ValidAccountType reports whether t is a known account type
+func ValidAccountType(t string) bool {
+	return t == AccountChecking || t == AccountSavings
+}
+
+// CheckActive reports why the account cannot be used for money movement, if it cannot
+func (a *Account) CheckActive() error {
+	switch a.Status {
+	case AccountFrozen:
+		return ErrAccountFrozen
+	case AccountClosed:
+		return ErrAccountClosed
+	}
+	return nil
+}
+
+// SetStatus moves the account to status, enforcing the allowed transitions
+// An account can only be closed once its balance is zero
+func (a *Account) SetStatus(status string) error {
+	if !slices.Contains(accountTransitions[a.Status], status) {
+		return ErrInvalidTransition
+	}
+	if status == AccountClosed && a.Balance != 0 {
+		return ErrAccountNotEmpty
+	}
+	a.Status = status
 	return nil
 }
 
-func (a *Account) Deposit(amount int) error {
-	if amount <= 0 {
+// Deposit adds amount to the balance of an active account
+func (a *Account) Deposit(amount Money) error {
+	if err := a.CheckActive(); err != nil {
+		return err
+	}
+	if !amount.IsPositive() {
 		return ErrInvalidAmount
 	}
-	a.Balance += amount
+	balance, err := a.GetBalance().Add(amount)
+	if err != nil {
+		return err
+	}
+	a.Balance = balance.Amount
 	return nil
 }
 
-func (a *Account) Withdraw(amount int) error {
-	if amount <= 0 {
+// Withdraw subtracts amount from the balance of an active account, which may not go below zero
+func (a *Account) Withdraw(amount Money) error {
+	if err := a.CheckActive(); err != nil {
+		return err
+	}
+	return a.debit(amount)
+}
+
+// PayOut subtracts amount from the balance of an account an operator is closing, which
+// may not go below zero
+// Unlike Withdraw it is allowed on frozen accounts, so that their money can be returned
+func (a *Account) PayOut(amount Money) error {
+	if a.Status == AccountClosed {
+		return ErrAccountClosed
+	}
+	return a.debit(amount)
+}
+
+// debit subtracts a positive amount from the balance, which may not go below zero
+func (a *Account) debit(amount Money) error {
+	if !amount.IsPositive() {
 		return ErrInvalidAmount
 	}
-	if a.Balance < amount {
+	balance, err := a.GetBalance().Sub(amount)
+	if err != nil {
+		return err
+	}
+	if balance.Amount < 0 {
+		return ErrInsufficientBalance
+	}
+	a.Balance = balance.Amount
+	return nil
+}
+
+// Adjust applies an operator's correction to the balance, which may not go below zero
+// Unlike Deposit and Withdraw it is allowed on frozen accounts, so that they can be
+// put right while blocked
+func (a *Account) Adjust(amount Money) error {
+	if a.Status == AccountClosed {
+		return ErrAccountClosed
+	}
+	if amount.IsZero() {
+		return ErrZeroAdjustment
+	}
+	balance, err := a.GetBalance().Add(amount)
+	if err != nil {
+		return err
+	}
+	if balance.Amount < 0 {
 		return ErrInsufficientBalance
 	}
-	a.Balance -= amount
+	a.Balance = balance.Amount
 	return nil
 }
 
-func (a *Account) GetBalance() int {
-	return a.Balance
+// GetBalance returns the balance as Money in the account currency
+func (a *Account) GetBalance() Money {
+	return Money{Amount: a.Balance, Currency: a.Currency}
 }
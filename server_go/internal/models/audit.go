@@ -0,0 +1,114 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrAuditChainBroken is returned when the audit log no longer matches its hash chain
+var ErrAuditChainBroken = errors.New("audit chain is broken")
+
+// Audited actions
+const (
+	AuditLogin             = "login"
+	AuditLoginFailure      = "login.failure"
+	AuditRegister          = "user.register"
+	AuditUserSearch        = "user.search"
+	AuditUserView          = "user.view"
+	AuditUserUnlock        = "user.unlock"
+	AuditUserRoles         = "user.roles"
+	AuditDeposit           = "account.deposit"
+	AuditWithdrawal        = "account.withdrawal"
+	AuditTransfer          = "account.transfer"
+	AuditAccountView       = "account.view"
+	AuditAccountHistory    = "account.history"
+	AuditAccountFreeze     = "account.freeze"
+	AuditAccountUnfreeze   = "account.unfreeze"
+	AuditAccountClose      = "account.close"
+	AuditAccountAdjustment = "account.adjustment"
+	AuditFXRates           = "fx.rates"
+	AuditLogView           = "audit.view"
+	AuditLogVerify         = "audit.verify"
+)
+
+// Kinds of records an audit event can target
+const (
+	AuditTargetUser    = "user"
+	AuditTargetAccount = "account"
+	AuditTargetAudit   = "audit"
+	AuditTargetFX      = "fx"
+)
+
+// AuditEvent is an entry of the append-only audit log
+// ActorID is the authenticated user who acted, empty for anonymous callers such as failed
+// logins; TargetType and TargetID name the affected record. IP, UserAgent and RequestID
+// describe the request. Before and After hold the state of the target around the action
+// and Details any other action-specific data, all as JSON objects
+// Every event carries the hash of its predecessor, so that altering or removing an
+// event breaks the chain from that point on
+type AuditEvent struct {
+	ID         uint   `gorm:"primaryKey"`
+	ActorID    string `gorm:"index;not null"`
+	Action     string `gorm:"index;not null"`
+	TargetType string `gorm:"not null"`
+	TargetID   string `gorm:"index"`
+	IP         string
+	UserAgent  string
+	RequestID  string `gorm:"index"`
+	Reason     string
+	Before     string
+	After      string
+	Details    string
+	PrevHash   string `gorm:"not null;default:''"`
+	Hash       string `gorm:"index;not null;default:''"`
+	CreatedAt  time.Time
+}
+
+// SetChange records the state of the target before and after the action
+func (e *AuditEvent) SetChange(before, after map[string]any) {
+	e.Before = auditJSON(before)
+	e.After = auditJSON(after)
+}
+
+// SetDetails records action-specific data
+func (e *AuditEvent) SetDetails(details map[string]any) {
+	e.Details = auditJSON(details)
+}
+
+// auditJSON encodes a JSON object, leaving absent objects empty
+func auditJSON(v map[string]any) string {
+	if v == nil {
+		return ""
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// ComputeHash returns the chain hash of the event: the SHA-256 of its contents,
+// including PrevHash and CreatedAt, in a fixed JSON layout
+func (e *AuditEvent) ComputeHash() string {
+	data, _ := json.Marshal(struct {
+		PrevHash   string `json:"prevHash"`
+		ActorID    string `json:"actorId"`
+		Action     string `json:"action"`
+		TargetType string `json:"targetType"`
+		TargetID   string `json:"targetId"`
+		IP         string `json:"ip"`
+		UserAgent  string `json:"userAgent"`
+		RequestID  string `json:"requestId"`
+		Reason     string `json:"reason"`
+		Before     string `json:"before"`
+		After      string `json:"after"`
+		Details    string `json:"details"`
+		CreatedAt  string `json:"createdAt"`
+	}{
+		e.PrevHash, e.ActorID, e.Action, e.TargetType, e.TargetID, e.IP, e.UserAgent,
+		e.RequestID, e.Reason, e.Before, e.After, e.Details,
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
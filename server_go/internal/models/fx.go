@@ -0,0 +1,42 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Error definitions for foreign exchange operations
+var (
+	ErrRateUnavailable = errors.New("exchange rate not available")
+	ErrQuoteRequired   = errors.New("cross-currency transfer requires an fx quote")
+	ErrQuoteNotFound   = errors.New("fx quote not found")
+	ErrQuoteExpired    = errors.New("fx quote expired or already used")
+	ErrQuoteMismatch   = errors.New("fx quote does not match the transfer currencies")
+)
+
+// FXQuote locks an exchange rate for a user until ExpiresAt
+// A quote can be used by a single transfer; UsedAt is set when it is consumed
+// Rate is the rate applied to the customer, MidRate the market rate it was derived from
+type FXQuote struct {
+	ID           string `gorm:"primaryKey"`
+	UserID       string `gorm:"index;not null"`
+	FromCurrency string `gorm:"not null"`
+	ToCurrency   string `gorm:"not null"`
+	Rate         string `gorm:"not null"`
+	MidRate      string `gorm:"not null"`
+	SpreadBps    int
+	ExpiresAt    time.Time `gorm:"not null"`
+	UsedAt       *time.Time
+	CreatedAt    time.Time
+}
+
+// BeforeCreate automatically generates a UUID for new FXQuote records
+func (q *FXQuote) BeforeCreate(tx *gorm.DB) error {
+	if q.ID == "" {
+		q.ID = uuid.New().String()
+	}
+	return nil
+}
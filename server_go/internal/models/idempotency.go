@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// IdempotencyKey remembers the outcome of a request sent with an Idempotency-Key header
+// so that a retried request is answered with the original response instead of being applied twice
+// StatusCode is zero while the original request is still being processed
+type IdempotencyKey struct {
+	Key         string `gorm:"primaryKey"`
+	UserID      string `gorm:"primaryKey"`
+	RequestHash string `gorm:"not null"`
+	StatusCode  int
+	ContentType string
+	Response    []byte
+	ExpiresAt   time.Time `gorm:"index;not null"`
+	CreatedAt   time.Time
+}
+
+// Completed reports whether the original request has finished and its response can be replayed
+func (k *IdempotencyKey) Completed() bool {
+	return k.StatusCode != 0
+}
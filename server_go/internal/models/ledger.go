@@ -0,0 +1,95 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// Posting directions of a ledger entry
+const (
+	Debit  = "debit"
+	Credit = "credit"
+)
+
+// ExternalAccountID is the ledger account representing money held outside the bank
+// It is the counterpart of every deposit and withdrawal
+const ExternalAccountID = "external"
+
+// OpeningBalanceAccountID is the equity account balancing the opening journals of
+// balances carried over from before the ledger
+const OpeningBalanceAccountID = "opening-balances"
+
+// AdjustmentAccountID is the ledger account absorbing manual balance corrections made by operators
+const AdjustmentAccountID = "adjustments"
+
+// FXPositionAccountID is the ledger account holding the bank's position in a currency
+// Cross-currency transfers pass through the position accounts of both currencies
+func FXPositionAccountID(currency string) string {
+	return "fx-position:" + currency
+}
+
+// FXRevenueAccountID is the ledger account collecting the FX spread earned in a currency
+func FXRevenueAccountID(currency string) string {
+	return "fx-revenue:" + currency
+}
+
+// Error definitions for ledger operations
+var (
+	ErrUnbalancedJournal = errors.New("journal debits and credits do not match")
+	ErrBalanceMismatch   = errors.New("account balance does not match ledger")
+)
+
+// LedgerEntry is a single debit or credit posting in the double-entry ledger
+// Entries sharing a JournalID are written in one transaction and balance per currency
+// Amount is in minor units of Currency
+type LedgerEntry struct {
+	ID        uint   `gorm:"primaryKey"`
+	JournalID string `gorm:"index;not null"`
+	AccountID string `gorm:"index;not null"`
+	Direction string `gorm:"not null"`
+	Amount    int64  `gorm:"not null"`
+	Currency  string `gorm:"not null;default:USD"`
+	CreatedAt time.Time
+}
+
+// Signed returns the effect of the entry on a customer account balance
+// Customer balances are liabilities of the bank, so credits increase them
+func (e LedgerEntry) Signed() int64 {
+	if e.Direction == Debit {
+		return -e.Amount
+	}
+	return e.Amount
+}
+
+// ValidateJournal checks that a set of postings is well-formed and that
+// debits equal credits in every currency it touches
+func ValidateJournal(entries []LedgerEntry) error {
+	if len(entries) < 2 {
+		return ErrUnbalancedJournal
+	}
+
+	net := make(map[string]Money)
+	for _, e := range entries {
+		if e.Amount <= 0 {
+			return ErrInvalidAmount
+		}
+		if e.Direction != Debit && e.Direction != Credit {
+			return ErrUnbalancedJournal
+		}
+		sum, ok := net[e.Currency]
+		if !ok {
+			sum = Money{Currency: e.Currency}
+		}
+		sum, err := sum.Add(Money{Amount: e.Signed(), Currency: e.Currency})
+		if err != nil {
+			return err
+		}
+		net[e.Currency] = sum
+	}
+	for _, sum := range net {
+		if !sum.IsZero() {
+			return ErrUnbalancedJournal
+		}
+	}
+	return nil
+}
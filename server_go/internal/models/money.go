@@ -0,0 +1,205 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is used for accounts opened without an explicit currency
+const DefaultCurrency = "USD"
+
+// Error definitions for money operations
+var (
+	ErrUnknownCurrency    = errors.New("unknown currency")
+	ErrCurrencyMismatch   = errors.New("currency mismatch")
+	ErrAmountOverflow     = errors.New("amount out of range")
+	ErrInvalidMoneyFormat = errors.New("invalid money amount")
+)
+
+// currencyDigits maps supported ISO 4217 codes to the number of minor-unit digits
+var currencyDigits = map[string]int{
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"RUB": 2,
+	"USD": 2,
+}
+
+// ValidCurrency reports whether code is a supported ISO 4217 currency code
+func ValidCurrency(code string) bool {
+	_, ok := currencyDigits[code]
+	return ok
+}
+
+// MinorUnits returns the number of minor-unit digits of a supported currency
+func MinorUnits(code string) (int, error) {
+	digits, ok := currencyDigits[code]
+	if !ok {
+		return 0, ErrUnknownCurrency
+	}
+	return digits, nil
+}
+
+// Money is an amount of a currency expressed in minor units (cents for USD)
+// All arithmetic is overflow-checked and refuses to mix currencies
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// NewMoney creates a Money value from minor units
+func NewMoney(amount int64, currency string) (Money, error) {
+	if !ValidCurrency(currency) {
+		return Money{}, ErrUnknownCurrency
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// ParseMoney parses a decimal amount such as "12.34" in the given currency
+// More fractional digits than the currency has minor units are rejected, not rounded
+func ParseMoney(amount, currency string) (Money, error) {
+	digits, ok := currencyDigits[currency]
+	if !ok {
+		return Money{}, ErrUnknownCurrency
+	}
+
+	s, negative := strings.CutPrefix(amount, "-")
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if !isDigits(whole) || (hasFrac && !isDigits(frac)) || len(frac) > digits {
+		return Money{}, ErrInvalidMoneyFormat
+	}
+	frac += strings.Repeat("0", digits-len(frac))
+
+	minor, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return Money{}, ErrAmountOverflow
+	}
+	if negative {
+		minor = -minor
+	}
+	return Money{Amount: minor, Currency: currency}, nil
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// IsPositive reports whether the amount is greater than zero
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+// IsZero reports whether the amount is zero
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// Add returns m + o
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	if (o.Amount > 0 && m.Amount > math.MaxInt64-o.Amount) ||
+		(o.Amount < 0 && m.Amount < math.MinInt64-o.Amount) {
+		return Money{}, ErrAmountOverflow
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}, nil
+}
+
+// Sub returns m - o
+func (m Money) Sub(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	if (o.Amount < 0 && m.Amount > math.MaxInt64+o.Amount) ||
+		(o.Amount > 0 && m.Amount < math.MinInt64+o.Amount) {
+		return Money{}, ErrAmountOverflow
+	}
+	return Money{Amount: m.Amount - o.Amount, Currency: m.Currency}, nil
+}
+
+// Cmp compares two amounts of the same currency, returning -1, 0 or +1
+func (m Money) Cmp(o Money) (int, error) {
+	if m.Currency != o.Currency {
+		return 0, ErrCurrencyMismatch
+	}
+	switch {
+	case m.Amount < o.Amount:
+		return -1, nil
+	case m.Amount > o.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Decimal formats the amount in major units, e.g. "12.34" for 1234 USD cents
+func (m Money) Decimal() string {
+	digits := currencyDigits[m.Currency]
+
+	// Work on the magnitude as uint64 so that math.MinInt64 formats correctly
+	magnitude := uint64(m.Amount)
+	sign := ""
+	if m.Amount < 0 {
+		magnitude = -magnitude
+		sign = "-"
+	}
+
+	s := strconv.FormatUint(magnitude, 10)
+	if digits == 0 {
+		return sign + s
+	}
+	if len(s) <= digits {
+		s = strings.Repeat("0", digits-len(s)+1) + s
+	}
+	return sign + s[:len(s)-digits] + "." + s[len(s)-digits:]
+}
+
+// String formats the amount with its currency code, e.g. "12.34 USD"
+func (m Money) String() string {
+	return fmt.Sprintf("%s %s", m.Decimal(), m.Currency)
+}
+
+// moneyJSON is the wire format of Money: the amount as a decimal string plus a currency code
+type moneyJSON struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// MarshalJSON encodes Money as {"amount":"12.34","currency":"USD"}
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: m.Decimal(), Currency: m.Currency})
+}
+
+// UnmarshalJSON decodes Money from {"amount":"12.34","currency":"USD"}
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var v moneyJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	parsed, err := ParseMoney(v.Amount, v.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Error definitions for refresh token operations
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+// RefreshToken is a persisted, single-use refresh token
+// Every login starts a new family; each rotation marks the presented token as used and
+// issues its successor in the same family, so presenting a used token reveals theft
+// and revokes the whole family
+type RefreshToken struct {
+	ID        string    `gorm:"primaryKey"`
+	UserID    string    `gorm:"index;not null"`
+	FamilyID  string    `gorm:"index;not null"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// BeforeCreate automatically generates UUIDs for new RefreshToken records
+// A token without a family starts a new one
+func (t *RefreshToken) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == "" {
+		t.ID = uuid.New().String()
+	}
+	if t.FamilyID == "" {
+		t.FamilyID = uuid.New().String()
+	}
+	return nil
+}
+
+// TokenRevocation invalidates access tokens before they expire
+// A revocation with a JTI revokes that single token (logout); one without a JTI
+// revokes every token of the user issued before IssuedBefore (logout everywhere)
+// ExpiresAt is when all affected tokens have expired and the entry can be purged
+type TokenRevocation struct {
+	ID           uint   `gorm:"primaryKey"`
+	JTI          string `gorm:"index"`
+	UserID       string `gorm:"index;not null"`
+	IssuedBefore *time.Time
+	ExpiresAt    time.Time `gorm:"index;not null"`
+	CreatedAt    time.Time
+}
+
+// ErrResetTokenInvalid is returned for unknown, used or expired password reset tokens
+var ErrResetTokenInvalid = errors.New("password reset token is invalid or expired")
+
+// PasswordResetToken is a persisted, single-use token for setting a new password
+// Only the hash is stored; the token itself is delivered to the user once
+type PasswordResetToken struct {
+	ID        string    `gorm:"primaryKey"`
+	UserID    string    `gorm:"index;not null"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// BeforeCreate automatically generates UUIDs for new PasswordResetToken records
+func (t *PasswordResetToken) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == "" {
+		t.ID = uuid.New().String()
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// Transaction types recorded in the account history
+const (
+	TransactionDeposit     = "deposit"
+	TransactionWithdrawal  = "withdrawal"
+	TransactionTransferIn  = "transfer_in"
+	TransactionTransferOut = "transfer_out"
+	TransactionAdjustment  = "adjustment"
+)
+
+// Error definitions for transaction operations
+var (
+	ErrInvalidTransactionType = errors.New("invalid transaction type")
+	ErrSelfTransfer           = errors.New("cannot transfer to the same account")
+	ErrRecipientNotFound      = errors.New("recipient account not found")
+)
+
+// Transaction is a customer-facing record of a single balance change
+// Amount and BalanceAfter are in minor units of Currency; Amount is positive except
+// for adjustments, where it carries the sign of the correction
+// Reference points to the ledger journal that carries the matching postings
+// CounterpartyAccountID is set for transfers and names the other side
+// Cross-currency transfers also record the other leg (CounterAmount in CounterCurrency),
+// the applied FXRate and the FXSpread charged, in minor units of FXSpreadCurrency
+type Transaction struct {
+	ID                    uint   `gorm:"primaryKey"`
+	AccountID             string `gorm:"index;not null"`
+	Type                  string `gorm:"not null"`
+	Amount                int64  `gorm:"not null"`
+	BalanceAfter          int64  `gorm:"not null"`
+	Currency              string `gorm:"not null;default:USD"`
+	Reference             string `gorm:"index;not null"`
+	CounterpartyAccountID string
+	CounterAmount         int64
+	CounterCurrency       string
+	FXRate                string
+	FXSpread              int64
+	FXSpreadCurrency      string
+	CreatedAt             time.Time
+}
+
+// ValidTransactionType reports whether t is a known transaction type
+func ValidTransactionType(t string) bool {
+	switch t {
+	case TransactionDeposit, TransactionWithdrawal, TransactionTransferIn, TransactionTransferOut,
+		TransactionAdjustment:
+		return true
+	}
+	return false
+}
+
+// GetAmount returns the transaction amount as Money
+func (t *Transaction) GetAmount() Money {
+	return Money{Amount: t.Amount, Currency: t.Currency}
+}
+
+// GetBalanceAfter returns the resulting account balance as Money
+func (t *Transaction) GetBalanceAfter() Money {
+	return Money{Amount: t.BalanceAfter, Currency: t.Currency}
+}
+
+// GetCounterAmount returns the other leg of a cross-currency transfer, if any
+func (t *Transaction) GetCounterAmount() (Money, bool) {
+	return Money{Amount: t.CounterAmount, Currency: t.CounterCurrency}, t.CounterCurrency != ""
+}
+
+// GetFXSpread returns the spread charged on a cross-currency transfer, if any
+func (t *Transaction) GetFXSpread() (Money, bool) {
+	return Money{Amount: t.FXSpread, Currency: t.FXSpreadCurrency}, t.FXSpreadCurrency != ""
+}
@@ -1,17 +1,91 @@
 package models
 
 import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Error definitions for two-factor authentication
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotPending = errors.New("two-factor enrollment has not been started")
+	ErrInvalidTwoFactor    = errors.New("invalid two-factor code")
+)
+
+// Roles grant access to operator functionality; regular customers have none
+const (
+	RoleAdmin   = "admin"   // full access, including role management
+	RoleSupport = "support" // customer support staff
+)
+
+// ErrInvalidRole is returned for roles other than the ones defined above
+var ErrInvalidRole = errors.New("invalid role")
+
+// ValidRole reports whether role is a known role
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleSupport
+}
+
 type User struct {
-	ID        string    `gorm:"primaryKey;unique"` // UNIQUE ensures no duplicate userIDs can be created
-	Password  string
-	Account   Account `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID                  string `gorm:"primaryKey;unique"` // UNIQUE ensures no duplicate userIDs can be created
+	Password            string
+	FailedLoginAttempts int        `gorm:"not null;default:0"` // consecutive failed logins, reset on success
+	LockedUntil         *time.Time // logins are refused until this time
+	TOTPSecret          string     // encrypted; set on enrollment, active once TOTPEnabled
+	TOTPEnabled         bool       `gorm:"not null;default:false"`
+	TOTPLastStep        int64      `gorm:"not null;default:0"` // last accepted time step, so codes cannot be replayed
+	RecoveryCodes       string     // space-separated hashes of the unused recovery codes
+	Roles               string     `gorm:"not null;default:''"` // space-separated roles, see RoleAdmin
+	Accounts            []Account  `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE"`
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
+
+// IsLocked reports whether logins are refused at the given time
+func (u *User) IsLocked(now time.Time) bool {
+	return u.LockedUntil != nil && u.LockedUntil.After(now)
+}
+
+// RoleList returns the roles granted to the user
+func (u *User) RoleList() []string {
+	return strings.Fields(u.Roles)
+}
+
+// RecoveryCodeHashes returns the hashes of the unused recovery codes
+func (u *User) RecoveryCodeHashes() []string {
+	return strings.Fields(u.RecoveryCodes)
+}
+
+// LoginPolicy decides how long logins are refused after consecutive failures
+// The first FreeAttempts failures cost nothing; each further failure doubles the wait,
+// starting at BackoffBase and capped at BackoffMax; once MaxAttempts failures have
+// accumulated the wait becomes Lockout
+type LoginPolicy struct {
+	FreeAttempts int
+	MaxAttempts  int
+	BackoffBase  time.Duration
+	BackoffMax   time.Duration
+	Lockout      time.Duration
+}
+
+// Delay returns how long logins are refused after the given number of consecutive failures
+func (p LoginPolicy) Delay(failures int) time.Duration {
+	if failures >= p.MaxAttempts {
+		return p.Lockout
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := p.BackoffBase
+	for i := p.FreeAttempts + 1; i < failures && delay < p.BackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, p.BackoffMax)
 }
 
 // HashPassword hashes a password using bcrypt with default cost
@@ -24,3 +98,21 @@ func HashPassword(password string) (string, error) {
 func CheckPassword(hashedPassword, password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 }
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// CheckDummyPassword spends the same time as CheckPassword without a real hash
+// Logins for unknown users call it so that their response time does not reveal
+// whether the user exists
+func CheckDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		secret := make([]byte, 16)
+		rand.Read(secret)
+		hash, _ := bcrypt.GenerateFromPassword(secret, bcrypt.DefaultCost)
+		dummyHash = string(hash)
+	})
+	bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+}
@@ -0,0 +1,95 @@
+// Package notify delivers messages to users, such as password reset links
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Supported notifier kinds
+// KindLog and KindFile are meant for local development; KindNone sends nothing, which
+// turns off the features that need to reach users, such as password reset
+const (
+	KindLog  = "log"
+	KindFile = "file"
+	KindNone = "none"
+)
+
+// Message is a single notification for a user
+type Message struct {
+	To      string `json:"to"` // user ID; the delivery channel resolves the address
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Notifier delivers messages to users
+// Implementations for real channels (email, SMS) plug in behind this interface
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
+
+// New creates the notifier of the given kind; path is used by KindFile
+// KindNone returns a nil Notifier
+func New(kind, path string) (Notifier, error) {
+	switch kind {
+	case KindNone:
+		return nil, nil
+	case KindLog:
+		return LogNotifier{}, nil
+	case KindFile:
+		return &FileNotifier{Path: path}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", kind)
+	}
+}
+
+// LogNotifier writes messages to the server log, for local development
+// Bodies may hold secrets such as password reset tokens, which is why production
+// configurations cannot select it
+type LogNotifier struct{}
+
+// Notify logs the message with the default logger
+func (LogNotifier) Notify(ctx context.Context, msg Message) error {
+	slog.InfoContext(ctx, "notification",
+		slog.String("to", msg.To), slog.String("subject", msg.Subject), slog.String("body", msg.Body))
+	return nil
+}
+
+// FileNotifier appends messages as JSON lines to a file, for local use and tests
+type FileNotifier struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// fileRecord is a message as written by FileNotifier
+type fileRecord struct {
+	Message
+	SentAt time.Time `json:"sentAt"`
+}
+
+// Notify appends the message to the file
+func (n *FileNotifier) Notify(ctx context.Context, msg Message) error {
+	data, err := json.Marshal(fileRecord{Message: msg, SentAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"strings"
+
+	"server/internal/models"
+
+	"gorm.io/gorm/clause"
+)
+
+// ==================== ADMIN OPERATIONS ====================
+
+// likeEscaper escapes the LIKE wildcards in user-supplied search terms
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchUsers finds users whose ID contains query, ordered by ID
+// An empty query matches every user; limit caps the number of results
+func (db *DB) SearchUsers(ctx context.Context, query string, limit int) ([]models.User, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var users []models.User
+	err := db.conn.WithContext(ctx).
+		Where(`id LIKE ? ESCAPE '\'`, "%"+likeEscaper.Replace(query)+"%").
+		Order("id").
+		Limit(limit).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// AdjustBalance applies a manual correction to the balance of an account and returns
+// its history record; amount is added to the balance and may be negative, but the
+// balance cannot drop below zero
+// The counterpart is models.AdjustmentAccountID; frozen accounts can still be adjusted
+func (db *DB) AdjustBalance(ctx context.Context, accountID string, amount models.Money) (*models.Transaction, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var record models.Transaction
+	err := db.transaction(ctx, func(txDB *DB) error {
+		var account models.Account
+		err := txDB.conn.WithContext(ctx).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&account, "id = ?", accountID).Error
+		if err != nil {
+			return err
+		}
+
+		if err := account.Adjust(amount); err != nil {
+			return err
+		}
+		err = txDB.conn.WithContext(ctx).Model(&models.Account{}).
+			Where("id = ?", account.ID).
+			Update("balance", account.Balance).Error
+		if err != nil {
+			return err
+		}
+
+		journalID, err := txDB.postAgainst(ctx, models.AdjustmentAccountID, account.ID, amount)
+		if err != nil {
+			return err
+		}
+		record = models.Transaction{
+			Type:      models.TransactionAdjustment,
+			Amount:    amount.Amount,
+			Reference: journalID,
+		}
+		return txDB.recordTransaction(ctx, &account, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
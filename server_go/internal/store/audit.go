@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"server/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ==================== AUDIT OPERATIONS ====================
+
+// auditBatchSize is the number of events read at a time while walking the hash chain
+const auditBatchSize = 500
+
+// auditChainHead is the single row holding the hash of the latest audit event
+type auditChainHead struct {
+	ID   int
+	Hash string
+}
+
+// TableName keeps the singular name of the migration
+func (auditChainHead) TableName() string { return "audit_chain_head" }
+
+// AuditFilter narrows down an audit log query
+// Zero values mean "no restriction"; BeforeID is the pagination cursor
+type AuditFilter struct {
+	ActorID    string
+	Action     string
+	TargetType string
+	TargetID   string
+	From       time.Time
+	To         time.Time
+	BeforeID   uint
+	Limit      int
+}
+
+// RecordAuditEvent appends an event to the audit log, chaining it to the latest event
+// Run it in the same WithTx as the action it describes, so that the action never
+// takes effect without its record
+func (db *DB) RecordAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.transaction(ctx, func(txDB *DB) error {
+		// Other appends wait for the head until this transaction ends
+		var head auditChainHead
+		err := txDB.conn.WithContext(ctx).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&head, 1).Error
+		if err != nil {
+			return err
+		}
+
+		// Timestamps are kept to microseconds so that they survive every database unchanged
+		if event.CreatedAt.IsZero() {
+			event.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+		}
+		event.PrevHash = head.Hash
+		event.Hash = event.ComputeHash()
+		if err := txDB.conn.WithContext(ctx).Create(event).Error; err != nil {
+			return err
+		}
+		return txDB.conn.WithContext(ctx).Model(&head).Update("hash", event.Hash).Error
+	})
+}
+
+// ListAuditEvents retrieves audit events, newest first
+func (db *DB) ListAuditEvents(ctx context.Context, filter AuditFilter) ([]models.AuditEvent, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	query := db.conn.WithContext(ctx)
+	for column, value := range map[string]string{
+		"actor_id":    filter.ActorID,
+		"action":      filter.Action,
+		"target_type": filter.TargetType,
+		"target_id":   filter.TargetID,
+	} {
+		if value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To.UTC())
+	}
+	if filter.BeforeID > 0 {
+		query = query.Where("id < ?", filter.BeforeID)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var events []models.AuditEvent
+	if err := query.Order("id DESC").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// VerifyAuditChain walks the whole audit log and checks every hash
+// Returns the number of events and the hash of the latest one; operators can keep the
+// latest hash elsewhere to also detect events removed from the end of the log
+// A mismatch is reported as models.ErrAuditChainBroken naming the first bad event
+func (db *DB) VerifyAuditChain(ctx context.Context) (int64, string, error) {
+	var count int64
+	var prev string
+	var batch []models.AuditEvent
+	res := db.conn.WithContext(ctx).Order("id").FindInBatches(&batch, auditBatchSize, func(tx *gorm.DB, _ int) error {
+		for _, event := range batch {
+			if event.PrevHash != prev || event.Hash != event.ComputeHash() {
+				return fmt.Errorf("%w at event %d", models.ErrAuditChainBroken, event.ID)
+			}
+			prev = event.Hash
+			count++
+		}
+		return nil
+	})
+	if res.Error != nil {
+		return count, prev, res.Error
+	}
+	return count, prev, nil
+}
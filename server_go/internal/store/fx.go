@@ -0,0 +1,170 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"server/internal/fx"
+	"server/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// ==================== FX OPERATIONS ====================
+
+// fxConversion describes how the destination side of a cross-currency transfer was priced
+type fxConversion struct {
+	credit models.Money // amount credited at the quoted rate
+	mid    models.Money // amount the mid-market rate would have credited
+	rate   string
+}
+
+// spread returns what the bank earned on the conversion, in the destination currency
+func (c *fxConversion) spread() models.Money {
+	return models.Money{Amount: c.mid.Amount - c.credit.Amount, Currency: c.credit.Currency}
+}
+
+// describe records the other leg, the applied rate and the spread on a history record
+func (c *fxConversion) describe(record *models.Transaction, counter models.Money) {
+	spread := c.spread()
+	record.CounterAmount = counter.Amount
+	record.CounterCurrency = counter.Currency
+	record.FXRate = c.rate
+	record.FXSpread = spread.Amount
+	record.FXSpreadCurrency = spread.Currency
+}
+
+// fxRate is a stored mid-market rate: 1 unit of FromCurrency buys Rate units of ToCurrency
+type fxRate struct {
+	FromCurrency string `gorm:"primaryKey"`
+	ToCurrency   string `gorm:"primaryKey"`
+	Rate         string
+}
+
+// TableName keeps the name of the migration
+func (fxRate) TableName() string { return "fx_rates" }
+
+// ListFXRates returns the stored rate table sorted by currency pair
+func (db *DB) ListFXRates(ctx context.Context) ([]fx.Rate, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var rows []fxRate
+	if err := db.conn.WithContext(ctx).Order("from_currency, to_currency").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	rates := make([]fx.Rate, len(rows))
+	for i, row := range rows {
+		rates[i] = fx.Rate{From: row.FromCurrency, To: row.ToCurrency, Rate: row.Rate}
+	}
+	return rates, nil
+}
+
+// ReplaceFXRates stores rates in place of the whole rate table
+func (db *DB) ReplaceFXRates(ctx context.Context, rates []fx.Rate) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.transaction(ctx, func(txDB *DB) error {
+		if err := txDB.conn.WithContext(ctx).Where("1 = 1").Delete(&fxRate{}).Error; err != nil {
+			return err
+		}
+		if len(rates) == 0 {
+			return nil
+		}
+		rows := make([]fxRate, len(rates))
+		for i, rate := range rates {
+			rows[i] = fxRate{FromCurrency: rate.From, ToCurrency: rate.To, Rate: rate.Rate}
+		}
+		return txDB.conn.WithContext(ctx).Create(&rows).Error
+	})
+}
+
+// CreateFXQuote persists a quote issued by fx.Quoter
+func (db *DB) CreateFXQuote(ctx context.Context, quote *models.FXQuote) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.conn.WithContext(ctx).Create(quote).Error
+}
+
+// consumeQuote marks a user's quote as used and prices amount with it
+// Must run inside the transfer transaction so that a failed transfer leaves the quote unused
+func (db *DB) consumeQuote(ctx context.Context, userID, quoteID string, amount models.Money, toCurrency string) (*fxConversion, error) {
+	if quoteID == "" {
+		return nil, models.ErrQuoteRequired
+	}
+
+	var quote models.FXQuote
+	err := db.conn.WithContext(ctx).First(&quote, "id = ? AND user_id = ?", quoteID, userID).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, models.ErrQuoteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if quote.FromCurrency != amount.Currency || quote.ToCurrency != toCurrency {
+		return nil, models.ErrQuoteMismatch
+	}
+
+	now := time.Now().UTC()
+	res := db.conn.WithContext(ctx).Model(&models.FXQuote{}).
+		Where("id = ? AND used_at IS NULL AND expires_at > ?", quote.ID, now).
+		Update("used_at", now)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, models.ErrQuoteExpired
+	}
+	return priceQuote(&quote, amount, toCurrency)
+}
+
+// priceQuote converts amount to toCurrency at the rate of quote
+func priceQuote(quote *models.FXQuote, amount models.Money, toCurrency string) (*fxConversion, error) {
+	rate, err := fx.ParseRate(quote.Rate)
+	if err != nil {
+		return nil, err
+	}
+	midRate, err := fx.ParseRate(quote.MidRate)
+	if err != nil {
+		return nil, err
+	}
+	credit, err := fx.Convert(amount, rate, toCurrency)
+	if err != nil {
+		return nil, err
+	}
+	mid, err := fx.Convert(amount, midRate, toCurrency)
+	if err != nil {
+		return nil, err
+	}
+	if !credit.IsPositive() {
+		return nil, models.ErrInvalidAmount
+	}
+	return &fxConversion{credit: credit, mid: mid, rate: quote.Rate}, nil
+}
+
+// transferPostings builds the ledger journal of a transfer
+// A cross-currency transfer goes through the bank's FX position in each currency,
+// and the spread is booked as FX revenue in the destination currency
+func transferPostings(fromID, toID string, debit, credit models.Money, conversion *fxConversion) []models.LedgerEntry {
+	if conversion == nil {
+		return []models.LedgerEntry{
+			{AccountID: fromID, Direction: models.Debit, Amount: debit.Amount, Currency: debit.Currency},
+			{AccountID: toID, Direction: models.Credit, Amount: credit.Amount, Currency: credit.Currency},
+		}
+	}
+
+	entries := []models.LedgerEntry{
+		{AccountID: fromID, Direction: models.Debit, Amount: debit.Amount, Currency: debit.Currency},
+		{AccountID: models.FXPositionAccountID(debit.Currency), Direction: models.Credit, Amount: debit.Amount, Currency: debit.Currency},
+		{AccountID: models.FXPositionAccountID(credit.Currency), Direction: models.Debit, Amount: conversion.mid.Amount, Currency: credit.Currency},
+		{AccountID: toID, Direction: models.Credit, Amount: credit.Amount, Currency: credit.Currency},
+	}
+	if spread := conversion.spread(); spread.IsPositive() {
+		entries = append(entries, models.LedgerEntry{
+			AccountID: models.FXRevenueAccountID(spread.Currency), Direction: models.Credit, Amount: spread.Amount, Currency: spread.Currency,
+		})
+	}
+	return entries
+}
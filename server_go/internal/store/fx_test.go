@@ -0,0 +1,102 @@
+package store
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"server/internal/fx"
+	"server/internal/models"
+)
+
+func TestSpreadQuotePostings(t *testing.T) {
+	rates := fx.NewTable()
+	if err := rates.Replace([]fx.Rate{
+		{From: "EUR", To: "USD", Rate: "1.25"},
+		{From: "USD", To: "JPY", Rate: "150"},
+	}); err != nil {
+		t.Fatalf("Replace: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		spreadBps int
+		amount    models.Money
+		to        string
+		want      []models.LedgerEntry
+	}{
+		{
+			// 100.00 USD at the mid rate of 0.8 is 80.00 EUR; the 1% spread keeps 0.80 EUR
+			name:      "spread booked as revenue",
+			spreadBps: 100,
+			amount:    usd(10000),
+			to:        "EUR",
+			want: []models.LedgerEntry{
+				{AccountID: "from", Direction: models.Debit, Amount: 10000, Currency: "USD"},
+				{AccountID: models.FXPositionAccountID("USD"), Direction: models.Credit, Amount: 10000, Currency: "USD"},
+				{AccountID: models.FXPositionAccountID("EUR"), Direction: models.Debit, Amount: 8000, Currency: "EUR"},
+				{AccountID: "to", Direction: models.Credit, Amount: 7920, Currency: "EUR"},
+				{AccountID: models.FXRevenueAccountID("EUR"), Direction: models.Credit, Amount: 80, Currency: "EUR"},
+			},
+		},
+		{
+			// 0.99 USD is 148.5 JPY at the mid rate and 146.27 after the spread; both round
+			// down to whole yen, leaving a spread of 2 JPY
+			name:      "rounded to whole minor units",
+			spreadBps: 150,
+			amount:    usd(99),
+			to:        "JPY",
+			want: []models.LedgerEntry{
+				{AccountID: "from", Direction: models.Debit, Amount: 99, Currency: "USD"},
+				{AccountID: models.FXPositionAccountID("USD"), Direction: models.Credit, Amount: 99, Currency: "USD"},
+				{AccountID: models.FXPositionAccountID("JPY"), Direction: models.Debit, Amount: 148, Currency: "JPY"},
+				{AccountID: "to", Direction: models.Credit, Amount: 146, Currency: "JPY"},
+				{AccountID: models.FXRevenueAccountID("JPY"), Direction: models.Credit, Amount: 2, Currency: "JPY"},
+			},
+		},
+		{
+			name:      "no spread",
+			spreadBps: 0,
+			amount:    usd(10000),
+			to:        "EUR",
+			want: []models.LedgerEntry{
+				{AccountID: "from", Direction: models.Debit, Amount: 10000, Currency: "USD"},
+				{AccountID: models.FXPositionAccountID("USD"), Direction: models.Credit, Amount: 10000, Currency: "USD"},
+				{AccountID: models.FXPositionAccountID("EUR"), Direction: models.Debit, Amount: 8000, Currency: "EUR"},
+				{AccountID: "to", Direction: models.Credit, Amount: 8000, Currency: "EUR"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote, err := fx.NewQuoter(rates, tt.spreadBps, time.Minute).Quote("alice", tt.amount.Currency, tt.to)
+			if err != nil {
+				t.Fatalf("Quote: %v", err)
+			}
+			conversion, err := priceQuote(quote, tt.amount, tt.to)
+			if err != nil {
+				t.Fatalf("priceQuote: %v", err)
+			}
+
+			entries := transferPostings("from", "to", tt.amount, conversion.credit, conversion)
+			if !slices.Equal(entries, tt.want) {
+				t.Fatalf("postings = %+v, want %+v", entries, tt.want)
+			}
+
+			// Each currency must balance on its own
+			net := map[string]int64{}
+			for _, entry := range entries {
+				if entry.Direction == models.Debit {
+					net[entry.Currency] += entry.Amount
+				} else {
+					net[entry.Currency] -= entry.Amount
+				}
+			}
+			for currency, amount := range net {
+				if amount != 0 {
+					t.Errorf("%s postings are off by %d", currency, amount)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"server/internal/models"
+
+	"gorm.io/gorm/clause"
+)
+
+// ==================== IDEMPOTENCY KEY OPERATIONS ====================
+
+// ReserveIdempotencyKey claims record.Key for record.UserID
+// Returns nil if the key was free (or had expired) and is now reserved for this request,
+// otherwise returns the stored record of the earlier request that used the key
+func (db *DB) ReserveIdempotencyKey(ctx context.Context, record *models.IdempotencyKey) (*models.IdempotencyKey, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var existing *models.IdempotencyKey
+	err := db.transaction(ctx, func(txDB *DB) error {
+		// An expired key is treated as if it had never been used
+		err := txDB.conn.WithContext(ctx).
+			Where("key = ? AND user_id = ? AND expires_at <= ?", record.Key, record.UserID, time.Now().UTC()).
+			Delete(&models.IdempotencyKey{}).Error
+		if err != nil {
+			return err
+		}
+
+		res := txDB.conn.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 1 {
+			return nil
+		}
+
+		existing = &models.IdempotencyKey{}
+		return txDB.conn.WithContext(ctx).First(existing, "key = ? AND user_id = ?", record.Key, record.UserID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request that reserved the key
+func (db *DB) CompleteIdempotencyKey(ctx context.Context, key, userID string, statusCode int, contentType string, response []byte) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.conn.WithContext(ctx).Model(&models.IdempotencyKey{}).
+		Where("key = ? AND user_id = ?", key, userID).
+		Updates(map[string]interface{}{
+			"status_code":  statusCode,
+			"content_type": contentType,
+			"response":     response,
+		}).Error
+}
+
+// ReleaseIdempotencyKey drops a reservation so that the request can be retried,
+// used when the original request failed without changing any state
+func (db *DB) ReleaseIdempotencyKey(ctx context.Context, key, userID string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.conn.WithContext(ctx).
+		Where("key = ? AND user_id = ?", key, userID).
+		Delete(&models.IdempotencyKey{}).Error
+}
+
+// PurgeExpiredIdempotencyKeys deletes all keys whose retention window has passed
+func (db *DB) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	res := db.conn.WithContext(ctx).
+		Where("expires_at <= ?", time.Now().UTC()).
+		Delete(&models.IdempotencyKey{})
+	return res.RowsAffected, res.Error
+}
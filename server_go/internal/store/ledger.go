@@ -0,0 +1,157 @@
+package store
+
+import (
+	"context"
+
+	"server/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ==================== LEDGER OPERATIONS ====================
+
+// signedAmountSQL evaluates a ledger entry's effect on a customer balance
+const signedAmountSQL = "CASE WHEN direction = 'credit' THEN amount ELSE -amount END"
+
+// postJournal writes a balanced set of postings under a new journal ID
+// It must run inside WithTx together with the balance updates the postings explain
+func (db *DB) postJournal(ctx context.Context, entries ...models.LedgerEntry) (string, error) {
+	if err := models.ValidateJournal(entries); err != nil {
+		return "", err
+	}
+
+	journalID := uuid.New().String()
+	for i := range entries {
+		entries[i].JournalID = journalID
+	}
+	if err := db.conn.WithContext(ctx).Create(&entries).Error; err != nil {
+		return "", err
+	}
+	return journalID, nil
+}
+
+// postExternal records money entering (amount > 0) or leaving (amount < 0) an account
+// from outside the bank, such as a deposit, withdrawal or opening balance
+func (db *DB) postExternal(ctx context.Context, accountID string, amount models.Money) (string, error) {
+	return db.postAgainst(ctx, models.ExternalAccountID, accountID, amount)
+}
+
+// postAgainst moves amount into (amount > 0) or out of (amount < 0) an account,
+// with the internal ledger account counterpartyID on the other side
+func (db *DB) postAgainst(ctx context.Context, counterpartyID, accountID string, amount models.Money) (string, error) {
+	from, to, value := counterpartyID, accountID, amount.Amount
+	if value < 0 {
+		from, to, value = accountID, counterpartyID, -value
+	}
+	return db.postJournal(ctx,
+		models.LedgerEntry{AccountID: from, Direction: models.Debit, Amount: value, Currency: amount.Currency},
+		models.LedgerEntry{AccountID: to, Direction: models.Credit, Amount: value, Currency: amount.Currency},
+	)
+}
+
+// GetLedgerEntries retrieves all postings of an account in the order they were written
+func (db *DB) GetLedgerEntries(ctx context.Context, accountID string) ([]models.LedgerEntry, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var entries []models.LedgerEntry
+	err := db.conn.WithContext(ctx).Order("id").Find(&entries, "account_id = ?", accountID).Error
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// LedgerBalance computes the balance of an account, in minor units, from its ledger entries
+func (db *DB) LedgerBalance(ctx context.Context, accountID string) (int64, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var balance int64
+	err := db.conn.WithContext(ctx).Model(&models.LedgerEntry{}).
+		Select("COALESCE(SUM("+signedAmountSQL+"), 0)").
+		Where("account_id = ?", accountID).
+		Scan(&balance).Error
+	return balance, err
+}
+
+// VerifyBalance checks that the cached balance of an account matches its ledger
+// Returns models.ErrBalanceMismatch if the two have diverged
+func (db *DB) VerifyBalance(ctx context.Context, accountID string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var account models.Account
+	if err := db.conn.WithContext(ctx).First(&account, "id = ?", accountID).Error; err != nil {
+		return err
+	}
+	balance, err := db.LedgerBalance(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	if balance != account.Balance {
+		return models.ErrBalanceMismatch
+	}
+	return nil
+}
+
+// RecomputeBalance rebuilds the cached balance of an account from its ledger
+func (db *DB) RecomputeBalance(ctx context.Context, accountID string) (*models.Account, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var account models.Account
+	err := db.transaction(ctx, func(txDB *DB) error {
+		balance, err := txDB.LedgerBalance(ctx, accountID)
+		if err != nil {
+			return err
+		}
+		res := txDB.conn.WithContext(ctx).Model(&models.Account{}).
+			Where("id = ?", accountID).
+			Update("balance", balance)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return txDB.conn.WithContext(ctx).First(&account, "id = ?", accountID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// VerifyLedger checks the whole ledger: every journal must balance and every
+// cached account balance must match the sum of its postings
+func (db *DB) VerifyLedger(ctx context.Context) error {
+	var unbalanced int64
+	err := db.conn.WithContext(ctx).Raw(`SELECT COUNT(*) FROM (
+		SELECT journal_id FROM ledger_entries
+		GROUP BY journal_id, currency
+		HAVING SUM(` + signedAmountSQL + `) <> 0
+	) AS j`).Scan(&unbalanced).Error
+	if err != nil {
+		return err
+	}
+	if unbalanced > 0 {
+		return models.ErrUnbalancedJournal
+	}
+
+	var mismatched int64
+	err = db.conn.WithContext(ctx).Raw(`SELECT COUNT(*) FROM accounts a
+		LEFT JOIN (
+			SELECT account_id, SUM(` + signedAmountSQL + `) AS balance
+			FROM ledger_entries GROUP BY account_id
+		) l ON l.account_id = a.id
+		WHERE a.balance <> COALESCE(l.balance, 0)`).Scan(&mismatched).Error
+	if err != nil {
+		return err
+	}
+	if mismatched > 0 {
+		return models.ErrBalanceMismatch
+	}
+	return nil
+}
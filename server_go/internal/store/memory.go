@@ -0,0 +1,1076 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"server/internal/fx"
+	"server/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ==================== IN-MEMORY REPOSITORY ====================
+
+// Memory is a Repository that keeps all data in process memory, for tests and local
+// experiments; nothing survives a restart and no ledger is kept
+// A single lock serializes operations. WithTx holds it until the transaction ends and
+// restores a snapshot when it fails, so transactions are all-or-nothing and isolated
+// like those of DB; a nested WithTx takes another snapshot, like a savepoint
+// Records are copied in and out, so callers never share state with the store
+type Memory struct {
+	mu   *sync.Mutex
+	data *memoryData
+	inTx bool // the lock is held by the enclosing transaction
+}
+
+// memoryData holds the tables of a Memory
+// Rows are stored by value and changed by replacing them, so a shallow copy of every
+// map and slice is a consistent snapshot
+type memoryData struct {
+	users         map[string]models.User
+	accounts      map[string]models.Account
+	transactions  []models.Transaction
+	fxQuotes      map[string]models.FXQuote
+	fxRates       []fx.Rate
+	idempotency   map[idempotencyKeyID]models.IdempotencyKey
+	refreshTokens map[string]models.RefreshToken
+	revocations   []models.TokenRevocation
+	resetTokens   map[string]models.PasswordResetToken
+	auditEvents   []models.AuditEvent
+	lastRecordID  uint // last ID given to a transaction
+	lastRevokeID  uint // last ID given to a token revocation
+	lastAuditID   uint // last ID given to an audit event
+}
+
+// idempotencyKeyID is the primary key of an idempotency key
+type idempotencyKeyID struct {
+	key    string
+	userID string
+}
+
+// NewMemory creates an empty in-memory repository
+func NewMemory() *Memory {
+	return &Memory{
+		mu: &sync.Mutex{},
+		data: &memoryData{
+			users:         map[string]models.User{},
+			accounts:      map[string]models.Account{},
+			fxQuotes:      map[string]models.FXQuote{},
+			idempotency:   map[idempotencyKeyID]models.IdempotencyKey{},
+			refreshTokens: map[string]models.RefreshToken{},
+			resetTokens:   map[string]models.PasswordResetToken{},
+		},
+	}
+}
+
+// Memory must satisfy Repository
+var _ Repository = (*Memory)(nil)
+
+// clone returns a snapshot of d
+func (d *memoryData) clone() *memoryData {
+	c := *d
+	c.users = maps.Clone(d.users)
+	c.accounts = maps.Clone(d.accounts)
+	c.transactions = slices.Clone(d.transactions)
+	c.fxQuotes = maps.Clone(d.fxQuotes)
+	c.fxRates = slices.Clone(d.fxRates)
+	c.idempotency = maps.Clone(d.idempotency)
+	c.refreshTokens = maps.Clone(d.refreshTokens)
+	c.revocations = slices.Clone(d.revocations)
+	c.resetTokens = maps.Clone(d.resetTokens)
+	c.auditEvents = slices.Clone(d.auditEvents)
+	return &c
+}
+
+// WithTx runs fn in a transaction, see Repository
+func (m *Memory) WithTx(ctx context.Context, fn func(Repository) error) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		return fn(tx)
+	})
+}
+
+// transaction is WithTx for the operations of Memory, which need the Memory itself
+// Changes are undone if fn fails or ctx ends before fn returns
+func (m *Memory) transaction(ctx context.Context, fn func(*Memory) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !m.inTx {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
+
+	snapshot := m.data.clone()
+	err := fn(&Memory{mu: m.mu, data: m.data, inTx: true})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		*m.data = *snapshot
+	}
+	return err
+}
+
+// view runs fn with read access to the data
+func (m *Memory) view(ctx context.Context, fn func(d *memoryData) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !m.inTx {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
+	return fn(m.data)
+}
+
+// ==================== USER OPERATIONS ====================
+
+// CreateUser creates a new user
+// A taken user ID is reported as gorm.ErrDuplicatedKey
+func (m *Memory) CreateUser(ctx context.Context, user *models.User) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		if _, ok := tx.data.users[user.ID]; ok {
+			return gorm.ErrDuplicatedKey
+		}
+		now := time.Now().UTC()
+		user.CreatedAt, user.UpdatedAt = now, now
+		stored := *user
+		stored.Accounts = nil
+		tx.data.users[user.ID] = stored
+		return nil
+	})
+}
+
+// GetUserByID retrieves a user by ID
+func (m *Memory) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	var user models.User
+	err := m.view(ctx, func(d *memoryData) error {
+		var ok bool
+		if user, ok = d.users[id]; !ok {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// updateUser applies change to a stored user
+func (m *Memory) updateUser(ctx context.Context, userID string, change func(user *models.User) error) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		user, ok := tx.data.users[userID]
+		if !ok {
+			return gorm.ErrRecordNotFound
+		}
+		if err := change(&user); err != nil {
+			return err
+		}
+		user.UpdatedAt = time.Now().UTC()
+		tx.data.users[userID] = user
+		return nil
+	})
+}
+
+// SearchUsers finds users whose ID contains query, ordered by ID
+func (m *Memory) SearchUsers(ctx context.Context, query string, limit int) ([]models.User, error) {
+	var users []models.User
+	err := m.view(ctx, func(d *memoryData) error {
+		for _, id := range slices.Sorted(maps.Keys(d.users)) {
+			if limit > 0 && len(users) == limit {
+				break
+			}
+			if strings.Contains(id, query) {
+				users = append(users, d.users[id])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// SetUserRoles replaces the roles of a user
+func (m *Memory) SetUserRoles(ctx context.Context, userID string, roles []string) error {
+	for _, role := range roles {
+		if !models.ValidRole(role) {
+			return models.ErrInvalidRole
+		}
+	}
+	return m.updateUser(ctx, userID, func(user *models.User) error {
+		user.Roles = strings.Join(roles, " ")
+		return nil
+	})
+}
+
+// GrantRole adds a role to a user, keeping the roles already granted
+func (m *Memory) GrantRole(ctx context.Context, userID, role string) error {
+	if !models.ValidRole(role) {
+		return models.ErrInvalidRole
+	}
+	return m.updateUser(ctx, userID, func(user *models.User) error {
+		if roles := user.RoleList(); !slices.Contains(roles, role) {
+			user.Roles = strings.Join(append(roles, role), " ")
+		}
+		return nil
+	})
+}
+
+// BootstrapAdmins grants the admin role to those of userIDs that exist, unless some user
+// is an admin already, and returns the users it was granted to
+func (m *Memory) BootstrapAdmins(ctx context.Context, userIDs []string) ([]string, error) {
+	var granted []string
+	err := m.transaction(ctx, func(tx *Memory) error {
+		for _, user := range tx.data.users {
+			if slices.Contains(user.RoleList(), models.RoleAdmin) {
+				return nil
+			}
+		}
+		for _, userID := range userIDs {
+			user, ok := tx.data.users[userID]
+			if !ok || slices.Contains(user.RoleList(), models.RoleAdmin) {
+				continue
+			}
+			user.Roles = strings.Join(append(user.RoleList(), models.RoleAdmin), " ")
+			user.UpdatedAt = time.Now().UTC()
+			tx.data.users[userID] = user
+			granted = append(granted, userID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return granted, nil
+}
+
+// RecordLoginFailure counts a failed login for a user and returns the updated user
+func (m *Memory) RecordLoginFailure(ctx context.Context, userID string, policy models.LoginPolicy) (*models.User, error) {
+	var updated models.User
+	err := m.updateUser(ctx, userID, func(user *models.User) error {
+		user.FailedLoginAttempts++
+		lockedUntil := time.Now().UTC().Add(policy.Delay(user.FailedLoginAttempts))
+		user.LockedUntil = &lockedUntil
+		updated = *user
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// ResetLoginFailures clears the failed login count and lockout of a user
+func (m *Memory) ResetLoginFailures(ctx context.Context, userID string) error {
+	return m.updateUser(ctx, userID, func(user *models.User) error {
+		user.FailedLoginAttempts = 0
+		user.LockedUntil = nil
+		return nil
+	})
+}
+
+// ==================== PASSWORD OPERATIONS ====================
+
+// ChangePassword stores a new password hash for a user and revokes all of the user's
+// refresh tokens
+func (m *Memory) ChangePassword(ctx context.Context, userID, passwordHash string) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		err := tx.updateUser(ctx, userID, func(user *models.User) error {
+			user.Password = passwordHash
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.RevokeUserRefreshTokens(ctx, userID)
+	})
+}
+
+// CreatePasswordResetToken stores a reset token, replacing any unused earlier ones of the user
+func (m *Memory) CreatePasswordResetToken(ctx context.Context, token *models.PasswordResetToken) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		maps.DeleteFunc(tx.data.resetTokens, func(_ string, t models.PasswordResetToken) bool {
+			return t.UserID == token.UserID && t.UsedAt == nil
+		})
+		for _, t := range tx.data.resetTokens {
+			if t.TokenHash == token.TokenHash {
+				return gorm.ErrDuplicatedKey
+			}
+		}
+		token.BeforeCreate(nil)
+		token.CreatedAt = time.Now().UTC()
+		tx.data.resetTokens[token.ID] = *token
+		return nil
+	})
+}
+
+// GetPasswordResetToken retrieves an unused, unexpired reset token by its hash
+func (m *Memory) GetPasswordResetToken(ctx context.Context, tokenHash string) (*models.PasswordResetToken, error) {
+	var token models.PasswordResetToken
+	err := m.view(ctx, func(d *memoryData) error {
+		for _, t := range d.resetTokens {
+			if t.TokenHash == tokenHash && t.UsedAt == nil && t.ExpiresAt.After(time.Now().UTC()) {
+				token = t
+				return nil
+			}
+		}
+		return models.ErrResetTokenInvalid
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ResetPassword consumes the reset token with the given hash and sets the new password
+// of its user, revoking the user's refresh tokens and clearing any login lockout
+func (m *Memory) ResetPassword(ctx context.Context, tokenHash, passwordHash string) (string, error) {
+	var userID string
+	err := m.transaction(ctx, func(tx *Memory) error {
+		token, err := tx.GetPasswordResetToken(ctx, tokenHash)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		token.UsedAt = &now
+		tx.data.resetTokens[token.ID] = *token
+
+		if err := tx.ChangePassword(ctx, token.UserID, passwordHash); err != nil {
+			return err
+		}
+		userID = token.UserID
+		return tx.ResetLoginFailures(ctx, token.UserID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// PurgeExpiredPasswordResetTokens deletes reset tokens that can no longer be used
+func (m *Memory) PurgeExpiredPasswordResetTokens(ctx context.Context) (int64, error) {
+	var n int64
+	err := m.transaction(ctx, func(tx *Memory) error {
+		now := time.Now().UTC()
+		n = purge(tx.data.resetTokens, func(t models.PasswordResetToken) bool {
+			return !t.ExpiresAt.After(now) || t.UsedAt != nil
+		})
+		return nil
+	})
+	return n, err
+}
+
+// ==================== TWO-FACTOR OPERATIONS ====================
+
+// StartTOTPEnrollment stores a new, not yet confirmed TOTP secret for a user
+func (m *Memory) StartTOTPEnrollment(ctx context.Context, userID, encryptedSecret string) error {
+	err := m.updateUser(ctx, userID, func(user *models.User) error {
+		if user.TOTPEnabled {
+			return models.ErrTwoFactorEnabled
+		}
+		user.TOTPSecret = encryptedSecret
+		user.TOTPLastStep = 0
+		return nil
+	})
+	if err == gorm.ErrRecordNotFound {
+		return models.ErrTwoFactorEnabled
+	}
+	return err
+}
+
+// ConfirmTOTPEnrollment enables two-factor authentication and stores the recovery codes
+func (m *Memory) ConfirmTOTPEnrollment(ctx context.Context, userID string, step int64, recoveryHashes []string) error {
+	err := m.updateUser(ctx, userID, func(user *models.User) error {
+		if user.TOTPEnabled || user.TOTPSecret == "" {
+			return models.ErrTwoFactorNotPending
+		}
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = strings.Join(recoveryHashes, " ")
+		return nil
+	})
+	if err == gorm.ErrRecordNotFound {
+		return models.ErrTwoFactorNotPending
+	}
+	return err
+}
+
+// UseTOTPStep records that a code of the given time step was accepted
+func (m *Memory) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	err := m.updateUser(ctx, userID, func(user *models.User) error {
+		if user.TOTPLastStep >= step {
+			return models.ErrInvalidTwoFactor
+		}
+		user.TOTPLastStep = step
+		return nil
+	})
+	if err == gorm.ErrRecordNotFound {
+		return models.ErrInvalidTwoFactor
+	}
+	return err
+}
+
+// UseRecoveryCode consumes the recovery code with the given hash
+func (m *Memory) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	return m.updateUser(ctx, userID, func(user *models.User) error {
+		hashes := user.RecoveryCodeHashes()
+		i := slices.Index(hashes, codeHash)
+		if i < 0 {
+			return models.ErrInvalidTwoFactor
+		}
+		user.RecoveryCodes = strings.Join(slices.Delete(hashes, i, i+1), " ")
+		return nil
+	})
+}
+
+// ==================== ACCOUNT OPERATIONS ====================
+
+// CreateAccount creates a new account
+// Accounts without a currency are opened in models.DefaultCurrency, without a type as checking
+func (m *Memory) CreateAccount(ctx context.Context, account *models.Account) error {
+	if account.Currency == "" {
+		account.Currency = models.DefaultCurrency
+	}
+	if !models.ValidCurrency(account.Currency) {
+		return models.ErrUnknownCurrency
+	}
+	return m.transaction(ctx, func(tx *Memory) error {
+		account.BeforeCreate(nil)
+		if _, ok := tx.data.accounts[account.ID]; ok {
+			return gorm.ErrDuplicatedKey
+		}
+		if account.Type == "" {
+			account.Type = models.AccountChecking
+		}
+		now := time.Now().UTC()
+		account.CreatedAt, account.UpdatedAt = now, now
+		tx.data.accounts[account.ID] = *account
+		return nil
+	})
+}
+
+// GetAccount retrieves any account by ID, regardless of its owner
+func (m *Memory) GetAccount(ctx context.Context, accountID string) (*models.Account, error) {
+	var account models.Account
+	err := m.view(ctx, func(d *memoryData) error {
+		var ok bool
+		if account, ok = d.accounts[accountID]; !ok {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// GetAccountForUser retrieves an account owned by the given user
+func (m *Memory) GetAccountForUser(ctx context.Context, userID, accountID string) (*models.Account, error) {
+	account, err := m.GetAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account.UserID != userID {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return account, nil
+}
+
+// GetAccountsByUserID retrieves all accounts for a user, oldest first
+func (m *Memory) GetAccountsByUserID(ctx context.Context, userID string) ([]models.Account, error) {
+	var accounts []models.Account
+	err := m.view(ctx, func(d *memoryData) error {
+		for _, account := range d.accounts {
+			if account.UserID == userID {
+				accounts = append(accounts, account)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(accounts, func(a, b models.Account) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID, b.ID))
+	})
+	return accounts, nil
+}
+
+// updateAccount applies change to a stored account and returns the updated account
+func (m *Memory) updateAccount(ctx context.Context, accountID string, change func(account *models.Account) error) (*models.Account, error) {
+	var updated models.Account
+	err := m.transaction(ctx, func(tx *Memory) error {
+		account, ok := tx.data.accounts[accountID]
+		if !ok {
+			return gorm.ErrRecordNotFound
+		}
+		if err := change(&account); err != nil {
+			return err
+		}
+		account.UpdatedAt = time.Now().UTC()
+		tx.data.accounts[accountID] = account
+		updated = account
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// SetAccountStatus moves an account to status and returns the updated account
+func (m *Memory) SetAccountStatus(ctx context.Context, accountID, status string) (*models.Account, error) {
+	return m.updateAccount(ctx, accountID, func(account *models.Account) error {
+		return account.SetStatus(status)
+	})
+}
+
+// CloseAccount closes an account and returns it together with the payout, if any
+func (m *Memory) CloseAccount(ctx context.Context, accountID, payoutAccountID string, operator bool) (*models.Account, *models.Transaction, error) {
+	var account *models.Account
+	var payout *models.Transaction
+	err := m.transaction(ctx, func(tx *Memory) error {
+		var err error
+		if account, err = tx.GetAccount(ctx, accountID); err != nil {
+			return err
+		}
+		if account.Status == models.AccountFrozen && !operator {
+			return models.ErrAccountFrozen
+		}
+		if account.Balance != 0 && payoutAccountID != "" {
+			payout, err = tx.transfer(ctx, account.UserID, accountID, payoutAccountID, account.GetBalance(), "", operator)
+			if err != nil {
+				return err
+			}
+		}
+		account, err = tx.SetAccountStatus(ctx, accountID, models.AccountClosed)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return account, payout, nil
+}
+
+// ==================== MONEY MOVEMENT ====================
+
+// Deposit adds amount to the balance of an account owned by userID and returns the
+// updated account
+func (m *Memory) Deposit(ctx context.Context, userID, accountID string, amount models.Money) (*models.Account, error) {
+	return m.changeBalance(ctx, userID, accountID, models.TransactionDeposit, amount)
+}
+
+// Withdraw subtracts amount from the balance of an account owned by userID and returns
+// the updated account
+func (m *Memory) Withdraw(ctx context.Context, userID, accountID string, amount models.Money) (*models.Account, error) {
+	return m.changeBalance(ctx, userID, accountID, models.TransactionWithdrawal, amount)
+}
+
+// changeBalance applies a deposit or withdrawal of amount and records it
+func (m *Memory) changeBalance(ctx context.Context, userID, accountID, kind string, amount models.Money) (*models.Account, error) {
+	if !amount.IsPositive() {
+		return nil, models.ErrInvalidAmount
+	}
+
+	var account *models.Account
+	err := m.transaction(ctx, func(tx *Memory) error {
+		if _, err := tx.GetAccountForUser(ctx, userID, accountID); err != nil {
+			return err
+		}
+		var err error
+		account, err = tx.updateAccount(ctx, accountID, func(account *models.Account) error {
+			if kind == models.TransactionDeposit {
+				return account.Deposit(amount)
+			}
+			return account.Withdraw(amount)
+		})
+		if err != nil {
+			return err
+		}
+		tx.data.recordTransaction(account, &models.Transaction{
+			Type:      kind,
+			Amount:    amount.Amount,
+			Reference: uuid.New().String(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Transfer moves amount from an account owned by userID to any other account and
+// returns the history record of the outgoing side
+func (m *Memory) Transfer(ctx context.Context, userID, fromAccountID, toAccountID string, amount models.Money, quoteID string) (*models.Transaction, error) {
+	return m.transfer(ctx, userID, fromAccountID, toAccountID, amount, quoteID, false)
+}
+
+// transfer implements Transfer; a payout by an operator closing the source account may
+// debit it while it is frozen
+func (m *Memory) transfer(ctx context.Context, userID, fromAccountID, toAccountID string, amount models.Money, quoteID string, payout bool) (*models.Transaction, error) {
+	if !amount.IsPositive() {
+		return nil, models.ErrInvalidAmount
+	}
+	if fromAccountID == toAccountID {
+		return nil, models.ErrSelfTransfer
+	}
+
+	var outgoing models.Transaction
+	err := m.transaction(ctx, func(tx *Memory) error {
+		from, ok := tx.data.accounts[fromAccountID]
+		if !ok || from.UserID != userID {
+			return gorm.ErrRecordNotFound
+		}
+		to, ok := tx.data.accounts[toAccountID]
+		if !ok {
+			return models.ErrRecipientNotFound
+		}
+
+		debit := from.Withdraw
+		if payout {
+			debit = from.PayOut
+		}
+		if err := debit(amount); err != nil {
+			return err
+		}
+		var conversion *fxConversion
+		credit := amount
+		if to.Currency != from.Currency {
+			var err error
+			conversion, err = tx.data.consumeQuote(userID, quoteID, amount, to.Currency)
+			if err != nil {
+				return err
+			}
+			credit = conversion.credit
+		}
+		if err := to.Deposit(credit); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		from.UpdatedAt, to.UpdatedAt = now, now
+		tx.data.accounts[from.ID] = from
+		tx.data.accounts[to.ID] = to
+
+		var incoming models.Transaction
+		outgoing, incoming = transferRecords(from.ID, to.ID, amount, credit, conversion, uuid.New().String())
+		tx.data.recordTransaction(&from, &outgoing)
+		tx.data.recordTransaction(&to, &incoming)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &outgoing, nil
+}
+
+// AdjustBalance applies a manual correction to the balance of an account and returns
+// its history record
+func (m *Memory) AdjustBalance(ctx context.Context, accountID string, amount models.Money) (*models.Transaction, error) {
+	var record models.Transaction
+	err := m.transaction(ctx, func(tx *Memory) error {
+		account, err := tx.updateAccount(ctx, accountID, func(account *models.Account) error {
+			return account.Adjust(amount)
+		})
+		if err != nil {
+			return err
+		}
+		record = models.Transaction{
+			Type:      models.TransactionAdjustment,
+			Amount:    amount.Amount,
+			Reference: uuid.New().String(),
+		}
+		tx.data.recordTransaction(account, &record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// recordTransaction stores the history record for a balance change that was just
+// applied to account, filling in AccountID, BalanceAfter and Currency from account
+func (d *memoryData) recordTransaction(account *models.Account, record *models.Transaction) {
+	d.lastRecordID++
+	record.ID = d.lastRecordID
+	record.AccountID = account.ID
+	record.BalanceAfter = account.Balance
+	record.Currency = account.Currency
+	record.CreatedAt = time.Now().UTC()
+	d.transactions = append(d.transactions, *record)
+}
+
+// ListTransactions retrieves an account's history, newest first
+func (m *Memory) ListTransactions(ctx context.Context, accountID string, filter TransactionFilter) ([]models.Transaction, error) {
+	var transactions []models.Transaction
+	err := m.view(ctx, func(d *memoryData) error {
+		for _, t := range slices.Backward(d.transactions) {
+			if filter.Limit > 0 && len(transactions) == filter.Limit {
+				break
+			}
+			if t.AccountID != accountID ||
+				(filter.Type != "" && t.Type != filter.Type) ||
+				(!filter.From.IsZero() && t.CreatedAt.Before(filter.From)) ||
+				(!filter.To.IsZero() && !t.CreatedAt.Before(filter.To)) ||
+				(filter.BeforeID > 0 && t.ID >= filter.BeforeID) {
+				continue
+			}
+			transactions = append(transactions, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// CreateFXQuote stores a quote issued by fx.Quoter
+func (m *Memory) CreateFXQuote(ctx context.Context, quote *models.FXQuote) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		quote.BeforeCreate(nil)
+		quote.CreatedAt = time.Now().UTC()
+		tx.data.fxQuotes[quote.ID] = *quote
+		return nil
+	})
+}
+
+// ListFXRates returns the stored rate table sorted by currency pair
+func (m *Memory) ListFXRates(ctx context.Context) ([]fx.Rate, error) {
+	var rates []fx.Rate
+	err := m.view(ctx, func(d *memoryData) error {
+		rates = slices.Clone(d.fxRates)
+		return nil
+	})
+	slices.SortFunc(rates, func(a, b fx.Rate) int {
+		return cmp.Or(cmp.Compare(a.From, b.From), cmp.Compare(a.To, b.To))
+	})
+	return rates, err
+}
+
+// ReplaceFXRates stores rates in place of the whole rate table
+func (m *Memory) ReplaceFXRates(ctx context.Context, rates []fx.Rate) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		tx.data.fxRates = slices.Clone(rates)
+		return nil
+	})
+}
+
+// consumeQuote marks a user's quote as used and prices amount with it
+func (d *memoryData) consumeQuote(userID, quoteID string, amount models.Money, toCurrency string) (*fxConversion, error) {
+	if quoteID == "" {
+		return nil, models.ErrQuoteRequired
+	}
+	quote, ok := d.fxQuotes[quoteID]
+	if !ok || quote.UserID != userID {
+		return nil, models.ErrQuoteNotFound
+	}
+	if quote.FromCurrency != amount.Currency || quote.ToCurrency != toCurrency {
+		return nil, models.ErrQuoteMismatch
+	}
+	now := time.Now().UTC()
+	if quote.UsedAt != nil || !quote.ExpiresAt.After(now) {
+		return nil, models.ErrQuoteExpired
+	}
+	quote.UsedAt = &now
+	d.fxQuotes[quoteID] = quote
+	return priceQuote(&quote, amount, toCurrency)
+}
+
+// ==================== IDEMPOTENCY KEY OPERATIONS ====================
+
+// ReserveIdempotencyKey claims record.Key for record.UserID
+// Returns nil if the key is now reserved for this request, otherwise the stored
+// record of the earlier request that used the key
+func (m *Memory) ReserveIdempotencyKey(ctx context.Context, record *models.IdempotencyKey) (*models.IdempotencyKey, error) {
+	var existing *models.IdempotencyKey
+	err := m.transaction(ctx, func(tx *Memory) error {
+		id := idempotencyKeyID{key: record.Key, userID: record.UserID}
+		if stored, ok := tx.data.idempotency[id]; ok && stored.ExpiresAt.After(time.Now().UTC()) {
+			existing = &stored
+			return nil
+		}
+		record.CreatedAt = time.Now().UTC()
+		tx.data.idempotency[id] = *record
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request that reserved the key
+func (m *Memory) CompleteIdempotencyKey(ctx context.Context, key, userID string, statusCode int, contentType string, response []byte) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		id := idempotencyKeyID{key: key, userID: userID}
+		if stored, ok := tx.data.idempotency[id]; ok {
+			stored.StatusCode = statusCode
+			stored.ContentType = contentType
+			stored.Response = slices.Clone(response)
+			tx.data.idempotency[id] = stored
+		}
+		return nil
+	})
+}
+
+// ReleaseIdempotencyKey drops a reservation so that the request can be retried
+func (m *Memory) ReleaseIdempotencyKey(ctx context.Context, key, userID string) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		delete(tx.data.idempotency, idempotencyKeyID{key: key, userID: userID})
+		return nil
+	})
+}
+
+// PurgeExpiredIdempotencyKeys deletes all keys whose retention window has passed
+func (m *Memory) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	var n int64
+	err := m.transaction(ctx, func(tx *Memory) error {
+		now := time.Now().UTC()
+		n = purge(tx.data.idempotency, func(k models.IdempotencyKey) bool {
+			return !k.ExpiresAt.After(now)
+		})
+		return nil
+	})
+	return n, err
+}
+
+// ==================== REFRESH TOKEN OPERATIONS ====================
+
+// CreateRefreshToken stores a new refresh token
+func (m *Memory) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		for _, t := range tx.data.refreshTokens {
+			if t.TokenHash == token.TokenHash {
+				return gorm.ErrDuplicatedKey
+			}
+		}
+		token.BeforeCreate(nil)
+		token.CreatedAt = time.Now().UTC()
+		tx.data.refreshTokens[token.ID] = *token
+		return nil
+	})
+}
+
+// RotateRefreshToken exchanges the token with the given hash for next
+// Presenting a token that was already rotated revokes its whole family and
+// returns models.ErrRefreshTokenReused
+func (m *Memory) RotateRefreshToken(ctx context.Context, tokenHash string, next *models.RefreshToken) (*models.RefreshToken, error) {
+	var current models.RefreshToken
+	reused := false
+	err := m.transaction(ctx, func(tx *Memory) error {
+		found := false
+		for _, t := range tx.data.refreshTokens {
+			if t.TokenHash == tokenHash {
+				current, found = t, true
+				break
+			}
+		}
+		now := time.Now().UTC()
+		if !found || current.RevokedAt != nil || !current.ExpiresAt.After(now) {
+			return models.ErrRefreshTokenInvalid
+		}
+
+		if current.UsedAt != nil {
+			// The revocation is kept, so the error is reported after the transaction
+			reused = true
+			tx.data.revokeRefreshTokens(func(t models.RefreshToken) bool { return t.FamilyID == current.FamilyID })
+			return nil
+		}
+		current.UsedAt = &now
+		tx.data.refreshTokens[current.ID] = current
+
+		next.UserID = current.UserID
+		next.FamilyID = current.FamilyID
+		return tx.CreateRefreshToken(ctx, next)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, models.ErrRefreshTokenReused
+	}
+	return &current, nil
+}
+
+// RevokeRefreshToken revokes the family of a refresh token owned by userID
+// Unknown tokens are ignored
+func (m *Memory) RevokeRefreshToken(ctx context.Context, userID, tokenHash string) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		for _, t := range tx.data.refreshTokens {
+			if t.TokenHash == tokenHash && t.UserID == userID {
+				tx.data.revokeRefreshTokens(func(other models.RefreshToken) bool { return other.FamilyID == t.FamilyID })
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of a user
+func (m *Memory) RevokeUserRefreshTokens(ctx context.Context, userID string) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		tx.data.revokeRefreshTokens(func(t models.RefreshToken) bool { return t.UserID == userID })
+		return nil
+	})
+}
+
+// revokeRefreshTokens revokes the unrevoked refresh tokens that match
+func (d *memoryData) revokeRefreshTokens(match func(models.RefreshToken) bool) {
+	now := time.Now().UTC()
+	for id, t := range d.refreshTokens {
+		if t.RevokedAt == nil && match(t) {
+			t.RevokedAt = &now
+			d.refreshTokens[id] = t
+		}
+	}
+}
+
+// PurgeExpiredRefreshTokens deletes refresh tokens that can no longer be used
+func (m *Memory) PurgeExpiredRefreshTokens(ctx context.Context) (int64, error) {
+	var n int64
+	err := m.transaction(ctx, func(tx *Memory) error {
+		now := time.Now().UTC()
+		n = purge(tx.data.refreshTokens, func(t models.RefreshToken) bool {
+			return !t.ExpiresAt.After(now)
+		})
+		return nil
+	})
+	return n, err
+}
+
+// ==================== TOKEN REVOCATION OPERATIONS ====================
+
+// CreateTokenRevocation stores a revocation of one or more access tokens
+func (m *Memory) CreateTokenRevocation(ctx context.Context, revocation *models.TokenRevocation) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		tx.data.lastRevokeID++
+		revocation.ID = tx.data.lastRevokeID
+		revocation.CreatedAt = time.Now().UTC()
+		tx.data.revocations = append(tx.data.revocations, *revocation)
+		return nil
+	})
+}
+
+// ListTokenRevocations retrieves the revocations that still affect unexpired tokens
+func (m *Memory) ListTokenRevocations(ctx context.Context) ([]models.TokenRevocation, error) {
+	var revocations []models.TokenRevocation
+	err := m.view(ctx, func(d *memoryData) error {
+		now := time.Now().UTC()
+		for _, r := range d.revocations {
+			if r.ExpiresAt.After(now) {
+				revocations = append(revocations, r)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+// PurgeExpiredTokenRevocations deletes revocations whose tokens have all expired
+func (m *Memory) PurgeExpiredTokenRevocations(ctx context.Context) (int64, error) {
+	var n int64
+	err := m.transaction(ctx, func(tx *Memory) error {
+		now := time.Now().UTC()
+		before := len(tx.data.revocations)
+		tx.data.revocations = slices.DeleteFunc(tx.data.revocations, func(r models.TokenRevocation) bool {
+			return !r.ExpiresAt.After(now)
+		})
+		n = int64(before - len(tx.data.revocations))
+		return nil
+	})
+	return n, err
+}
+
+// purge deletes the rows of table that match and returns how many it deleted
+func purge[K comparable, V any](table map[K]V, match func(V) bool) int64 {
+	var n int64
+	for k, v := range table {
+		if match(v) {
+			delete(table, k)
+			n++
+		}
+	}
+	return n
+}
+
+// ==================== AUDIT OPERATIONS ====================
+
+// RecordAuditEvent appends an event to the audit log, chaining it to the latest event
+func (m *Memory) RecordAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	return m.transaction(ctx, func(tx *Memory) error {
+		if event.CreatedAt.IsZero() {
+			event.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+		}
+		event.PrevHash = ""
+		if n := len(tx.data.auditEvents); n > 0 {
+			event.PrevHash = tx.data.auditEvents[n-1].Hash
+		}
+		event.Hash = event.ComputeHash()
+		tx.data.lastAuditID++
+		event.ID = tx.data.lastAuditID
+		tx.data.auditEvents = append(tx.data.auditEvents, *event)
+		return nil
+	})
+}
+
+// ListAuditEvents retrieves audit events, newest first
+func (m *Memory) ListAuditEvents(ctx context.Context, filter AuditFilter) ([]models.AuditEvent, error) {
+	var events []models.AuditEvent
+	err := m.view(ctx, func(d *memoryData) error {
+		for _, e := range slices.Backward(d.auditEvents) {
+			if filter.Limit > 0 && len(events) == filter.Limit {
+				break
+			}
+			if (filter.ActorID != "" && e.ActorID != filter.ActorID) ||
+				(filter.Action != "" && e.Action != filter.Action) ||
+				(filter.TargetType != "" && e.TargetType != filter.TargetType) ||
+				(filter.TargetID != "" && e.TargetID != filter.TargetID) ||
+				(!filter.From.IsZero() && e.CreatedAt.Before(filter.From)) ||
+				(!filter.To.IsZero() && !e.CreatedAt.Before(filter.To)) ||
+				(filter.BeforeID > 0 && e.ID >= filter.BeforeID) {
+				continue
+			}
+			events = append(events, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// VerifyAuditChain walks the whole audit log and checks every hash
+func (m *Memory) VerifyAuditChain(ctx context.Context) (int64, string, error) {
+	var count int64
+	var prev string
+	err := m.view(ctx, func(d *memoryData) error {
+		for _, event := range d.auditEvents {
+			if event.PrevHash != prev || event.Hash != event.ComputeHash() {
+				return fmt.Errorf("%w at event %d", models.ErrAuditChainBroken, event.ID)
+			}
+			prev = event.Hash
+			count++
+		}
+		return nil
+	})
+	return count, prev, err
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"server/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// newMemoryAccount creates a user with a single USD account in m
+func newMemoryAccount(t *testing.T, m *Memory, userID string, balance int64) *models.Account {
+	t.Helper()
+	if err := m.CreateUser(context.Background(), &models.User{ID: userID, Password: "x"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	account := &models.Account{UserID: userID, Balance: balance, Currency: "USD"}
+	if err := m.CreateAccount(context.Background(), account); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	return account
+}
+
+// memoryBalance reads the current balance of an account
+func memoryBalance(t *testing.T, m *Memory, accountID string) int64 {
+	t.Helper()
+	account, err := m.GetAccount(context.Background(), accountID)
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	return account.Balance
+}
+
+func TestMemoryWithTxIsAllOrNothing(t *testing.T) {
+	m := NewMemory()
+	account := newMemoryAccount(t, m, "alice", 100)
+	ctx := context.Background()
+	errAbort := errors.New("abort")
+
+	err := m.WithTx(ctx, func(tx Repository) error {
+		if _, err := tx.Deposit(ctx, "alice", account.ID, usd(50)); err != nil {
+			return err
+		}
+		if err := tx.RecordAuditEvent(ctx, &models.AuditEvent{ActorID: "alice", Action: models.AuditDeposit}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("WithTx = %v, want the error of fn", err)
+	}
+	if got := memoryBalance(t, m, account.ID); got != 100 {
+		t.Fatalf("balance after rollback = %d, want 100", got)
+	}
+	history, _ := m.ListTransactions(ctx, account.ID, TransactionFilter{})
+	events, _ := m.ListAuditEvents(ctx, AuditFilter{})
+	if len(history) != 0 || len(events) != 0 {
+		t.Fatalf("rolled back transaction left %d transactions and %d audit events", len(history), len(events))
+	}
+
+	// A failed nested transaction only undoes its own changes
+	err = m.WithTx(ctx, func(tx Repository) error {
+		if _, err := tx.Deposit(ctx, "alice", account.ID, usd(10)); err != nil {
+			return err
+		}
+		if err := tx.WithTx(ctx, func(inner Repository) error {
+			if _, err := inner.Deposit(ctx, "alice", account.ID, usd(1000)); err != nil {
+				return err
+			}
+			return errAbort
+		}); err != errAbort {
+			t.Errorf("nested WithTx = %v, want the error of fn", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	if got := memoryBalance(t, m, account.ID); got != 110 {
+		t.Fatalf("balance after nested rollback = %d, want 110", got)
+	}
+
+	// Failed operations roll back what they changed before failing
+	if _, err := m.Transfer(ctx, "alice", account.ID, "missing", usd(10), ""); !errors.Is(err, models.ErrRecipientNotFound) {
+		t.Fatalf("Transfer to an unknown account: got %v, want ErrRecipientNotFound", err)
+	}
+	if got := memoryBalance(t, m, account.ID); got != 110 {
+		t.Fatalf("balance after failed transfer = %d, want 110", got)
+	}
+}
+
+func TestMemoryReturnsCopies(t *testing.T) {
+	m := NewMemory()
+	account := newMemoryAccount(t, m, "alice", 100)
+	account.Balance = 1 << 40
+
+	loaded, err := m.GetAccount(context.Background(), account.ID)
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	loaded.Status = models.AccountClosed
+	if got := memoryBalance(t, m, account.ID); got != 100 {
+		t.Fatalf("balance = %d, want 100 despite changes to returned records", got)
+	}
+	if again, _ := m.GetAccount(context.Background(), account.ID); again.Status != models.AccountActive {
+		t.Fatalf("status = %s, want active despite changes to returned records", again.Status)
+	}
+}
+
+func TestMemoryConcurrentWithdrawalsNeverOverdraw(t *testing.T) {
+	m := NewMemory()
+	account := newMemoryAccount(t, m, "bob", 1000)
+	ctx := context.Background()
+
+	const workers = 100
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.Withdraw(ctx, account.UserID, account.ID, usd(30))
+			switch {
+			case err == nil:
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			case !errors.Is(err, models.ErrInsufficientBalance):
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != 1000/30 {
+		t.Fatalf("%d withdrawals succeeded, want %d", succeeded, 1000/30)
+	}
+	if got, want := memoryBalance(t, m, account.ID), int64(1000%30); got != want {
+		t.Fatalf("balance = %d, want %d", got, want)
+	}
+}
+
+func TestMemoryStopsWithItsContext(t *testing.T) {
+	m := NewMemory()
+	newMemoryAccount(t, m, "alice", 100)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.GetUserByID(cancelled, "alice"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetUserByID with a cancelled context: got %v, want context.Canceled", err)
+	}
+
+	// A context that ends while fn runs rolls the transaction back
+	ctx, cancel := context.WithCancel(context.Background())
+	err := m.WithTx(ctx, func(tx Repository) error {
+		if err := tx.CreateUser(ctx, &models.User{ID: "bob", Password: "x"}); err != nil {
+			return err
+		}
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("WithTx cancelled while running: got %v, want context.Canceled", err)
+	}
+	if _, err := m.GetUserByID(context.Background(), "bob"); err != gorm.ErrRecordNotFound {
+		t.Fatalf("GetUserByID(bob) = %v, want gorm.ErrRecordNotFound after the cancelled transaction", err)
+	}
+}
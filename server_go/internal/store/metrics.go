@@ -0,0 +1,49 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"server/internal/metrics"
+
+	"gorm.io/gorm"
+)
+
+// queryStartKey is the statement setting holding the time a statement started
+const queryStartKey = "metrics:query_start"
+
+// instrument registers gorm callbacks that report the latency of every statement
+// run through conn to the metrics package, by operation and table
+func instrument(conn *gorm.DB) error {
+	callbacks := conn.Callback()
+	return errors.Join(
+		callbacks.Create().Before("*").Register("metrics:start_create", startQuery),
+		callbacks.Create().After("*").Register("metrics:observe_create", observeQuery("create")),
+		callbacks.Query().Before("*").Register("metrics:start_query", startQuery),
+		callbacks.Query().After("*").Register("metrics:observe_query", observeQuery("query")),
+		callbacks.Update().Before("*").Register("metrics:start_update", startQuery),
+		callbacks.Update().After("*").Register("metrics:observe_update", observeQuery("update")),
+		callbacks.Delete().Before("*").Register("metrics:start_delete", startQuery),
+		callbacks.Delete().After("*").Register("metrics:observe_delete", observeQuery("delete")),
+		callbacks.Row().Before("*").Register("metrics:start_row", startQuery),
+		callbacks.Row().After("*").Register("metrics:observe_row", observeQuery("row")),
+		callbacks.Raw().Before("*").Register("metrics:start_raw", startQuery),
+		callbacks.Raw().After("*").Register("metrics:observe_raw", observeQuery("raw")),
+	)
+}
+
+// startQuery records when a statement starts
+func startQuery(tx *gorm.DB) {
+	tx.InstanceSet(queryStartKey, time.Now())
+}
+
+// observeQuery returns a callback reporting the latency of a statement of operation
+func observeQuery(operation string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		start, ok := tx.InstanceGet(queryStartKey)
+		if !ok {
+			return
+		}
+		metrics.ObserveQuery(operation, tx.Statement.Table, time.Since(start.(time.Time)))
+	}
+}
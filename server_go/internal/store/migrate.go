@@ -0,0 +1,243 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== SCHEMA MIGRATIONS ====================
+
+// Migration errors
+var (
+	ErrSchemaBehind      = errors.New("database schema is behind")
+	ErrSchemaAhead       = errors.New("database schema is newer than this build")
+	ErrMigrationModified = errors.New("migration was modified after it was applied")
+)
+
+// migrationFiles holds the SQL migrations of every dialect, in migrations/<dialect>/
+// Each version is a pair of files named <version>_<name>.up.sql and <version>_<name>.down.sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is a versioned schema change
+// Checksum identifies the Up script, so that an applied migration cannot be edited unnoticed
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationState is a migration together with the time it was applied, nil while pending
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// appliedMigration is a row of the schema_migrations table
+type appliedMigration struct {
+	Version   int `gorm:"primaryKey"`
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// TableName names the table applied migrations are recorded in
+func (appliedMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// CheckSchema makes sure the schema matches the migrations of this build exactly
+// Returns ErrSchemaBehind when migrations are pending, ErrSchemaAhead when the database
+// was migrated by a newer build, and ErrMigrationModified when an applied migration differs
+func (db *DB) CheckSchema(ctx context.Context) error {
+	states, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, state := range states {
+		if state.AppliedAt == nil {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%w: %d of %d migrations pending", ErrSchemaBehind, pending, len(states))
+	}
+	return nil
+}
+
+// MigrationStatus lists every migration of this build, oldest first, with the time it
+// was applied
+func (db *DB) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	migrations, err := db.migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i].Migration = m
+		if row, ok := applied[m.Version]; ok {
+			if row.Checksum != m.Checksum {
+				return nil, fmt.Errorf("%w: %04d_%s", ErrMigrationModified, m.Version, m.Name)
+			}
+			states[i].AppliedAt = &row.AppliedAt
+			delete(applied, m.Version)
+		}
+	}
+	for version := range applied {
+		return nil, fmt.Errorf("%w: unknown migration %04d is applied", ErrSchemaAhead, version)
+	}
+	return states, nil
+}
+
+// MigrateUp applies every pending migration in order and returns those it applied
+// Each migration runs in a transaction of its own, so a failure leaves the schema at
+// the last migration that succeeded
+func (db *DB) MigrateUp(ctx context.Context) ([]Migration, error) {
+	states, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, state := range states {
+		if state.AppliedAt != nil {
+			continue
+		}
+		m := state.Migration
+		err := db.transaction(ctx, func(txDB *DB) error {
+			if err := txDB.conn.WithContext(ctx).Exec(m.Up).Error; err != nil {
+				return err
+			}
+			return txDB.conn.WithContext(ctx).Create(&appliedMigration{
+				Version:   m.Version,
+				Name:      m.Name,
+				Checksum:  m.Checksum,
+				AppliedAt: time.Now().UTC(),
+			}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// MigrateDown rolls back the latest steps applied migrations, newest first, and returns
+// those it rolled back
+func (db *DB) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	states, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(states) - 1; i >= 0 && len(done) < steps; i-- {
+		if states[i].AppliedAt == nil {
+			continue
+		}
+		m := states[i].Migration
+		err := db.transaction(ctx, func(txDB *DB) error {
+			if err := txDB.conn.WithContext(ctx).Exec(m.Down).Error; err != nil {
+				return err
+			}
+			return txDB.conn.WithContext(ctx).Delete(&appliedMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("rollback of migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// appliedMigrations reads the schema_migrations table, creating it on first use
+func (db *DB) appliedMigrations(ctx context.Context) (map[int]appliedMigration, error) {
+	err := db.conn.WithContext(ctx).Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		checksum text NOT NULL,
+		applied_at timestamp NOT NULL
+	)`).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []appliedMigration
+	if err := db.conn.WithContext(ctx).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int]appliedMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// migrations loads the migrations for the dialect of the database, oldest first
+func (db *DB) migrations() ([]Migration, error) {
+	dir := path.Join("migrations", db.conn.Dialector.Name())
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", db.conn.Dialector.Name(), err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		base, direction, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		number, name, found := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || !found || err != nil || version <= 0 || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+		script, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %04d has two names, %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(script)
+			sum := sha256.Sum256(script)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(script)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
@@ -0,0 +1,17 @@
+-- Schema of the first release, which created its tables with AutoMigrate; IF NOT EXISTS
+-- adopts such a database as it is, and the following migrations bring it up to date
+CREATE TABLE IF NOT EXISTS users (
+	id text PRIMARY KEY,
+	password text,
+	created_at timestamptz,
+	updated_at timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS accounts (
+	id text PRIMARY KEY,
+	user_id text NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	balance bigint,
+	created_at timestamptz,
+	updated_at timestamptz,
+	CONSTRAINT uni_accounts_user_id UNIQUE (user_id)
+);
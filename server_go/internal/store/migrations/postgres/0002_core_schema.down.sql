@@ -0,0 +1,27 @@
+-- Fails while a user owns several accounts, which the first release cannot represent
+-- Balances go back to whole dollars; cents are dropped
+DROP TABLE IF EXISTS audit_events CASCADE;
+DROP TABLE IF EXISTS password_reset_tokens CASCADE;
+DROP TABLE IF EXISTS token_revocations CASCADE;
+DROP TABLE IF EXISTS refresh_tokens CASCADE;
+DROP TABLE IF EXISTS fx_quotes CASCADE;
+DROP TABLE IF EXISTS idempotency_keys CASCADE;
+DROP TABLE IF EXISTS transactions CASCADE;
+DROP TABLE IF EXISTS ledger_entries CASCADE;
+
+ALTER TABLE users
+	DROP COLUMN IF EXISTS roles,
+	DROP COLUMN IF EXISTS recovery_codes,
+	DROP COLUMN IF EXISTS totp_last_step,
+	DROP COLUMN IF EXISTS totp_enabled,
+	DROP COLUMN IF EXISTS totp_secret,
+	DROP COLUMN IF EXISTS locked_until,
+	DROP COLUMN IF EXISTS failed_login_attempts;
+
+UPDATE accounts SET balance = balance / 100;
+DROP INDEX IF EXISTS idx_accounts_user_id;
+ALTER TABLE accounts
+	DROP COLUMN IF EXISTS currency,
+	DROP COLUMN IF EXISTS status,
+	DROP COLUMN IF EXISTS type,
+	ADD CONSTRAINT uni_accounts_user_id UNIQUE (user_id);
@@ -0,0 +1,150 @@
+-- Brings the first release's schema up to multiple accounts per user, currencies,
+-- the ledger, tokens and the audit log
+-- Existing accounts become active USD checking accounts. The first release stored
+-- balances in whole dollars; they are converted to cents, the minor units of USD
+-- Every step is guarded, so that databases created by builds between the first release
+-- and versioned migrations are adopted too. Those builds added the currency column
+-- and already stored minor units, so their balances are left alone
+DO $$
+BEGIN
+	IF NOT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'accounts' AND column_name = 'currency'
+	) THEN
+		UPDATE accounts SET balance = balance * 100;
+	END IF;
+END $$;
+
+ALTER TABLE accounts DROP CONSTRAINT IF EXISTS uni_accounts_user_id;
+ALTER TABLE accounts
+	ADD COLUMN IF NOT EXISTS type text NOT NULL DEFAULT 'checking',
+	ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'active',
+	ADD COLUMN IF NOT EXISTS currency text NOT NULL DEFAULT 'USD';
+CREATE INDEX IF NOT EXISTS idx_accounts_user_id ON accounts (user_id);
+
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS failed_login_attempts bigint NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS locked_until timestamptz,
+	ADD COLUMN IF NOT EXISTS totp_secret text,
+	ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT false,
+	ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS recovery_codes text,
+	ADD COLUMN IF NOT EXISTS roles text NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+	id bigserial PRIMARY KEY,
+	journal_id text NOT NULL,
+	account_id text NOT NULL,
+	direction text NOT NULL,
+	amount bigint NOT NULL,
+	currency text NOT NULL DEFAULT 'USD',
+	created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_account_id ON ledger_entries (account_id);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_journal_id ON ledger_entries (journal_id);
+
+CREATE TABLE IF NOT EXISTS transactions (
+	id bigserial PRIMARY KEY,
+	account_id text NOT NULL,
+	type text NOT NULL,
+	amount bigint NOT NULL,
+	balance_after bigint NOT NULL,
+	currency text NOT NULL DEFAULT 'USD',
+	reference text NOT NULL,
+	counterparty_account_id text,
+	counter_amount bigint,
+	counter_currency text,
+	fx_rate text,
+	fx_spread bigint,
+	fx_spread_currency text,
+	created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_transactions_account_id ON transactions (account_id);
+CREATE INDEX IF NOT EXISTS idx_transactions_reference ON transactions (reference);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key text,
+	user_id text,
+	request_hash text NOT NULL,
+	status_code bigint,
+	content_type text,
+	response bytea,
+	expires_at timestamptz NOT NULL,
+	created_at timestamptz,
+	PRIMARY KEY (key, user_id)
+);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys (expires_at);
+
+CREATE TABLE IF NOT EXISTS fx_quotes (
+	id text PRIMARY KEY,
+	user_id text NOT NULL,
+	from_currency text NOT NULL,
+	to_currency text NOT NULL,
+	rate text NOT NULL,
+	mid_rate text NOT NULL,
+	spread_bps bigint,
+	expires_at timestamptz NOT NULL,
+	used_at timestamptz,
+	created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_fx_quotes_user_id ON fx_quotes (user_id);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id text PRIMARY KEY,
+	user_id text NOT NULL,
+	family_id text NOT NULL,
+	token_hash text NOT NULL,
+	expires_at timestamptz NOT NULL,
+	used_at timestamptz,
+	revoked_at timestamptz,
+	created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens (user_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens (family_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_refresh_tokens_token_hash ON refresh_tokens (token_hash);
+
+CREATE TABLE IF NOT EXISTS token_revocations (
+	id bigserial PRIMARY KEY,
+	jti text,
+	user_id text NOT NULL,
+	issued_before timestamptz,
+	expires_at timestamptz NOT NULL,
+	created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_token_revocations_jti ON token_revocations (jti);
+CREATE INDEX IF NOT EXISTS idx_token_revocations_user_id ON token_revocations (user_id);
+CREATE INDEX IF NOT EXISTS idx_token_revocations_expires_at ON token_revocations (expires_at);
+
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+	id text PRIMARY KEY,
+	user_id text NOT NULL,
+	token_hash text NOT NULL,
+	expires_at timestamptz NOT NULL,
+	used_at timestamptz,
+	created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON password_reset_tokens (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_password_reset_tokens_token_hash ON password_reset_tokens (token_hash);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+	id bigserial PRIMARY KEY,
+	actor_id text NOT NULL,
+	action text NOT NULL,
+	target_type text NOT NULL,
+	target_id text,
+	ip text,
+	user_agent text,
+	request_id text,
+	reason text,
+	before text,
+	after text,
+	details text,
+	prev_hash text NOT NULL DEFAULT '',
+	hash text NOT NULL DEFAULT '',
+	created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events (actor_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events (action);
+CREATE INDEX IF NOT EXISTS idx_audit_events_target_id ON audit_events (target_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_request_id ON audit_events (request_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_hash ON audit_events (hash);
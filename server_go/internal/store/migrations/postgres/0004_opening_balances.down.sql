@@ -0,0 +1 @@
+DELETE FROM ledger_entries WHERE journal_id LIKE 'opening:%';
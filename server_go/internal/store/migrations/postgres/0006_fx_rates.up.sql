@@ -0,0 +1,8 @@
+-- Mid-market exchange rates, shared by every instance; PUT /admin/fx/rates replaces
+-- the whole table and instances reload it periodically
+CREATE TABLE fx_rates (
+	from_currency text NOT NULL,
+	to_currency text NOT NULL,
+	rate text NOT NULL,
+	PRIMARY KEY (from_currency, to_currency)
+);
@@ -0,0 +1,16 @@
+-- Schema of the first release, which created its tables with AutoMigrate; IF NOT EXISTS
+-- adopts such a database as it is, and the following migrations bring it up to date
+CREATE TABLE IF NOT EXISTS users (
+	id text PRIMARY KEY,
+	password text,
+	created_at datetime,
+	updated_at datetime
+);
+
+CREATE TABLE IF NOT EXISTS accounts (
+	id text PRIMARY KEY,
+	user_id text NOT NULL UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+	balance integer,
+	created_at datetime,
+	updated_at datetime
+);
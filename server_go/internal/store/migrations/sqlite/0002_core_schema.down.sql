@@ -0,0 +1,30 @@
+-- Fails while a user owns several accounts, which the first release cannot represent
+-- Balances go back to whole dollars; cents are dropped
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS password_reset_tokens;
+DROP TABLE IF EXISTS token_revocations;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS fx_quotes;
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS transactions;
+DROP TABLE IF EXISTS ledger_entries;
+
+ALTER TABLE users DROP COLUMN roles;
+ALTER TABLE users DROP COLUMN recovery_codes;
+ALTER TABLE users DROP COLUMN totp_last_step;
+ALTER TABLE users DROP COLUMN totp_enabled;
+ALTER TABLE users DROP COLUMN totp_secret;
+ALTER TABLE users DROP COLUMN locked_until;
+ALTER TABLE users DROP COLUMN failed_login_attempts;
+
+CREATE TABLE accounts_old (
+	id text PRIMARY KEY,
+	user_id text NOT NULL UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+	balance integer,
+	created_at datetime,
+	updated_at datetime
+);
+INSERT INTO accounts_old (id, user_id, balance, created_at, updated_at)
+SELECT id, user_id, balance / 100, created_at, updated_at FROM accounts;
+DROP TABLE accounts;
+ALTER TABLE accounts_old RENAME TO accounts;
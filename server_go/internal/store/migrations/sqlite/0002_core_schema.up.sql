@@ -0,0 +1,148 @@
+-- Brings the first release's schema up to multiple accounts per user, currencies,
+-- the ledger, tokens and the audit log
+-- SQLite cannot drop the one-account-per-user UNIQUE constraint, so accounts are rebuilt;
+-- existing accounts become active USD checking accounts. The first release stored
+-- balances in whole dollars; they are converted to cents, the minor units of USD
+-- Run on a database created by a build between the first release and versioned
+-- migrations, adding the columns fails and the migration is rolled back
+CREATE TABLE accounts_new (
+	id text PRIMARY KEY,
+	user_id text NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	type text NOT NULL DEFAULT 'checking',
+	status text NOT NULL DEFAULT 'active',
+	balance integer,
+	currency text NOT NULL DEFAULT 'USD',
+	created_at datetime,
+	updated_at datetime
+);
+INSERT INTO accounts_new (id, user_id, balance, created_at, updated_at)
+SELECT id, user_id, balance * 100, created_at, updated_at FROM accounts;
+DROP TABLE accounts;
+ALTER TABLE accounts_new RENAME TO accounts;
+CREATE INDEX idx_accounts_user_id ON accounts (user_id);
+
+ALTER TABLE users ADD COLUMN failed_login_attempts integer NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN locked_until datetime;
+ALTER TABLE users ADD COLUMN totp_secret text;
+ALTER TABLE users ADD COLUMN totp_enabled numeric NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN totp_last_step integer NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN recovery_codes text;
+ALTER TABLE users ADD COLUMN roles text NOT NULL DEFAULT '';
+
+CREATE TABLE ledger_entries (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	journal_id text NOT NULL,
+	account_id text NOT NULL,
+	direction text NOT NULL,
+	amount integer NOT NULL,
+	currency text NOT NULL DEFAULT 'USD',
+	created_at datetime
+);
+CREATE INDEX idx_ledger_entries_account_id ON ledger_entries (account_id);
+CREATE INDEX idx_ledger_entries_journal_id ON ledger_entries (journal_id);
+
+CREATE TABLE transactions (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	account_id text NOT NULL,
+	type text NOT NULL,
+	amount integer NOT NULL,
+	balance_after integer NOT NULL,
+	currency text NOT NULL DEFAULT 'USD',
+	reference text NOT NULL,
+	counterparty_account_id text,
+	counter_amount integer,
+	counter_currency text,
+	fx_rate text,
+	fx_spread integer,
+	fx_spread_currency text,
+	created_at datetime
+);
+CREATE INDEX idx_transactions_account_id ON transactions (account_id);
+CREATE INDEX idx_transactions_reference ON transactions (reference);
+
+CREATE TABLE idempotency_keys (
+	key text,
+	user_id text,
+	request_hash text NOT NULL,
+	status_code integer,
+	content_type text,
+	response blob,
+	expires_at datetime NOT NULL,
+	created_at datetime,
+	PRIMARY KEY (key, user_id)
+);
+CREATE INDEX idx_idempotency_keys_expires_at ON idempotency_keys (expires_at);
+
+CREATE TABLE fx_quotes (
+	id text PRIMARY KEY,
+	user_id text NOT NULL,
+	from_currency text NOT NULL,
+	to_currency text NOT NULL,
+	rate text NOT NULL,
+	mid_rate text NOT NULL,
+	spread_bps integer,
+	expires_at datetime NOT NULL,
+	used_at datetime,
+	created_at datetime
+);
+CREATE INDEX idx_fx_quotes_user_id ON fx_quotes (user_id);
+
+CREATE TABLE refresh_tokens (
+	id text PRIMARY KEY,
+	user_id text NOT NULL,
+	family_id text NOT NULL,
+	token_hash text NOT NULL,
+	expires_at datetime NOT NULL,
+	used_at datetime,
+	revoked_at datetime,
+	created_at datetime
+);
+CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens (user_id);
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens (family_id);
+CREATE UNIQUE INDEX idx_refresh_tokens_token_hash ON refresh_tokens (token_hash);
+
+CREATE TABLE token_revocations (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	jti text,
+	user_id text NOT NULL,
+	issued_before datetime,
+	expires_at datetime NOT NULL,
+	created_at datetime
+);
+CREATE INDEX idx_token_revocations_jti ON token_revocations (jti);
+CREATE INDEX idx_token_revocations_user_id ON token_revocations (user_id);
+CREATE INDEX idx_token_revocations_expires_at ON token_revocations (expires_at);
+
+CREATE TABLE password_reset_tokens (
+	id text PRIMARY KEY,
+	user_id text NOT NULL,
+	token_hash text NOT NULL,
+	expires_at datetime NOT NULL,
+	used_at datetime,
+	created_at datetime
+);
+CREATE INDEX idx_password_reset_tokens_user_id ON password_reset_tokens (user_id);
+CREATE UNIQUE INDEX idx_password_reset_tokens_token_hash ON password_reset_tokens (token_hash);
+
+CREATE TABLE audit_events (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	actor_id text NOT NULL,
+	action text NOT NULL,
+	target_type text NOT NULL,
+	target_id text,
+	ip text,
+	user_agent text,
+	request_id text,
+	reason text,
+	before text,
+	after text,
+	details text,
+	prev_hash text NOT NULL DEFAULT '',
+	hash text NOT NULL DEFAULT '',
+	created_at datetime
+);
+CREATE INDEX idx_audit_events_actor_id ON audit_events (actor_id);
+CREATE INDEX idx_audit_events_action ON audit_events (action);
+CREATE INDEX idx_audit_events_target_id ON audit_events (target_id);
+CREATE INDEX idx_audit_events_request_id ON audit_events (request_id);
+CREATE INDEX idx_audit_events_hash ON audit_events (hash);
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS audit_events_no_DELETE;
+DROP TRIGGER IF EXISTS audit_events_no_UPDATE;
@@ -0,0 +1,7 @@
+-- Audit events can only be appended; changing the log takes dropping these triggers,
+-- which the hash chain still reveals
+CREATE TRIGGER IF NOT EXISTS audit_events_no_UPDATE BEFORE UPDATE ON audit_events
+BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END;
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_DELETE BEFORE DELETE ON audit_events
+BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END;
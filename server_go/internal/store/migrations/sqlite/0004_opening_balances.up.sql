@@ -0,0 +1,15 @@
+-- Balances carried over from before the ledger have no postings to explain them; each
+-- gets an opening journal against the opening balance equity account
+-- Accounts with postings are left alone, so that a balance that diverged from its
+-- ledger is still reported instead of being booked away
+INSERT INTO ledger_entries (journal_id, account_id, direction, amount, currency, created_at)
+SELECT 'opening:' || a.id, 'opening-balances',
+	CASE WHEN a.balance > 0 THEN 'debit' ELSE 'credit' END, ABS(a.balance), a.currency, a.created_at
+FROM accounts a
+WHERE a.balance <> 0 AND NOT EXISTS (SELECT 1 FROM ledger_entries l WHERE l.account_id = a.id);
+
+INSERT INTO ledger_entries (journal_id, account_id, direction, amount, currency, created_at)
+SELECT 'opening:' || a.id, a.id,
+	CASE WHEN a.balance > 0 THEN 'credit' ELSE 'debit' END, ABS(a.balance), a.currency, a.created_at
+FROM accounts a
+WHERE a.balance <> 0 AND NOT EXISTS (SELECT 1 FROM ledger_entries l WHERE l.account_id = a.id);
@@ -0,0 +1,9 @@
+-- The hash of the latest audit event, kept in a single row; appending transactions lock
+-- it with SELECT ... FOR UPDATE instead of the whole audit_events table, so that two
+-- events never chain to the same predecessor
+CREATE TABLE audit_chain_head (
+	id integer PRIMARY KEY CHECK (id = 1),
+	hash text NOT NULL
+);
+INSERT INTO audit_chain_head (id, hash)
+SELECT 1, COALESCE((SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1), '');
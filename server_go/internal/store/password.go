@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"server/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// ==================== PASSWORD OPERATIONS ====================
+
+// ChangePassword stores a new password hash for a user and revokes all of the user's
+// refresh tokens, so that other sessions have to log in again
+func (db *DB) ChangePassword(ctx context.Context, userID, passwordHash string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.transaction(ctx, func(txDB *DB) error {
+		res := txDB.conn.WithContext(ctx).Model(&models.User{}).
+			Where("id = ?", userID).
+			Update("password", passwordHash)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return txDB.RevokeUserRefreshTokens(ctx, userID)
+	})
+}
+
+// CreatePasswordResetToken stores a reset token, replacing any unused earlier ones of the user
+func (db *DB) CreatePasswordResetToken(ctx context.Context, token *models.PasswordResetToken) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.transaction(ctx, func(txDB *DB) error {
+		err := txDB.conn.WithContext(ctx).
+			Where("user_id = ? AND used_at IS NULL", token.UserID).
+			Delete(&models.PasswordResetToken{}).Error
+		if err != nil {
+			return err
+		}
+		return txDB.conn.WithContext(ctx).Create(token).Error
+	})
+}
+
+// GetPasswordResetToken retrieves an unused, unexpired reset token by its hash
+func (db *DB) GetPasswordResetToken(ctx context.Context, tokenHash string) (*models.PasswordResetToken, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var token models.PasswordResetToken
+	err := db.conn.WithContext(ctx).
+		First(&token, "token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, time.Now().UTC()).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, models.ErrResetTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ResetPassword consumes the reset token with the given hash and sets the new password
+// of its user, revoking the user's refresh tokens and clearing any login lockout
+// Returns the ID of the user whose password was reset
+func (db *DB) ResetPassword(ctx context.Context, tokenHash, passwordHash string) (string, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var token models.PasswordResetToken
+	err := db.transaction(ctx, func(txDB *DB) error {
+		err := txDB.conn.WithContext(ctx).First(&token, "token_hash = ?", tokenHash).Error
+		if err == gorm.ErrRecordNotFound {
+			return models.ErrResetTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+
+		// Claim the token; a concurrent reset with the same token finds it used
+		now := time.Now().UTC()
+		res := txDB.conn.WithContext(ctx).Model(&models.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL AND expires_at > ?", token.ID, now).
+			Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return models.ErrResetTokenInvalid
+		}
+
+		if err := txDB.ChangePassword(ctx, token.UserID, passwordHash); err != nil {
+			return err
+		}
+		return txDB.ResetLoginFailures(ctx, token.UserID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token.UserID, nil
+}
+
+// PurgeExpiredPasswordResetTokens deletes reset tokens that can no longer be used
+func (db *DB) PurgeExpiredPasswordResetTokens(ctx context.Context) (int64, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	res := db.conn.WithContext(ctx).
+		Where("expires_at <= ? OR used_at IS NOT NULL", time.Now().UTC()).
+		Delete(&models.PasswordResetToken{})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+
+	"server/internal/fx"
+	"server/internal/models"
+)
+
+// Repository is the set of data operations the application relies on
+// DB implements it on top of SQLite or PostgreSQL; handlers depend on the interface
+// only, so that another implementation can stand in for the database
+// Every operation stops when its context ends
+// Operations report missing records as gorm.ErrRecordNotFound and broken business
+// rules as the models.Err* values, whatever the implementation
+type Repository interface {
+	// WithTx runs fn in a transaction: every operation fn performs on the Repository it
+	// receives takes effect together, or not at all if fn returns an error or ctx ends
+	WithTx(ctx context.Context, fn func(Repository) error) error
+
+	// Users
+	CreateUser(ctx context.Context, user *models.User) error
+	GetUserByID(ctx context.Context, id string) (*models.User, error)
+	SearchUsers(ctx context.Context, query string, limit int) ([]models.User, error)
+	SetUserRoles(ctx context.Context, userID string, roles []string) error
+	GrantRole(ctx context.Context, userID, role string) error
+	BootstrapAdmins(ctx context.Context, userIDs []string) ([]string, error)
+	RecordLoginFailure(ctx context.Context, userID string, policy models.LoginPolicy) (*models.User, error)
+	ResetLoginFailures(ctx context.Context, userID string) error
+
+	// Passwords
+	ChangePassword(ctx context.Context, userID, passwordHash string) error
+	CreatePasswordResetToken(ctx context.Context, token *models.PasswordResetToken) error
+	GetPasswordResetToken(ctx context.Context, tokenHash string) (*models.PasswordResetToken, error)
+	ResetPassword(ctx context.Context, tokenHash, passwordHash string) (string, error)
+	PurgeExpiredPasswordResetTokens(ctx context.Context) (int64, error)
+
+	// Two-factor authentication
+	StartTOTPEnrollment(ctx context.Context, userID, encryptedSecret string) error
+	ConfirmTOTPEnrollment(ctx context.Context, userID string, step int64, recoveryHashes []string) error
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+	UseRecoveryCode(ctx context.Context, userID, codeHash string) error
+
+	// Accounts
+	CreateAccount(ctx context.Context, account *models.Account) error
+	GetAccount(ctx context.Context, accountID string) (*models.Account, error)
+	GetAccountForUser(ctx context.Context, userID, accountID string) (*models.Account, error)
+	GetAccountsByUserID(ctx context.Context, userID string) ([]models.Account, error)
+	SetAccountStatus(ctx context.Context, accountID, status string) (*models.Account, error)
+	CloseAccount(ctx context.Context, accountID, payoutAccountID string, operator bool) (*models.Account, *models.Transaction, error)
+
+	// Money movement
+	Deposit(ctx context.Context, userID, accountID string, amount models.Money) (*models.Account, error)
+	Withdraw(ctx context.Context, userID, accountID string, amount models.Money) (*models.Account, error)
+	Transfer(ctx context.Context, userID, fromAccountID, toAccountID string, amount models.Money, quoteID string) (*models.Transaction, error)
+	AdjustBalance(ctx context.Context, accountID string, amount models.Money) (*models.Transaction, error)
+	ListTransactions(ctx context.Context, accountID string, filter TransactionFilter) ([]models.Transaction, error)
+	CreateFXQuote(ctx context.Context, quote *models.FXQuote) error
+
+	// Exchange rates
+	ListFXRates(ctx context.Context) ([]fx.Rate, error)
+	ReplaceFXRates(ctx context.Context, rates []fx.Rate) error
+
+	// Idempotency keys
+	ReserveIdempotencyKey(ctx context.Context, record *models.IdempotencyKey) (*models.IdempotencyKey, error)
+	CompleteIdempotencyKey(ctx context.Context, key, userID string, statusCode int, contentType string, response []byte) error
+	ReleaseIdempotencyKey(ctx context.Context, key, userID string) error
+	PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+
+	// Refresh tokens and access token revocations
+	CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error
+	RotateRefreshToken(ctx context.Context, tokenHash string, next *models.RefreshToken) (*models.RefreshToken, error)
+	RevokeRefreshToken(ctx context.Context, userID, tokenHash string) error
+	RevokeUserRefreshTokens(ctx context.Context, userID string) error
+	PurgeExpiredRefreshTokens(ctx context.Context) (int64, error)
+	CreateTokenRevocation(ctx context.Context, revocation *models.TokenRevocation) error
+	ListTokenRevocations(ctx context.Context) ([]models.TokenRevocation, error)
+	PurgeExpiredTokenRevocations(ctx context.Context) (int64, error)
+
+	// Audit log
+	RecordAuditEvent(ctx context.Context, event *models.AuditEvent) error
+	ListAuditEvents(ctx context.Context, filter AuditFilter) ([]models.AuditEvent, error)
+	VerifyAuditChain(ctx context.Context) (int64, string, error)
+}
+
+// DB must satisfy Repository
+var _ Repository = (*DB)(nil)
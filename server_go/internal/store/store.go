@@ -3,31 +3,92 @@ package store
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"server/internal/config"
 	"server/internal/models"
 
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// dialectPostgres is the gorm dialect name of PostgreSQL connections
+const dialectPostgres = "postgres"
+
 // DB wraps gorm.DB and provides all database operations for the application
 type DB struct {
-	conn *gorm.DB
+	conn         *gorm.DB
+	queryTimeout time.Duration // bound on each operation, see timeout
 }
 
-// InitDB initializes the database connection and runs migrations
-func InitDB(dbPath string) (*DB, error) {
-	conn, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+// InitDB opens the database selected by cfg and checks that its schema is up to date
+// A schema with pending migrations is reported as ErrSchemaBehind; apply them with MigrateUp
+func InitDB(ctx context.Context, cfg config.DBConfig) (*DB, error) {
+	db, err := Open(cfg)
 	if err != nil {
 		return nil, err
 	}
+	if err := db.CheckSchema(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
 
-	// AutoMigrate creates tables automatically if they do not exist
-	err = conn.AutoMigrate(&models.User{}, &models.Account{})
+// Open connects to the database selected by cfg and sizes its connection pool,
+// leaving the schema as it is
+func Open(cfg config.DBConfig) (*DB, error) {
+	dialector, err := openDialector(cfg)
 	if err != nil {
 		return nil, err
 	}
+	conn, err := gorm.Open(dialector, &gorm.Config{
+		// Timestamps are stored in UTC so that range queries compare consistently
+		NowFunc: func() time.Time { return time.Now().UTC() },
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := instrument(conn); err != nil {
+		return nil, err
+	}
+
+	pool, err := conn.DB()
+	if err != nil {
+		return nil, err
+	}
+	pool.SetMaxOpenConns(cfg.MaxOpenConns)
+	pool.SetMaxIdleConns(cfg.MaxIdleConns)
+	pool.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime) * time.Second)
+	pool.SetConnMaxIdleTime(time.Duration(cfg.ConnMaxIdleTime) * time.Second)
+	return &DB{conn: conn, queryTimeout: time.Duration(cfg.QueryTimeout) * time.Second}, nil
+}
 
-	return &DB{conn: conn}, nil
+// openDialector returns the gorm driver for the database selected by cfg
+func openDialector(cfg config.DBConfig) (gorm.Dialector, error) {
+	switch cfg.Driver {
+	case config.DriverSQLite:
+		return sqlite.Open(sqliteDSN(cfg.Path)), nil
+	case config.DriverPostgres:
+		return postgres.Open(cfg.DSN), nil
+	}
+	return nil, fmt.Errorf("unsupported database driver %q", cfg.Driver)
+}
+
+// sqliteDSN appends connection options so that concurrent writers wait for the lock
+// instead of failing, and every transaction takes the write lock when it begins
+func sqliteDSN(dbPath string) string {
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return dbPath + sep + "_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL"
 }
 
 // New creates a new DB instance from gorm.DB connection
@@ -35,71 +96,547 @@ func New(conn *gorm.DB) *DB {
 	return &DB{conn: conn}
 }
 
+// Close closes every connection of the pool
+func (db *DB) Close() error {
+	pool, err := db.conn.DB()
+	if err != nil {
+		return err
+	}
+	return pool.Close()
+}
+
+// timeout bounds an operation started with ctx by the configured query timeout
+// Scans of a whole table and migrations are not bounded, as they take as long as the data needs
+func (db *DB) timeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
+// isPostgres reports whether the database is PostgreSQL rather than SQLite
+func (db *DB) isPostgres() bool {
+	return db.conn.Dialector.Name() == dialectPostgres
+}
+
 // ==================== USER OPERATIONS ====================
 
 // CreateUser creates a new user in the database
-func (db *DB) CreateUser(user *models.User) error {
-	return db.conn.Create(user).Error
-}
+func (db *DB) CreateUser(ctx context.Context, user *models.User) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
 
-// CreateUserWithTx creates a user within an existing transaction
-func (db *DB) CreateUserWithTx(tx *gorm.DB, user *models.User) error {
-	return tx.Create(user).Error
+	return db.conn.WithContext(ctx).Create(user).Error
 }
 
 // GetUserByID retrieves a user by ID
-func (db *DB) GetUserByID(id string) (*models.User, error) {
+func (db *DB) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var user models.User
+	err := db.conn.WithContext(ctx).First(&user, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// lockUser retrieves a user and locks its row until the transaction ends, so that
+// changes computed from the loaded user cannot overwrite a concurrent change
+func (db *DB) lockUser(ctx context.Context, userID string) (*models.User, error) {
 	var user models.User
-	err := db.conn.First(&user, "id = ?", id).Error
+	err := db.conn.WithContext(ctx).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&user, "id = ?", userID).Error
 	if err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
+// SetUserRoles replaces the roles of a user
+func (db *DB) SetUserRoles(ctx context.Context, userID string, roles []string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	for _, role := range roles {
+		if !models.ValidRole(role) {
+			return models.ErrInvalidRole
+		}
+	}
+	res := db.conn.WithContext(ctx).Model(&models.User{}).
+		Where("id = ?", userID).
+		Update("roles", strings.Join(roles, " "))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GrantRole adds a role to a user, keeping the roles already granted
+func (db *DB) GrantRole(ctx context.Context, userID, role string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.transaction(ctx, func(txDB *DB) error {
+		user, err := txDB.lockUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+		roles := user.RoleList()
+		if slices.Contains(roles, role) {
+			return nil
+		}
+		return txDB.SetUserRoles(ctx, userID, append(roles, role))
+	})
+}
+
+// BootstrapAdmins grants the admin role to those of userIDs that exist, unless some user
+// is an admin already, and returns the users it was granted to
+// Once an admin exists this does nothing, so that a demotion through the admin API is
+// not undone on the next start
+func (db *DB) BootstrapAdmins(ctx context.Context, userIDs []string) ([]string, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var granted []string
+	err := db.transaction(ctx, func(txDB *DB) error {
+		var admins int64
+		err := txDB.conn.WithContext(ctx).Model(&models.User{}).
+			Where("' ' || roles || ' ' LIKE ?", "% "+models.RoleAdmin+" %").
+			Count(&admins).Error
+		if err != nil || admins > 0 {
+			return err
+		}
+		for _, userID := range userIDs {
+			err := txDB.GrantRole(ctx, userID, models.RoleAdmin)
+			if err == gorm.ErrRecordNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			granted = append(granted, userID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return granted, nil
+}
+
+// RecordLoginFailure counts a failed login for a user and locks further logins for the
+// delay the policy assigns to the new number of consecutive failures
+// Returns the updated user, or gorm.ErrRecordNotFound if the user does not exist
+func (db *DB) RecordLoginFailure(ctx context.Context, userID string, policy models.LoginPolicy) (*models.User, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var user models.User
+	err := db.transaction(ctx, func(txDB *DB) error {
+		err := txDB.conn.WithContext(ctx).Model(&models.User{}).
+			Where("id = ?", userID).
+			Update("failed_login_attempts", gorm.Expr("failed_login_attempts + 1")).Error
+		if err != nil {
+			return err
+		}
+		if err := txDB.conn.WithContext(ctx).First(&user, "id = ?", userID).Error; err != nil {
+			return err
+		}
+
+		lockedUntil := time.Now().UTC().Add(policy.Delay(user.FailedLoginAttempts))
+		user.LockedUntil = &lockedUntil
+		return txDB.conn.WithContext(ctx).Model(&user).Update("locked_until", lockedUntil).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ResetLoginFailures clears the failed login count and lockout of a user
+// Returns gorm.ErrRecordNotFound if the user does not exist
+func (db *DB) ResetLoginFailures(ctx context.Context, userID string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	res := db.conn.WithContext(ctx).Model(&models.User{}).
+		Where("id = ?", userID).
+		Updates(map[string]interface{}{"failed_login_attempts": 0, "locked_until": nil})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
 // ==================== ACCOUNT OPERATIONS ====================
 
 // CreateAccount creates a new account in the database
-func (db *DB) CreateAccount(account *models.Account) error {
-	return db.conn.Create(account).Error
-}
+// Accounts without a currency are opened in models.DefaultCurrency
+// A non-zero opening balance is posted to the ledger in the same transaction
+func (db *DB) CreateAccount(ctx context.Context, account *models.Account) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
 
-// CreateAccountWithTx creates an account within an existing transaction
-func (db *DB) CreateAccountWithTx(tx *gorm.DB, account *models.Account) error {
-	return tx.Create(account).Error
+	if account.Currency == "" {
+		account.Currency = models.DefaultCurrency
+	}
+	if !models.ValidCurrency(account.Currency) {
+		return models.ErrUnknownCurrency
+	}
+	if account.Balance == 0 {
+		return db.conn.WithContext(ctx).Create(account).Error
+	}
+	return db.transaction(ctx, func(txDB *DB) error {
+		if err := txDB.conn.WithContext(ctx).Create(account).Error; err != nil {
+			return err
+		}
+		_, err := txDB.postExternal(ctx, account.ID, account.GetBalance())
+		return err
+	})
 }
 
-// GetAccountsByUserID retrieves all accounts for a user
+// GetAccountsByUserID retrieves all accounts for a user, oldest first
 func (db *DB) GetAccountsByUserID(ctx context.Context, userID string) ([]models.Account, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
 	var accounts []models.Account
-	err := db.conn.WithContext(ctx).Find(&accounts, "user_id = ?", userID).Error
+	err := db.conn.WithContext(ctx).Order("created_at, id").Find(&accounts, "user_id = ?", userID).Error
 	if err != nil {
 		return nil, err
 	}
 	return accounts, nil
 }
 
-// UpdateBalance updates the balance of an account
-func (db *DB) UpdateBalance(ctx context.Context, accountID string, newBalance int) error {
-	return db.conn.WithContext(ctx).Model(&models.Account{}).Where("id = ?", accountID).Update("balance", newBalance).Error
+// GetAccountForUser retrieves an account owned by the given user
+// Accounts of other users are reported as gorm.ErrRecordNotFound so that their existence is not revealed
+func (db *DB) GetAccountForUser(ctx context.Context, userID, accountID string) (*models.Account, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var account models.Account
+	err := db.conn.WithContext(ctx).First(&account, "id = ? AND user_id = ?", accountID, userID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
 }
 
-// ==================== TRANSACTION OPERATIONS ====================
+// GetAccount retrieves any account by ID, regardless of its owner
+func (db *DB) GetAccount(ctx context.Context, accountID string) (*models.Account, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
 
-// WithTx executes a function within a database transaction
-// If fn returns an error, the transaction is automatically rolled back
-// Otherwise, the transaction is committed
-func (db *DB) WithTx(fn func(*DB) error) error {
-	tx := db.conn.Begin()
-	if tx.Error != nil {
-		return tx.Error
+	var account models.Account
+	if err := db.conn.WithContext(ctx).First(&account, "id = ?", accountID).Error; err != nil {
+		return nil, err
 	}
+	return &account, nil
+}
 
-	err := fn(&DB{conn: tx})
+// SetAccountStatus moves an account to status and returns the updated account
+// Transitions not allowed by models.Account.SetStatus are rejected
+func (db *DB) SetAccountStatus(ctx context.Context, accountID, status string) (*models.Account, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var account models.Account
+	err := db.transaction(ctx, func(txDB *DB) error {
+		err := txDB.conn.WithContext(ctx).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&account, "id = ?", accountID).Error
+		if err != nil {
+			return err
+		}
+		if err := account.SetStatus(status); err != nil {
+			return err
+		}
+		return txDB.conn.WithContext(ctx).Model(&account).Update("status", account.Status).Error
+	})
 	if err != nil {
-		tx.Rollback()
+		return nil, err
+	}
+	return &account, nil
+}
+
+// CloseAccount closes an account and returns it together with the payout, if any
+// A remaining balance is first transferred to payoutAccountID as an ordinary transfer
+// by the owner; without a payout account the balance must already be zero
+// Frozen accounts can only be closed by an operator, whose payout may debit them
+func (db *DB) CloseAccount(ctx context.Context, accountID, payoutAccountID string, operator bool) (*models.Account, *models.Transaction, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var account *models.Account
+	var payout *models.Transaction
+	err := db.transaction(ctx, func(txDB *DB) error {
+		account = &models.Account{}
+		err := txDB.conn.WithContext(ctx).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(account, "id = ?", accountID).Error
+		if err != nil {
+			return err
+		}
+		if account.Status == models.AccountFrozen && !operator {
+			return models.ErrAccountFrozen
+		}
+		if account.Balance != 0 && payoutAccountID != "" {
+			payout, err = txDB.transfer(ctx, account.UserID, accountID, payoutAccountID, account.GetBalance(), "", operator)
+			if err != nil {
+				return err
+			}
+		}
+		account, err = txDB.SetAccountStatus(ctx, accountID, models.AccountClosed)
 		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return account, payout, nil
+}
+
+// Deposit atomically adds amount to the balance of an account owned by userID
+// and returns the updated account
+func (db *DB) Deposit(ctx context.Context, userID, accountID string, amount models.Money) (*models.Account, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	if !amount.IsPositive() {
+		return nil, models.ErrInvalidAmount
+	}
+
+	var account models.Account
+	err := db.transaction(ctx, func(txDB *DB) error {
+		// The balance guard keeps the stored int64 from overflowing
+		res := txDB.conn.WithContext(ctx).Model(&models.Account{}).
+			Where("id = ? AND user_id = ? AND status = ? AND currency = ? AND balance <= ?",
+				accountID, userID, models.AccountActive, amount.Currency, math.MaxInt64-amount.Amount).
+			Update("balance", gorm.Expr("balance + ?", amount.Amount))
+		if res.Error != nil {
+			return res.Error
+		}
+		if err := txDB.conn.WithContext(ctx).First(&account, "id = ? AND user_id = ?", accountID, userID).Error; err != nil {
+			return err
+		}
+		if res.RowsAffected == 0 {
+			if err := account.CheckActive(); err != nil {
+				return err
+			}
+			if account.Currency != amount.Currency {
+				return models.ErrCurrencyMismatch
+			}
+			return models.ErrAmountOverflow
+		}
+		journalID, err := txDB.postExternal(ctx, accountID, amount)
+		if err != nil {
+			return err
+		}
+		return txDB.recordTransaction(ctx, &account, &models.Transaction{
+			Type:      models.TransactionDeposit,
+			Amount:    amount.Amount,
+			Reference: journalID,
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
+	return &account, nil
+}
+
+// Withdraw atomically subtracts amount from the balance of an account owned by userID
+// and returns the updated account
+// The balance check and the update are a single conditional statement, so concurrent
+// withdrawals can never overdraw the account
+func (db *DB) Withdraw(ctx context.Context, userID, accountID string, amount models.Money) (*models.Account, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	if !amount.IsPositive() {
+		return nil, models.ErrInvalidAmount
+	}
+
+	var account models.Account
+	err := db.transaction(ctx, func(txDB *DB) error {
+		res := txDB.conn.WithContext(ctx).Model(&models.Account{}).
+			Where("id = ? AND user_id = ? AND status = ? AND currency = ? AND balance >= ?",
+				accountID, userID, models.AccountActive, amount.Currency, amount.Amount).
+			Update("balance", gorm.Expr("balance - ?", amount.Amount))
+		if res.Error != nil {
+			return res.Error
+		}
+		if err := txDB.conn.WithContext(ctx).First(&account, "id = ? AND user_id = ?", accountID, userID).Error; err != nil {
+			return err
+		}
+		if res.RowsAffected == 0 {
+			if err := account.CheckActive(); err != nil {
+				return err
+			}
+			if account.Currency != amount.Currency {
+				return models.ErrCurrencyMismatch
+			}
+			return models.ErrInsufficientBalance
+		}
+		journalID, err := txDB.postExternal(ctx, accountID, models.Money{Amount: -amount.Amount, Currency: amount.Currency})
+		if err != nil {
+			return err
+		}
+		return txDB.recordTransaction(ctx, &account, &models.Transaction{
+			Type:      models.TransactionWithdrawal,
+			Amount:    amount.Amount,
+			Reference: journalID,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// Transfer moves amount from an account owned by userID to any other account in a
+// single transaction and returns the history record of the outgoing side
+// Both rows are locked in ID order so that opposite concurrent transfers cannot deadlock
+// amount must be in the source account currency; if the destination holds another
+// currency, quoteID must name an unused, unexpired FX quote of the user for that pair
+func (db *DB) Transfer(ctx context.Context, userID, fromAccountID, toAccountID string, amount models.Money, quoteID string) (*models.Transaction, error) {
+	return db.transfer(ctx, userID, fromAccountID, toAccountID, amount, quoteID, false)
+}
+
+// transfer implements Transfer; a payout by an operator closing the source account may
+// debit it while it is frozen
+func (db *DB) transfer(ctx context.Context, userID, fromAccountID, toAccountID string, amount models.Money, quoteID string, payout bool) (*models.Transaction, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	if !amount.IsPositive() {
+		return nil, models.ErrInvalidAmount
+	}
+	if fromAccountID == toAccountID {
+		return nil, models.ErrSelfTransfer
+	}
+
+	var outgoing models.Transaction
+	err := db.transaction(ctx, func(txDB *DB) error {
+		var locked []models.Account
+		err := txDB.conn.WithContext(ctx).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id IN ?", []string{fromAccountID, toAccountID}).
+			Order("id").
+			Find(&locked).Error
+		if err != nil {
+			return err
+		}
+
+		var from, to *models.Account
+		for i := range locked {
+			switch locked[i].ID {
+			case fromAccountID:
+				from = &locked[i]
+			case toAccountID:
+				to = &locked[i]
+			}
+		}
+		if from == nil || from.UserID != userID {
+			return gorm.ErrRecordNotFound
+		}
+		if to == nil {
+			return models.ErrRecipientNotFound
+		}
+
+		debit := from.Withdraw
+		if payout {
+			debit = from.PayOut
+		}
+		if err := debit(amount); err != nil {
+			return err
+		}
+		var conversion *fxConversion
+		credit := amount
+		if to.Currency != from.Currency {
+			conversion, err = txDB.consumeQuote(ctx, userID, quoteID, amount, to.Currency)
+			if err != nil {
+				return err
+			}
+			credit = conversion.credit
+		}
+		if err := to.Deposit(credit); err != nil {
+			return err
+		}
+
+		// Update in the same order the rows were locked
+		for _, account := range locked {
+			err := txDB.conn.WithContext(ctx).Model(&models.Account{}).
+				Where("id = ?", account.ID).
+				Update("balance", account.Balance).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		journalID, err := txDB.postJournal(ctx, transferPostings(from.ID, to.ID, amount, credit, conversion)...)
+		if err != nil {
+			return err
+		}
+
+		var incoming models.Transaction
+		outgoing, incoming = transferRecords(from.ID, to.ID, amount, credit, conversion, journalID)
+		if err := txDB.recordTransaction(ctx, from, &outgoing); err != nil {
+			return err
+		}
+		return txDB.recordTransaction(ctx, to, &incoming)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &outgoing, nil
+}
+
+// transferRecords builds the history records of both sides of a transfer of amount
+// that credited the destination with credit
+func transferRecords(fromID, toID string, amount, credit models.Money, conversion *fxConversion, journalID string) (outgoing, incoming models.Transaction) {
+	outgoing = models.Transaction{
+		Type:                  models.TransactionTransferOut,
+		Amount:                amount.Amount,
+		Reference:             journalID,
+		CounterpartyAccountID: toID,
+	}
+	incoming = models.Transaction{
+		Type:                  models.TransactionTransferIn,
+		Amount:                credit.Amount,
+		Reference:             journalID,
+		CounterpartyAccountID: fromID,
+	}
+	if conversion != nil {
+		conversion.describe(&outgoing, credit)
+		conversion.describe(&incoming, amount)
+	}
+	return outgoing, incoming
+}
+
+// ==================== TRANSACTION OPERATIONS ====================
+
+// WithTx executes a function within a database transaction bound to ctx
+// If fn returns an error, the transaction is automatically rolled back
+// Otherwise, the transaction is committed; if ctx ends first, it is rolled back
+// Calling WithTx on a Repository that is already inside a transaction nests it using a
+// savepoint, so store operations that use transactions internally can be composed
+func (db *DB) WithTx(ctx context.Context, fn func(Repository) error) error {
+	return db.transaction(ctx, func(txDB *DB) error {
+		return fn(txDB)
+	})
+}
 
-	return tx.Commit().Error
+// transaction is WithTx for the operations of this package, which need the DB itself
+func (db *DB) transaction(ctx context.Context, fn func(*DB) error) error {
+	return db.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&DB{conn: tx, queryTimeout: db.queryTimeout})
+	})
 }
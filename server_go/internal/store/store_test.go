@@ -0,0 +1,1289 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"server/internal/auth"
+	"server/internal/config"
+	"server/internal/fx"
+	"server/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// postgresTestDSN names a PostgreSQL database to run the tests against instead of SQLite
+// Every test gets a schema of its own there, which is dropped when the test ends
+const postgresTestDSN = "STORE_TEST_POSTGRES_DSN"
+
+// postgresTestRequired, set to "required", makes the tests fail unless postgresTestDSN is
+// set, so that a CI job meant for PostgreSQL cannot quietly fall back to SQLite
+const postgresTestRequired = "STORE_TEST_POSTGRES"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(postgresTestRequired) == "required" && os.Getenv(postgresTestDSN) == "" {
+		fmt.Fprintf(os.Stderr, "%s=required but %s is not set\n", postgresTestRequired, postgresTestDSN)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestDB opens a fresh, fully migrated database
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(newTestDBConfig(t))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.MigrateUp(context.Background()); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	return db
+}
+
+// newTestDBConfig selects an empty database: a SQLite file in a temporary directory,
+// or a new schema of the PostgreSQL database named by STORE_TEST_POSTGRES_DSN
+func newTestDBConfig(t *testing.T) config.DBConfig {
+	t.Helper()
+	cfg := config.DBConfig{
+		Driver:       config.DriverSQLite,
+		Path:         filepath.Join(t.TempDir(), "test.db"),
+		MaxOpenConns: 10,
+		MaxIdleConns: 10,
+	}
+	if dsn := os.Getenv(postgresTestDSN); dsn != "" {
+		cfg.Driver = config.DriverPostgres
+		cfg.DSN = newPostgresSchema(t, dsn)
+	}
+	return cfg
+}
+
+// newPostgresSchema creates an empty schema for the running test and returns dsn with
+// the schema as its search path
+func newPostgresSchema(t *testing.T, dsn string) string {
+	t.Helper()
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("connect to %s: %v", postgresTestDSN, err)
+	}
+	pool, err := conn.DB()
+	if err != nil {
+		t.Fatalf("connect to %s: %v", postgresTestDSN, err)
+	}
+
+	schema := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	if err := conn.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("CREATE SCHEMA: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := conn.Exec("DROP SCHEMA " + schema + " CASCADE").Error; err != nil {
+			t.Errorf("DROP SCHEMA: %v", err)
+		}
+		pool.Close()
+	})
+
+	// Both URL and keyword/value connection strings accept search_path as a parameter
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+// newTestAccount creates a user with a single account holding the given balance
+func newTestAccount(t *testing.T, db *DB, userID string, balance int64) *models.Account {
+	t.Helper()
+	if err := db.CreateUser(context.Background(), &models.User{ID: userID, Password: "x"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	account := &models.Account{UserID: userID, Balance: balance, Currency: "USD"}
+	if err := db.CreateAccount(context.Background(), account); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	return account
+}
+
+// usd builds a USD amount from minor units
+func usd(amount int64) models.Money {
+	return models.Money{Amount: amount, Currency: "USD"}
+}
+
+// balanceOf reads the current balance of an account straight from the database
+func balanceOf(t *testing.T, db *DB, accountID string) int64 {
+	t.Helper()
+	var account models.Account
+	if err := db.conn.First(&account, "id = ?", accountID).Error; err != nil {
+		t.Fatalf("load account: %v", err)
+	}
+	return account.Balance
+}
+
+func TestConcurrentDepositsAndWithdrawals(t *testing.T) {
+	db := newTestDB(t)
+	account := newTestAccount(t, db, "alice", 1000)
+	ctx := context.Background()
+
+	const workers = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := db.Deposit(ctx, account.UserID, account.ID, usd(7)); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := db.Withdraw(ctx, account.UserID, account.ID, usd(3)); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got, want := balanceOf(t, db, account.ID), int64(1000+workers*(7-3)); got != want {
+		t.Fatalf("balance = %d, want %d", got, want)
+	}
+	if err := db.VerifyLedger(ctx); err != nil {
+		t.Fatalf("VerifyLedger: %v", err)
+	}
+}
+
+func TestConcurrentWithdrawalsNeverOverdraw(t *testing.T) {
+	db := newTestDB(t)
+	account := newTestAccount(t, db, "bob", 1000)
+	ctx := context.Background()
+
+	const workers = 100
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.Withdraw(ctx, account.UserID, account.ID, usd(30))
+			switch {
+			case err == nil:
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			case !errors.Is(err, models.ErrInsufficientBalance):
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != 1000/30 {
+		t.Fatalf("%d withdrawals succeeded, want %d", succeeded, 1000/30)
+	}
+	if got, want := balanceOf(t, db, account.ID), int64(1000%30); got != want {
+		t.Fatalf("balance = %d, want %d", got, want)
+	}
+}
+
+func TestWithdrawRejectsInvalidInput(t *testing.T) {
+	db := newTestDB(t)
+	account := newTestAccount(t, db, "carol", 100)
+	ctx := context.Background()
+
+	if _, err := db.Withdraw(ctx, account.UserID, account.ID, usd(0)); !errors.Is(err, models.ErrInvalidAmount) {
+		t.Fatalf("zero amount: got %v, want ErrInvalidAmount", err)
+	}
+	if _, err := db.Withdraw(ctx, account.UserID, account.ID, usd(101)); !errors.Is(err, models.ErrInsufficientBalance) {
+		t.Fatalf("overdraw: got %v, want ErrInsufficientBalance", err)
+	}
+	if _, err := db.Deposit(ctx, account.UserID, "missing", usd(10)); err == nil {
+		t.Fatal("deposit into unknown account succeeded")
+	}
+	if got := balanceOf(t, db, account.ID); got != 100 {
+		t.Fatalf("balance = %d, want 100", got)
+	}
+}
+
+func TestLedgerRecordsEveryBalanceChange(t *testing.T) {
+	db := newTestDB(t)
+	account := newTestAccount(t, db, "dave", 100)
+	ctx := context.Background()
+
+	if _, err := db.Deposit(ctx, account.UserID, account.ID, usd(50)); err != nil {
+		t.Fatalf("Deposit: %v", err)
+	}
+	if _, err := db.Withdraw(ctx, account.UserID, account.ID, usd(30)); err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+	if _, err := db.Withdraw(ctx, account.UserID, account.ID, usd(1000)); !errors.Is(err, models.ErrInsufficientBalance) {
+		t.Fatalf("overdraw: got %v, want ErrInsufficientBalance", err)
+	}
+
+	entries, err := db.GetLedgerEntries(ctx, account.ID)
+	if err != nil {
+		t.Fatalf("GetLedgerEntries: %v", err)
+	}
+	// Opening balance, deposit and withdrawal; the rejected withdrawal leaves no trace
+	if len(entries) != 3 {
+		t.Fatalf("got %d ledger entries, want 3", len(entries))
+	}
+	balance, err := db.LedgerBalance(ctx, account.ID)
+	if err != nil {
+		t.Fatalf("LedgerBalance: %v", err)
+	}
+	if balance != 120 {
+		t.Fatalf("ledger balance = %d, want 120", balance)
+	}
+	if err := db.VerifyLedger(ctx); err != nil {
+		t.Fatalf("VerifyLedger: %v", err)
+	}
+}
+
+func TestRecomputeBalanceRepairsCachedBalance(t *testing.T) {
+	db := newTestDB(t)
+	account := newTestAccount(t, db, "erin", 100)
+	ctx := context.Background()
+
+	if err := db.conn.Model(&models.Account{}).Where("id = ?", account.ID).Update("balance", 999).Error; err != nil {
+		t.Fatalf("tamper: %v", err)
+	}
+	if err := db.VerifyBalance(ctx, account.ID); !errors.Is(err, models.ErrBalanceMismatch) {
+		t.Fatalf("VerifyBalance: got %v, want ErrBalanceMismatch", err)
+	}
+	if err := db.VerifyLedger(ctx); !errors.Is(err, models.ErrBalanceMismatch) {
+		t.Fatalf("VerifyLedger: got %v, want ErrBalanceMismatch", err)
+	}
+
+	repaired, err := db.RecomputeBalance(ctx, account.ID)
+	if err != nil {
+		t.Fatalf("RecomputeBalance: %v", err)
+	}
+	if repaired.Balance != 100 {
+		t.Fatalf("recomputed balance = %d, want 100", repaired.Balance)
+	}
+	if err := db.VerifyBalance(ctx, account.ID); err != nil {
+		t.Fatalf("VerifyBalance after repair: %v", err)
+	}
+}
+
+func TestListTransactionsFiltersAndPaginates(t *testing.T) {
+	db := newTestDB(t)
+	account := newTestAccount(t, db, "frank", 0)
+	ctx := context.Background()
+
+	for i := 1; i <= 5; i++ {
+		if _, err := db.Deposit(ctx, account.UserID, account.ID, usd(int64(i*10))); err != nil {
+			t.Fatalf("Deposit: %v", err)
+		}
+	}
+	if _, err := db.Withdraw(ctx, account.UserID, account.ID, usd(5)); err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+
+	page, err := db.ListTransactions(ctx, account.ID, TransactionFilter{Limit: 4})
+	if err != nil {
+		t.Fatalf("ListTransactions: %v", err)
+	}
+	if len(page) != 4 || page[0].Type != models.TransactionWithdrawal || page[0].BalanceAfter != 145 {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+
+	rest, err := db.ListTransactions(ctx, account.ID, TransactionFilter{BeforeID: page[3].ID, Limit: 4})
+	if err != nil {
+		t.Fatalf("ListTransactions: %v", err)
+	}
+	if len(rest) != 2 || rest[1].Amount != 10 || rest[1].BalanceAfter != 10 {
+		t.Fatalf("unexpected second page: %+v", rest)
+	}
+
+	deposits, err := db.ListTransactions(ctx, account.ID, TransactionFilter{Type: models.TransactionDeposit})
+	if err != nil {
+		t.Fatalf("ListTransactions: %v", err)
+	}
+	if len(deposits) != 5 {
+		t.Fatalf("got %d deposits, want 5", len(deposits))
+	}
+
+	future, err := db.ListTransactions(ctx, account.ID, TransactionFilter{From: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("ListTransactions: %v", err)
+	}
+	if len(future) != 0 {
+		t.Fatalf("got %d transactions after from, want 0", len(future))
+	}
+
+	past, err := db.ListTransactions(ctx, account.ID, TransactionFilter{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("ListTransactions: %v", err)
+	}
+	if len(past) != 6 {
+		t.Fatalf("got %d transactions in range, want 6", len(past))
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	db := newTestDB(t)
+	alice := newTestAccount(t, db, "alice", 100)
+	bob := newTestAccount(t, db, "bob", 0)
+	ctx := context.Background()
+
+	record, err := db.Transfer(ctx, alice.UserID, alice.ID, bob.ID, usd(40), "")
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	if record.BalanceAfter != 60 || record.CounterpartyAccountID != bob.ID {
+		t.Fatalf("unexpected outgoing record: %+v", record)
+	}
+	if got := balanceOf(t, db, bob.ID); got != 40 {
+		t.Fatalf("recipient balance = %d, want 40", got)
+	}
+
+	if _, err := db.Transfer(ctx, alice.UserID, alice.ID, alice.ID, usd(10), ""); !errors.Is(err, models.ErrSelfTransfer) {
+		t.Fatalf("self transfer: got %v, want ErrSelfTransfer", err)
+	}
+	if _, err := db.Transfer(ctx, alice.UserID, alice.ID, "missing", usd(10), ""); !errors.Is(err, models.ErrRecipientNotFound) {
+		t.Fatalf("unknown recipient: got %v, want ErrRecipientNotFound", err)
+	}
+	if _, err := db.Transfer(ctx, alice.UserID, alice.ID, bob.ID, usd(61), ""); !errors.Is(err, models.ErrInsufficientBalance) {
+		t.Fatalf("overdraw: got %v, want ErrInsufficientBalance", err)
+	}
+	if err := db.VerifyLedger(ctx); err != nil {
+		t.Fatalf("VerifyLedger: %v", err)
+	}
+}
+
+func TestConcurrentOpposingTransfers(t *testing.T) {
+	db := newTestDB(t)
+	alice := newTestAccount(t, db, "alice", 1000)
+	bob := newTestAccount(t, db, "bob", 1000)
+	ctx := context.Background()
+
+	const workers = 40
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := db.Transfer(ctx, alice.UserID, alice.ID, bob.ID, usd(5), ""); err != nil {
+				t.Errorf("alice -> bob: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := db.Transfer(ctx, bob.UserID, bob.ID, alice.ID, usd(3), ""); err != nil {
+				t.Errorf("bob -> alice: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := balanceOf(t, db, alice.ID), int64(1000-workers*2); got != want {
+		t.Fatalf("alice balance = %d, want %d", got, want)
+	}
+	if got, want := balanceOf(t, db, bob.ID), int64(1000+workers*2); got != want {
+		t.Fatalf("bob balance = %d, want %d", got, want)
+	}
+	if err := db.VerifyLedger(ctx); err != nil {
+		t.Fatalf("VerifyLedger: %v", err)
+	}
+}
+
+func TestIdempotencyKeyLifecycle(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	newKey := func(ttl time.Duration) *models.IdempotencyKey {
+		return &models.IdempotencyKey{Key: "k1", UserID: "alice", RequestHash: "h1", ExpiresAt: time.Now().UTC().Add(ttl)}
+	}
+
+	existing, err := db.ReserveIdempotencyKey(ctx, newKey(time.Hour))
+	if err != nil || existing != nil {
+		t.Fatalf("first reservation: got %+v, %v", existing, err)
+	}
+	existing, err = db.ReserveIdempotencyKey(ctx, newKey(time.Hour))
+	if err != nil || existing == nil || existing.Completed() {
+		t.Fatalf("in-flight reservation: got %+v, %v", existing, err)
+	}
+
+	if err := db.CompleteIdempotencyKey(ctx, "k1", "alice", 200, "application/json", []byte(`{}`)); err != nil {
+		t.Fatalf("CompleteIdempotencyKey: %v", err)
+	}
+	existing, err = db.ReserveIdempotencyKey(ctx, newKey(time.Hour))
+	if err != nil || existing == nil || existing.StatusCode != 200 || string(existing.Response) != `{}` {
+		t.Fatalf("completed reservation: got %+v, %v", existing, err)
+	}
+
+	// Keys are scoped per user
+	other := newKey(time.Hour)
+	other.UserID = "bob"
+	if existing, err := db.ReserveIdempotencyKey(ctx, other); err != nil || existing != nil {
+		t.Fatalf("other user's reservation: got %+v, %v", existing, err)
+	}
+
+	// An expired key can be reused
+	if err := db.ReleaseIdempotencyKey(ctx, "k1", "alice"); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey: %v", err)
+	}
+	if existing, err := db.ReserveIdempotencyKey(ctx, newKey(-time.Second)); err != nil || existing != nil {
+		t.Fatalf("expiring reservation: got %+v, %v", existing, err)
+	}
+	if existing, err := db.ReserveIdempotencyKey(ctx, newKey(time.Hour)); err != nil || existing != nil {
+		t.Fatalf("reservation after expiry: got %+v, %v", existing, err)
+	}
+	if n, err := db.PurgeExpiredIdempotencyKeys(ctx); err != nil || n != 0 {
+		t.Fatalf("PurgeExpiredIdempotencyKeys: got %d, %v", n, err)
+	}
+}
+
+func TestAccountOwnershipIsEnforced(t *testing.T) {
+	db := newTestDB(t)
+	alice := newTestAccount(t, db, "alice", 100)
+	mallory := newTestAccount(t, db, "mallory", 0)
+	ctx := context.Background()
+
+	savings := &models.Account{UserID: "alice", Type: models.AccountSavings}
+	if err := db.CreateAccount(ctx, savings); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	accounts, err := db.GetAccountsByUserID(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetAccountsByUserID: %v", err)
+	}
+	if len(accounts) != 2 || accounts[0].ID != alice.ID {
+		t.Fatalf("unexpected accounts: %+v", accounts)
+	}
+
+	if _, err := db.GetAccountForUser(ctx, mallory.UserID, alice.ID); err != gorm.ErrRecordNotFound {
+		t.Fatalf("GetAccountForUser: got %v, want ErrRecordNotFound", err)
+	}
+	if _, err := db.Withdraw(ctx, mallory.UserID, alice.ID, usd(10)); err != gorm.ErrRecordNotFound {
+		t.Fatalf("Withdraw: got %v, want ErrRecordNotFound", err)
+	}
+	if _, err := db.Deposit(ctx, mallory.UserID, alice.ID, usd(10)); err != gorm.ErrRecordNotFound {
+		t.Fatalf("Deposit: got %v, want ErrRecordNotFound", err)
+	}
+	if _, err := db.Transfer(ctx, mallory.UserID, alice.ID, mallory.ID, usd(10), ""); err != gorm.ErrRecordNotFound {
+		t.Fatalf("Transfer: got %v, want ErrRecordNotFound", err)
+	}
+
+	// Moving money between one's own accounts is an ordinary transfer
+	if _, err := db.Transfer(ctx, alice.UserID, alice.ID, savings.ID, usd(60), ""); err != nil {
+		t.Fatalf("Transfer to savings: %v", err)
+	}
+	if got := balanceOf(t, db, savings.ID); got != 60 {
+		t.Fatalf("savings balance = %d, want 60", got)
+	}
+}
+
+func TestCurrencyRulesAreEnforced(t *testing.T) {
+	db := newTestDB(t)
+	account := newTestAccount(t, db, "gina", 100)
+	ctx := context.Background()
+
+	euros := &models.Account{UserID: "gina", Currency: "EUR"}
+	if err := db.CreateAccount(ctx, euros); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	eur := models.Money{Amount: 10, Currency: "EUR"}
+
+	if _, err := db.Deposit(ctx, account.UserID, account.ID, eur); !errors.Is(err, models.ErrCurrencyMismatch) {
+		t.Fatalf("Deposit: got %v, want ErrCurrencyMismatch", err)
+	}
+	if _, err := db.Withdraw(ctx, account.UserID, account.ID, eur); !errors.Is(err, models.ErrCurrencyMismatch) {
+		t.Fatalf("Withdraw: got %v, want ErrCurrencyMismatch", err)
+	}
+	if _, err := db.Transfer(ctx, account.UserID, account.ID, euros.ID, eur, ""); !errors.Is(err, models.ErrCurrencyMismatch) {
+		t.Fatalf("Transfer: got %v, want ErrCurrencyMismatch", err)
+	}
+	if _, err := db.Transfer(ctx, account.UserID, account.ID, euros.ID, usd(10), ""); !errors.Is(err, models.ErrQuoteRequired) {
+		t.Fatalf("Transfer: got %v, want ErrQuoteRequired", err)
+	}
+	if _, err := db.Deposit(ctx, account.UserID, account.ID, usd(math.MaxInt64)); !errors.Is(err, models.ErrAmountOverflow) {
+		t.Fatalf("Deposit: got %v, want ErrAmountOverflow", err)
+	}
+	if err := db.CreateAccount(ctx, &models.Account{UserID: "gina", Currency: "XXX"}); !errors.Is(err, models.ErrUnknownCurrency) {
+		t.Fatalf("CreateAccount: got %v, want ErrUnknownCurrency", err)
+	}
+	if got := balanceOf(t, db, account.ID); got != 100 {
+		t.Fatalf("balance = %d, want 100", got)
+	}
+}
+
+func TestCrossCurrencyTransferWithQuote(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	alice := newTestAccount(t, db, "alice", 100000)
+	euros := &models.Account{UserID: "bob", Currency: "EUR"}
+	newTestAccount(t, db, "bob", 0)
+	if err := db.CreateAccount(ctx, euros); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	rates := fx.NewTable()
+	if err := rates.Replace([]fx.Rate{{From: "EUR", To: "USD", Rate: "1.25"}}); err != nil {
+		t.Fatalf("Replace: %v", err)
+	}
+	quote, err := fx.NewQuoter(rates, 100, time.Minute).Quote("alice", "USD", "EUR")
+	if err != nil {
+		t.Fatalf("Quote: %v", err)
+	}
+	if err := db.CreateFXQuote(ctx, quote); err != nil {
+		t.Fatalf("CreateFXQuote: %v", err)
+	}
+
+	// 100.00 USD at the mid rate of 0.8 is 80.00 EUR; the 1% spread keeps 0.80 EUR
+	record, err := db.Transfer(ctx, alice.UserID, alice.ID, euros.ID, usd(10000), quote.ID)
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	if record.CounterAmount != 7920 || record.CounterCurrency != "EUR" || record.FXSpread != 80 {
+		t.Fatalf("unexpected outgoing record: %+v", record)
+	}
+	if got := balanceOf(t, db, euros.ID); got != 7920 {
+		t.Fatalf("recipient balance = %d, want 7920", got)
+	}
+	if got := balanceOf(t, db, alice.ID); got != 90000 {
+		t.Fatalf("sender balance = %d, want 90000", got)
+	}
+	if err := db.VerifyLedger(ctx); err != nil {
+		t.Fatalf("VerifyLedger: %v", err)
+	}
+
+	if _, err := db.Transfer(ctx, alice.UserID, alice.ID, euros.ID, usd(100), quote.ID); !errors.Is(err, models.ErrQuoteExpired) {
+		t.Fatalf("reused quote: got %v, want ErrQuoteExpired", err)
+	}
+	if _, err := db.Transfer(ctx, alice.UserID, alice.ID, euros.ID, usd(100), "missing"); !errors.Is(err, models.ErrQuoteNotFound) {
+		t.Fatalf("unknown quote: got %v, want ErrQuoteNotFound", err)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	expires := time.Now().UTC().Add(time.Hour)
+
+	first := &models.RefreshToken{UserID: "alice", TokenHash: "h1", ExpiresAt: expires}
+	if err := db.CreateRefreshToken(ctx, first); err != nil {
+		t.Fatalf("CreateRefreshToken: %v", err)
+	}
+
+	second := &models.RefreshToken{TokenHash: "h2", ExpiresAt: expires}
+	current, err := db.RotateRefreshToken(ctx, "h1", second)
+	if err != nil {
+		t.Fatalf("RotateRefreshToken: %v", err)
+	}
+	if current.UserID != "alice" || second.UserID != "alice" || second.FamilyID != first.FamilyID {
+		t.Fatalf("rotated token does not inherit user and family: %+v", second)
+	}
+
+	// Presenting the first token again revokes the whole family, including the second token
+	if _, err := db.RotateRefreshToken(ctx, "h1", &models.RefreshToken{TokenHash: "h3", ExpiresAt: expires}); !errors.Is(err, models.ErrRefreshTokenReused) {
+		t.Fatalf("reused token: got %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := db.RotateRefreshToken(ctx, "h2", &models.RefreshToken{TokenHash: "h4", ExpiresAt: expires}); !errors.Is(err, models.ErrRefreshTokenInvalid) {
+		t.Fatalf("revoked family: got %v, want ErrRefreshTokenInvalid", err)
+	}
+	if _, err := db.RotateRefreshToken(ctx, "unknown", &models.RefreshToken{TokenHash: "h5", ExpiresAt: expires}); !errors.Is(err, models.ErrRefreshTokenInvalid) {
+		t.Fatalf("unknown token: got %v, want ErrRefreshTokenInvalid", err)
+	}
+}
+
+func TestTokenRevocationsSurviveReload(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	now := time.Now().UTC()
+	claims := func(userID, jti string, issuedAt time.Time) *auth.JWTClaims {
+		return &auth.JWTClaims{UserID: userID, RegisteredClaims: jwt.RegisteredClaims{
+			ID:       jti,
+			IssuedAt: jwt.NewNumericDate(issuedAt),
+		}}
+	}
+
+	revocations := auth.NewRevocations(db)
+	if err := revocations.RevokeToken(ctx, "alice", "jti-1"); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	if err := revocations.RevokeUser(ctx, "bob"); err != nil {
+		t.Fatalf("RevokeUser: %v", err)
+	}
+
+	// A fresh cache loaded from the database must reach the same decisions
+	reloaded := auth.NewRevocations(db)
+	if err := reloaded.Load(ctx); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for _, r := range []*auth.Revocations{revocations, reloaded} {
+		if !r.IsRevoked(claims("alice", "jti-1", now)) {
+			t.Fatal("revoked token accepted")
+		}
+		if r.IsRevoked(claims("alice", "jti-2", now)) {
+			t.Fatal("other token of the user rejected")
+		}
+		if !r.IsRevoked(claims("bob", "jti-3", now.Add(-time.Minute))) {
+			t.Fatal("token issued before logout-all accepted")
+		}
+		if r.IsRevoked(claims("bob", "jti-4", now.Add(time.Minute))) {
+			t.Fatal("token issued after logout-all rejected")
+		}
+	}
+
+	if n, err := reloaded.Purge(ctx); err != nil || n != 0 {
+		t.Fatalf("Purge = %d, %v; want nothing purged before expiry", n, err)
+	}
+}
+
+func TestLoginFailuresLockUser(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.CreateUser(ctx, &models.User{ID: "alice", Password: "hash"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	policy := models.LoginPolicy{MaxAttempts: 3, BackoffBase: time.Second, BackoffMax: 10 * time.Second, Lockout: time.Hour}
+
+	var user *models.User
+	for i := 0; i < 3; i++ {
+		var err error
+		if user, err = db.RecordLoginFailure(ctx, "alice", policy); err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+	}
+	if user.FailedLoginAttempts != 3 {
+		t.Fatalf("FailedLoginAttempts = %d, want 3", user.FailedLoginAttempts)
+	}
+	if !user.IsLocked(time.Now().Add(30 * time.Minute)) {
+		t.Fatalf("user not locked out after %d failures: %v", policy.MaxAttempts, user.LockedUntil)
+	}
+
+	if err := db.ResetLoginFailures(ctx, "alice"); err != nil {
+		t.Fatalf("ResetLoginFailures: %v", err)
+	}
+	user, err := db.GetUserByID(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if user.FailedLoginAttempts != 0 || user.IsLocked(time.Now()) {
+		t.Fatalf("lockout not reset: %+v", user)
+	}
+
+	// Logins for unknown users record their failures too, which must change nothing
+	if _, err := db.RecordLoginFailure(ctx, "nobody", policy); err != gorm.ErrRecordNotFound {
+		t.Fatalf("RecordLoginFailure(nobody) = %v, want gorm.ErrRecordNotFound", err)
+	}
+}
+
+func TestTwoFactorCodesAreSingleUse(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.CreateUser(ctx, &models.User{ID: "alice", Password: "hash"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	if err := db.ConfirmTOTPEnrollment(ctx, "alice", 1, nil); !errors.Is(err, models.ErrTwoFactorNotPending) {
+		t.Fatalf("confirm without enrollment: got %v, want ErrTwoFactorNotPending", err)
+	}
+	if err := db.StartTOTPEnrollment(ctx, "alice", "sealed"); err != nil {
+		t.Fatalf("StartTOTPEnrollment: %v", err)
+	}
+	if err := db.ConfirmTOTPEnrollment(ctx, "alice", 100, []string{"h1", "h2"}); err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment: %v", err)
+	}
+	if err := db.StartTOTPEnrollment(ctx, "alice", "other"); !errors.Is(err, models.ErrTwoFactorEnabled) {
+		t.Fatalf("re-enrollment: got %v, want ErrTwoFactorEnabled", err)
+	}
+
+	// The step used to confirm, and any earlier one, cannot be replayed
+	if err := db.UseTOTPStep(ctx, "alice", 100); !errors.Is(err, models.ErrInvalidTwoFactor) {
+		t.Fatalf("replayed step: got %v, want ErrInvalidTwoFactor", err)
+	}
+	if err := db.UseTOTPStep(ctx, "alice", 101); err != nil {
+		t.Fatalf("UseTOTPStep: %v", err)
+	}
+
+	if err := db.UseRecoveryCode(ctx, "alice", "h1"); err != nil {
+		t.Fatalf("UseRecoveryCode: %v", err)
+	}
+	if err := db.UseRecoveryCode(ctx, "alice", "h1"); !errors.Is(err, models.ErrInvalidTwoFactor) {
+		t.Fatalf("reused recovery code: got %v, want ErrInvalidTwoFactor", err)
+	}
+	user, err := db.GetUserByID(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if got := user.RecoveryCodeHashes(); len(got) != 1 || got[0] != "h2" {
+		t.Fatalf("remaining recovery codes = %v, want [h2]", got)
+	}
+}
+
+func TestPasswordResetTokenIsSingleUse(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.CreateUser(ctx, &models.User{ID: "alice", Password: "old", FailedLoginAttempts: 3}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	refresh := &models.RefreshToken{UserID: "alice", TokenHash: "r1", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := db.CreateRefreshToken(ctx, refresh); err != nil {
+		t.Fatalf("CreateRefreshToken: %v", err)
+	}
+
+	expires := time.Now().UTC().Add(time.Hour)
+	for _, hash := range []string{"t1", "t2"} {
+		if err := db.CreatePasswordResetToken(ctx, &models.PasswordResetToken{UserID: "alice", TokenHash: hash, ExpiresAt: expires}); err != nil {
+			t.Fatalf("CreatePasswordResetToken: %v", err)
+		}
+	}
+
+	// Issuing a new token replaces the earlier one
+	if _, err := db.ResetPassword(ctx, "t1", "new"); !errors.Is(err, models.ErrResetTokenInvalid) {
+		t.Fatalf("replaced token: got %v, want ErrResetTokenInvalid", err)
+	}
+	userID, err := db.ResetPassword(ctx, "t2", "new")
+	if err != nil || userID != "alice" {
+		t.Fatalf("ResetPassword = %q, %v", userID, err)
+	}
+	if _, err := db.ResetPassword(ctx, "t2", "newer"); !errors.Is(err, models.ErrResetTokenInvalid) {
+		t.Fatalf("reused token: got %v, want ErrResetTokenInvalid", err)
+	}
+
+	user, err := db.GetUserByID(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if user.Password != "new" || user.FailedLoginAttempts != 0 {
+		t.Fatalf("password not reset: %+v", user)
+	}
+	if _, err := db.RotateRefreshToken(ctx, "r1", &models.RefreshToken{TokenHash: "r2", ExpiresAt: expires}); !errors.Is(err, models.ErrRefreshTokenInvalid) {
+		t.Fatalf("refresh token after reset: got %v, want ErrRefreshTokenInvalid", err)
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.CreateUser(ctx, &models.User{ID: "alice", Password: "hash"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	if err := db.SetUserRoles(ctx, "alice", []string{"root"}); !errors.Is(err, models.ErrInvalidRole) {
+		t.Fatalf("unknown role: got %v, want ErrInvalidRole", err)
+	}
+	if err := db.SetUserRoles(ctx, "nobody", []string{models.RoleSupport}); err != gorm.ErrRecordNotFound {
+		t.Fatalf("unknown user: got %v, want ErrRecordNotFound", err)
+	}
+	if err := db.SetUserRoles(ctx, "alice", []string{models.RoleSupport}); err != nil {
+		t.Fatalf("SetUserRoles: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.GrantRole(ctx, "alice", models.RoleAdmin); err != nil {
+			t.Fatalf("GrantRole: %v", err)
+		}
+	}
+
+	user, err := db.GetUserByID(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if got := user.RoleList(); len(got) != 2 || got[0] != models.RoleSupport || got[1] != models.RoleAdmin {
+		t.Fatalf("roles = %v, want [support admin]", got)
+	}
+}
+
+func TestBootstrapAdmins(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	for _, id := range []string{"alice", "bob"} {
+		if err := db.CreateUser(ctx, &models.User{ID: id, Password: "hash", Roles: models.RoleSupport}); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+
+	// Listed users that do not exist are skipped, not created
+	granted, err := db.BootstrapAdmins(ctx, []string{"alice", "root"})
+	if err != nil || len(granted) != 1 || granted[0] != "alice" {
+		t.Fatalf("BootstrapAdmins = %v, %v; want [alice]", granted, err)
+	}
+	if _, err := db.GetUserByID(ctx, "root"); err != gorm.ErrRecordNotFound {
+		t.Fatalf("GetUserByID(root) = %v, want gorm.ErrRecordNotFound", err)
+	}
+
+	// Once an admin exists, later starts change nothing, even after a demotion
+	if granted, err := db.BootstrapAdmins(ctx, []string{"bob"}); err != nil || len(granted) != 0 {
+		t.Fatalf("BootstrapAdmins with an admin = %v, %v; want nothing granted", granted, err)
+	}
+	if err := db.SetUserRoles(ctx, "alice", []string{models.RoleSupport}); err != nil {
+		t.Fatalf("SetUserRoles: %v", err)
+	}
+	if err := db.SetUserRoles(ctx, "bob", []string{models.RoleSupport, models.RoleAdmin}); err != nil {
+		t.Fatalf("SetUserRoles: %v", err)
+	}
+	if granted, err := db.BootstrapAdmins(ctx, []string{"alice"}); err != nil || len(granted) != 0 {
+		t.Fatalf("BootstrapAdmins after a demotion = %v, %v; want nothing granted", granted, err)
+	}
+	user, err := db.GetUserByID(ctx, "alice")
+	if err != nil || slices.Contains(user.RoleList(), models.RoleAdmin) {
+		t.Fatalf("alice = %+v, %v; want the demotion kept", user, err)
+	}
+}
+
+func TestFrozenAccountRejectsMoneyMovement(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	frozen := newTestAccount(t, db, "alice", 10000)
+	other := newTestAccount(t, db, "bob", 10000)
+
+	if _, err := db.SetAccountStatus(ctx, frozen.ID, models.AccountFrozen); err != nil {
+		t.Fatalf("SetAccountStatus: %v", err)
+	}
+	if _, err := db.Deposit(ctx, "alice", frozen.ID, usd(100)); !errors.Is(err, models.ErrAccountFrozen) {
+		t.Fatalf("deposit: got %v, want ErrAccountFrozen", err)
+	}
+	if _, err := db.Withdraw(ctx, "alice", frozen.ID, usd(100)); !errors.Is(err, models.ErrAccountFrozen) {
+		t.Fatalf("withdraw: got %v, want ErrAccountFrozen", err)
+	}
+	if _, err := db.Transfer(ctx, "bob", other.ID, frozen.ID, usd(100), ""); !errors.Is(err, models.ErrAccountFrozen) {
+		t.Fatalf("transfer in: got %v, want ErrAccountFrozen", err)
+	}
+
+	if _, err := db.SetAccountStatus(ctx, frozen.ID, models.AccountActive); err != nil {
+		t.Fatalf("SetAccountStatus: %v", err)
+	}
+	if _, err := db.Withdraw(ctx, "alice", frozen.ID, usd(100)); err != nil {
+		t.Fatalf("withdraw after unfreeze: %v", err)
+	}
+	if _, err := db.SetAccountStatus(ctx, "missing", models.AccountFrozen); err != gorm.ErrRecordNotFound {
+		t.Fatalf("unknown account: got %v, want ErrRecordNotFound", err)
+	}
+}
+
+func TestAdjustBalance(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	account := newTestAccount(t, db, "alice", 10000)
+	if _, err := db.SetAccountStatus(ctx, account.ID, models.AccountFrozen); err != nil {
+		t.Fatalf("SetAccountStatus: %v", err)
+	}
+
+	record, err := db.AdjustBalance(ctx, account.ID, usd(-2500))
+	if err != nil {
+		t.Fatalf("AdjustBalance: %v", err)
+	}
+	if record.Type != models.TransactionAdjustment || record.Amount != -2500 || record.BalanceAfter != 7500 {
+		t.Fatalf("record = %+v, want adjustment of -2500 leaving 7500", record)
+	}
+	if _, err := db.AdjustBalance(ctx, account.ID, usd(-7501)); !errors.Is(err, models.ErrInsufficientBalance) {
+		t.Fatalf("overdraw: got %v, want ErrInsufficientBalance", err)
+	}
+	if _, err := db.AdjustBalance(ctx, account.ID, usd(0)); !errors.Is(err, models.ErrZeroAdjustment) {
+		t.Fatalf("zero: got %v, want ErrZeroAdjustment", err)
+	}
+	if _, err := db.AdjustBalance(ctx, account.ID, usd(500)); err != nil {
+		t.Fatalf("AdjustBalance: %v", err)
+	}
+
+	if got := balanceOf(t, db, account.ID); got != 8000 {
+		t.Fatalf("balance = %d, want 8000", got)
+	}
+	if err := db.VerifyLedger(ctx); err != nil {
+		t.Fatalf("VerifyLedger: %v", err)
+	}
+}
+
+func TestAccountLifecycle(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	account := newTestAccount(t, db, "alice", 10000)
+	payout := &models.Account{UserID: "alice", Currency: "USD"}
+	if err := db.CreateAccount(ctx, payout); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	if _, err := db.SetAccountStatus(ctx, account.ID, models.AccountActive); !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("active to active: got %v, want ErrInvalidTransition", err)
+	}
+	if _, _, err := db.CloseAccount(ctx, account.ID, "", false); !errors.Is(err, models.ErrAccountNotEmpty) {
+		t.Fatalf("close with balance: got %v, want ErrAccountNotEmpty", err)
+	}
+
+	closed, record, err := db.CloseAccount(ctx, account.ID, payout.ID, false)
+	if err != nil {
+		t.Fatalf("CloseAccount: %v", err)
+	}
+	if closed.Status != models.AccountClosed || closed.Balance != 0 {
+		t.Fatalf("account = %+v, want closed with zero balance", closed)
+	}
+	if record == nil || record.Amount != 10000 || record.CounterpartyAccountID != payout.ID {
+		t.Fatalf("payout = %+v, want 10000 to %s", record, payout.ID)
+	}
+	if got := balanceOf(t, db, payout.ID); got != 10000 {
+		t.Fatalf("payout balance = %d, want 10000", got)
+	}
+
+	if _, err := db.Deposit(ctx, "alice", account.ID, usd(100)); !errors.Is(err, models.ErrAccountClosed) {
+		t.Fatalf("deposit: got %v, want ErrAccountClosed", err)
+	}
+	if _, err := db.Transfer(ctx, "alice", payout.ID, account.ID, usd(100), ""); !errors.Is(err, models.ErrAccountClosed) {
+		t.Fatalf("transfer in: got %v, want ErrAccountClosed", err)
+	}
+	if _, err := db.AdjustBalance(ctx, account.ID, usd(100)); !errors.Is(err, models.ErrAccountClosed) {
+		t.Fatalf("adjustment: got %v, want ErrAccountClosed", err)
+	}
+	if _, err := db.SetAccountStatus(ctx, account.ID, models.AccountActive); !errors.Is(err, models.ErrInvalidTransition) {
+		t.Fatalf("reopen: got %v, want ErrInvalidTransition", err)
+	}
+	if err := db.VerifyLedger(ctx); err != nil {
+		t.Fatalf("VerifyLedger: %v", err)
+	}
+}
+
+func TestCloseFrozenAccount(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	account := newTestAccount(t, db, "alice", 10000)
+	payout := &models.Account{UserID: "alice", Currency: "USD"}
+	if err := db.CreateAccount(ctx, payout); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if _, err := db.SetAccountStatus(ctx, account.ID, models.AccountFrozen); err != nil {
+		t.Fatalf("SetAccountStatus: %v", err)
+	}
+
+	// The owner cannot move money out of a frozen account by closing it
+	if _, _, err := db.CloseAccount(ctx, account.ID, payout.ID, false); !errors.Is(err, models.ErrAccountFrozen) {
+		t.Fatalf("close by the owner: got %v, want ErrAccountFrozen", err)
+	}
+	if got := balanceOf(t, db, account.ID); got != 10000 {
+		t.Fatalf("balance after a refused close = %d, want 10000", got)
+	}
+
+	// An operator can, and the payout leg debits the frozen account
+	closed, record, err := db.CloseAccount(ctx, account.ID, payout.ID, true)
+	if err != nil {
+		t.Fatalf("close by an operator: %v", err)
+	}
+	if closed.Status != models.AccountClosed || closed.Balance != 0 {
+		t.Fatalf("account = %+v, want closed with zero balance", closed)
+	}
+	if record == nil || record.Amount != 10000 || balanceOf(t, db, payout.ID) != 10000 {
+		t.Fatalf("payout = %+v, want 10000 to %s", record, payout.ID)
+	}
+
+	// Ordinary transfers out of a frozen account are still refused
+	other := newTestAccount(t, db, "bob", 500)
+	if _, err := db.SetAccountStatus(ctx, other.ID, models.AccountFrozen); err != nil {
+		t.Fatalf("SetAccountStatus: %v", err)
+	}
+	if _, err := db.Transfer(ctx, "bob", other.ID, payout.ID, usd(100), ""); !errors.Is(err, models.ErrAccountFrozen) {
+		t.Fatalf("transfer from a frozen account: got %v, want ErrAccountFrozen", err)
+	}
+	if err := db.VerifyLedger(ctx); err != nil {
+		t.Fatalf("VerifyLedger: %v", err)
+	}
+}
+
+func TestFXRates(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	if rates, err := db.ListFXRates(ctx); err != nil || len(rates) != 0 {
+		t.Fatalf("ListFXRates on a new database = %v, %v; want none", rates, err)
+	}
+	first := []fx.Rate{{From: "USD", To: "JPY", Rate: "150"}, {From: "EUR", To: "USD", Rate: "1.25"}}
+	if err := db.ReplaceFXRates(ctx, first); err != nil {
+		t.Fatalf("ReplaceFXRates: %v", err)
+	}
+	want := []fx.Rate{first[1], first[0]}
+	if rates, err := db.ListFXRates(ctx); err != nil || !slices.Equal(rates, want) {
+		t.Fatalf("ListFXRates = %v, %v; want %v", rates, err, want)
+	}
+
+	// A replacement drops the pairs it does not list
+	second := []fx.Rate{{From: "USD", To: "GBP", Rate: "0.79"}}
+	if err := db.ReplaceFXRates(ctx, second); err != nil {
+		t.Fatalf("ReplaceFXRates: %v", err)
+	}
+	if rates, err := db.ListFXRates(ctx); err != nil || !slices.Equal(rates, second) {
+		t.Fatalf("ListFXRates after a replacement = %v, %v; want %v", rates, err, second)
+	}
+}
+
+func TestAuditLogIsChainedAndAppendOnly(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	for _, action := range []string{models.AuditRegister, models.AuditLogin, models.AuditDeposit} {
+		event := &models.AuditEvent{ActorID: "alice", Action: action, TargetType: models.AuditTargetUser, TargetID: "alice"}
+		event.SetChange(map[string]any{"balance": usd(0)}, map[string]any{"balance": usd(100)})
+		if err := db.RecordAuditEvent(ctx, event); err != nil {
+			t.Fatalf("RecordAuditEvent: %v", err)
+		}
+	}
+
+	count, head, err := db.VerifyAuditChain(ctx)
+	if err != nil || count != 3 {
+		t.Fatalf("VerifyAuditChain = %d, %v; want 3 valid events", count, err)
+	}
+	events, err := db.ListAuditEvents(ctx, AuditFilter{Action: models.AuditLogin})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("ListAuditEvents = %d events, %v; want 1", len(events), err)
+	}
+	latest, err := db.ListAuditEvents(ctx, AuditFilter{Limit: 1})
+	if err != nil || latest[0].Hash != head {
+		t.Fatalf("latest hash = %v, %v; want %s", latest, err, head)
+	}
+
+	if err := db.conn.Model(&models.AuditEvent{}).Where("id = ?", events[0].ID).Update("actor_id", "mallory").Error; err == nil {
+		t.Fatal("updating an audit event succeeded")
+	}
+	if err := db.conn.Delete(&models.AuditEvent{}, events[0].ID).Error; err == nil {
+		t.Fatal("deleting an audit event succeeded")
+	}
+
+	// Tampering that bypasses the triggers is caught by the hash chain
+	drops := []string{"DROP TRIGGER audit_events_no_UPDATE", "DROP TRIGGER audit_events_no_DELETE"}
+	if db.isPostgres() {
+		drops = []string{"DROP TRIGGER audit_events_append_only ON audit_events"}
+	}
+	for _, drop := range drops {
+		if err := db.conn.Exec(drop).Error; err != nil {
+			t.Fatalf("%s: %v", drop, err)
+		}
+	}
+	if err := db.conn.Model(&models.AuditEvent{}).Where("id = ?", events[0].ID).Update("actor_id", "mallory").Error; err != nil {
+		t.Fatalf("tamper: %v", err)
+	}
+	if _, _, err := db.VerifyAuditChain(ctx); !errors.Is(err, models.ErrAuditChainBroken) {
+		t.Fatalf("VerifyAuditChain after tampering: got %v, want ErrAuditChainBroken", err)
+	}
+}
+
+func TestConcurrentAuditEventsFormOneChain(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	const workers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			event := &models.AuditEvent{ActorID: "alice", Action: models.AuditLogin, TargetType: models.AuditTargetUser, TargetID: "alice"}
+			if err := db.RecordAuditEvent(ctx, event); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("RecordAuditEvent: %v", err)
+	}
+
+	count, hash, err := db.VerifyAuditChain(ctx)
+	if err != nil || count != workers {
+		t.Fatalf("VerifyAuditChain = %d, %v; want %d valid events", count, err, workers)
+	}
+	var head auditChainHead
+	if err := db.conn.First(&head, 1).Error; err != nil || head.Hash != hash {
+		t.Fatalf("chain head = %q, %v; want %s", head.Hash, err, hash)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	cfg := newTestDBConfig(t)
+	ctx := context.Background()
+
+	if _, err := InitDB(ctx, cfg); !errors.Is(err, ErrSchemaBehind) {
+		t.Fatalf("InitDB on an empty database: got %v, want ErrSchemaBehind", err)
+	}
+
+	db, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	applied, err := db.MigrateUp(ctx)
+	if err != nil || len(applied) == 0 {
+		t.Fatalf("MigrateUp = %d migrations, %v", len(applied), err)
+	}
+	if again, err := db.MigrateUp(ctx); err != nil || len(again) != 0 {
+		t.Fatalf("second MigrateUp = %d migrations, %v; want none", len(again), err)
+	}
+	migrated, err := InitDB(ctx, cfg)
+	if err != nil {
+		t.Fatalf("InitDB after MigrateUp: %v", err)
+	}
+	migrated.Close()
+
+	// Rolling back everything and migrating again must work from any point
+	if _, err := db.MigrateDown(ctx, 1); err != nil {
+		t.Fatalf("MigrateDown(1): %v", err)
+	}
+	if err := db.CheckSchema(ctx); !errors.Is(err, ErrSchemaBehind) {
+		t.Fatalf("CheckSchema after rollback: got %v, want ErrSchemaBehind", err)
+	}
+	if rolledBack, err := db.MigrateDown(ctx, len(applied)-1); err != nil || len(rolledBack) != len(applied)-1 {
+		t.Fatalf("MigrateDown(all) = %d migrations, %v; want %d", len(rolledBack), err, len(applied)-1)
+	}
+	if db.conn.Migrator().HasTable("users") {
+		t.Fatal("users table left after rolling back every migration")
+	}
+	if reapplied, err := db.MigrateUp(ctx); err != nil || len(reapplied) != len(applied) {
+		t.Fatalf("MigrateUp after rollback = %d migrations, %v; want %d", len(reapplied), err, len(applied))
+	}
+	newTestAccount(t, db, "alice", 100)
+
+	// An applied migration that no longer matches its script, or one this build does
+	// not know, stops the server from starting
+	if err := db.conn.Exec("UPDATE schema_migrations SET checksum = 'edited' WHERE version = 1").Error; err != nil {
+		t.Fatalf("edit checksum: %v", err)
+	}
+	if err := db.CheckSchema(ctx); !errors.Is(err, ErrMigrationModified) {
+		t.Fatalf("CheckSchema with an edited migration: got %v, want ErrMigrationModified", err)
+	}
+	if err := db.conn.Exec("UPDATE schema_migrations SET checksum = ? WHERE version = 1", applied[0].Checksum).Error; err != nil {
+		t.Fatalf("restore checksum: %v", err)
+	}
+	err = db.conn.Create(&appliedMigration{Version: 9999, Name: "future", Checksum: "x", AppliedAt: time.Now()}).Error
+	if err != nil {
+		t.Fatalf("record future migration: %v", err)
+	}
+	if err := db.CheckSchema(ctx); !errors.Is(err, ErrSchemaAhead) {
+		t.Fatalf("CheckSchema with an unknown migration: got %v, want ErrSchemaAhead", err)
+	}
+}
+
+func TestMigrateFirstReleaseDatabase(t *testing.T) {
+	cfg := newTestDBConfig(t)
+	ctx := context.Background()
+	db, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	fixture, err := os.ReadFile(filepath.Join("testdata", "first_release", cfg.Driver+".sql"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	if err := db.conn.Exec(string(fixture)).Error; err != nil {
+		t.Fatalf("load fixture: %v", err)
+	}
+	applied, err := db.MigrateUp(ctx)
+	if err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	if err := db.CheckSchema(ctx); err != nil {
+		t.Fatalf("CheckSchema: %v", err)
+	}
+
+	// Existing accounts keep their ID and get the new defaults; the first release stored
+	// whole dollars, which become cents
+	accounts, err := db.GetAccountsByUserID(ctx, "alice")
+	if err != nil || len(accounts) != 1 {
+		t.Fatalf("GetAccountsByUserID = %d accounts, %v; want 1", len(accounts), err)
+	}
+	want := models.Account{
+		ID: "3810ef11-e48e-43f8-a4f5-f6cab51b8b39", UserID: "alice", Type: models.AccountChecking,
+		Status: models.AccountActive, Balance: 110000, Currency: "USD",
+	}
+	got := accounts[0]
+	got.CreatedAt, got.UpdatedAt = time.Time{}, time.Time{}
+	if got != want {
+		t.Fatalf("migrated account = %+v, want %+v", got, want)
+	}
+
+	// Rolling back to the baseline, the first release's schema, restores whole dollars,
+	// and upgrading again converts them once more
+	if _, err := db.MigrateDown(ctx, len(applied)-1); err != nil {
+		t.Fatalf("MigrateDown: %v", err)
+	}
+	var legacy int64
+	if err := db.conn.Raw("SELECT balance FROM accounts WHERE id = ?", want.ID).Scan(&legacy).Error; err != nil || legacy != 1100 {
+		t.Fatalf("balance after rolling back = %d, %v; want 1100", legacy, err)
+	}
+	if _, err := db.MigrateUp(ctx); err != nil {
+		t.Fatalf("MigrateUp after rolling back: %v", err)
+	}
+	if got := balanceOf(t, db, want.ID); got != 110000 {
+		t.Fatalf("balance after upgrading again = %d, want 110000", got)
+	}
+
+	// Users may now own several accounts, and the new user columns are usable
+	second := &models.Account{UserID: "alice", Type: models.AccountSavings, Currency: "EUR"}
+	if err := db.CreateAccount(ctx, second); err != nil {
+		t.Fatalf("CreateAccount for a user who already has one: %v", err)
+	}
+	policy := models.LoginPolicy{MaxAttempts: 3, BackoffBase: time.Second, BackoffMax: time.Minute, Lockout: time.Hour}
+	if user, err := db.RecordLoginFailure(ctx, "bob", policy); err != nil || user.FailedLoginAttempts != 1 {
+		t.Fatalf("RecordLoginFailure on a migrated user: %v", err)
+	}
+	if err := db.SetUserRoles(ctx, "bob", []string{models.RoleSupport}); err != nil {
+		t.Fatalf("SetUserRoles on a migrated user: %v", err)
+	}
+
+	// Balances from before the ledger are explained by an opening journal
+	if err := db.VerifyLedger(ctx); err != nil {
+		t.Fatalf("VerifyLedger after migration: %v", err)
+	}
+	entries, err := db.GetLedgerEntries(ctx, want.ID)
+	if err != nil || len(entries) != 1 || entries[0].Signed() != 110000 {
+		t.Fatalf("ledger of a migrated account = %+v, %v; want one credit of 110000", entries, err)
+	}
+	if recomputed, err := db.RecomputeBalance(ctx, want.ID); err != nil || recomputed.Balance != 110000 {
+		t.Fatalf("RecomputeBalance of a migrated account = %v, %v; want 110000", recomputed, err)
+	}
+	if _, err := db.Deposit(ctx, "alice", want.ID, usd(50)); err != nil {
+		t.Fatalf("Deposit to a migrated account: %v", err)
+	}
+	if got := balanceOf(t, db, want.ID); got != 110050 {
+		t.Fatalf("balance after deposit = %d, want 110050", got)
+	}
+}
+
+func TestOperationsStopWithTheirContext(t *testing.T) {
+	db := newTestDB(t)
+	newTestAccount(t, db, "alice", 100)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.GetUserByID(cancelled, "alice"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetUserByID with a cancelled context: got %v, want context.Canceled", err)
+	}
+	err := db.WithTx(cancelled, func(tx Repository) error {
+		return tx.CreateUser(cancelled, &models.User{ID: "bob", Password: "x"})
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("WithTx with a cancelled context: got %v, want context.Canceled", err)
+	}
+
+	// The query timeout applies even when the caller set no deadline
+	db.queryTimeout = time.Nanosecond
+	if _, err := db.GetUserByID(context.Background(), "alice"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetUserByID past the query timeout: got %v, want context.DeadlineExceeded", err)
+	}
+	db.queryTimeout = 0
+	if _, err := db.GetUserByID(context.Background(), "bob"); err != gorm.ErrRecordNotFound {
+		t.Fatalf("GetUserByID(bob) = %v, want gorm.ErrRecordNotFound after the cancelled transaction", err)
+	}
+}
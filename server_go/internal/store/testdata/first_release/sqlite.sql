@@ -0,0 +1,8 @@
+-- Database of the first release, as its AutoMigrate created it
+CREATE TABLE `users` (`id` text,`password` text,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`id`),CONSTRAINT `uni_users_id` UNIQUE (`id`));
+CREATE TABLE `accounts` (`id` text,`user_id` text NOT NULL,`balance` integer,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`id`),CONSTRAINT `fk_users_account` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`) ON DELETE CASCADE,CONSTRAINT `uni_accounts_user_id` UNIQUE (`user_id`));
+
+INSERT INTO users VALUES ('alice', 'x', '2025-12-09 17:51:36.326886+08:00', '2025-12-09 17:51:36.326886+08:00');
+INSERT INTO users VALUES ('bob', 'x', '2025-12-09 17:52:10.104512+08:00', '2025-12-09 17:52:10.104512+08:00');
+INSERT INTO accounts VALUES ('3810ef11-e48e-43f8-a4f5-f6cab51b8b39', 'alice', 1100, '2025-12-09 17:51:36.327366+08:00', '2025-12-09 17:58:05.180299+08:00');
+INSERT INTO accounts VALUES ('9c3b7a52-0d41-4f7e-b1a6-5e2f8d9c0a17', 'bob', 0, '2025-12-09 17:52:10.105023+08:00', '2025-12-09 17:52:10.105023+08:00');
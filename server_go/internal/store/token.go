@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"server/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// ==================== REFRESH TOKEN OPERATIONS ====================
+
+// CreateRefreshToken stores a new refresh token
+func (db *DB) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.conn.WithContext(ctx).Create(token).Error
+}
+
+// RotateRefreshToken exchanges the token with the given hash for next
+// next inherits the user and family of the presented token, which is returned
+// Presenting a token that was already rotated revokes its whole family and
+// returns models.ErrRefreshTokenReused
+func (db *DB) RotateRefreshToken(ctx context.Context, tokenHash string, next *models.RefreshToken) (*models.RefreshToken, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var current models.RefreshToken
+	reused := false
+	err := db.transaction(ctx, func(txDB *DB) error {
+		err := txDB.conn.WithContext(ctx).First(&current, "token_hash = ?", tokenHash).Error
+		if err == gorm.ErrRecordNotFound {
+			return models.ErrRefreshTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if current.RevokedAt != nil || !current.ExpiresAt.After(now) {
+			return models.ErrRefreshTokenInvalid
+		}
+
+		// Claim the token; losing this race means it was presented twice
+		res := txDB.conn.WithContext(ctx).Model(&models.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL", current.ID).
+			Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			// The revocation must be committed, so the error is reported after the transaction
+			reused = true
+			return txDB.RevokeRefreshTokenFamily(ctx, current.FamilyID)
+		}
+
+		next.UserID = current.UserID
+		next.FamilyID = current.FamilyID
+		return txDB.CreateRefreshToken(ctx, next)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, models.ErrRefreshTokenReused
+	}
+	return &current, nil
+}
+
+// RevokeRefreshTokenFamily revokes every token descended from the same login
+func (db *DB) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.conn.WithContext(ctx).Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now().UTC()).Error
+}
+
+// RevokeRefreshToken revokes the family of a refresh token owned by userID
+// Unknown tokens are ignored, so logging out never reveals whether a token exists
+func (db *DB) RevokeRefreshToken(ctx context.Context, userID, tokenHash string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var token models.RefreshToken
+	err := db.conn.WithContext(ctx).First(&token, "token_hash = ? AND user_id = ?", tokenHash, userID).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return db.RevokeRefreshTokenFamily(ctx, token.FamilyID)
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of a user
+func (db *DB) RevokeUserRefreshTokens(ctx context.Context, userID string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.conn.WithContext(ctx).Model(&models.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now().UTC()).Error
+}
+
+// PurgeExpiredRefreshTokens deletes refresh tokens that can no longer be used
+func (db *DB) PurgeExpiredRefreshTokens(ctx context.Context) (int64, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	res := db.conn.WithContext(ctx).
+		Where("expires_at <= ?", time.Now().UTC()).
+		Delete(&models.RefreshToken{})
+	return res.RowsAffected, res.Error
+}
+
+// ==================== TOKEN REVOCATION OPERATIONS ====================
+
+// CreateTokenRevocation stores a revocation of one or more access tokens
+func (db *DB) CreateTokenRevocation(ctx context.Context, revocation *models.TokenRevocation) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.conn.WithContext(ctx).Create(revocation).Error
+}
+
+// ListTokenRevocations retrieves the revocations that still affect unexpired tokens
+func (db *DB) ListTokenRevocations(ctx context.Context) ([]models.TokenRevocation, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	var revocations []models.TokenRevocation
+	err := db.conn.WithContext(ctx).Find(&revocations, "expires_at > ?", time.Now().UTC()).Error
+	if err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+// PurgeExpiredTokenRevocations deletes revocations whose tokens have all expired
+func (db *DB) PurgeExpiredTokenRevocations(ctx context.Context) (int64, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	res := db.conn.WithContext(ctx).
+		Where("expires_at <= ?", time.Now().UTC()).
+		Delete(&models.TokenRevocation{})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"server/internal/models"
+)
+
+// ==================== TRANSACTION HISTORY OPERATIONS ====================
+
+// TransactionFilter narrows down a transaction history query
+// Zero values mean "no restriction"; BeforeID is the pagination cursor
+type TransactionFilter struct {
+	Type     string
+	From     time.Time
+	To       time.Time
+	BeforeID uint
+	Limit    int
+}
+
+// recordTransaction writes the history record for a balance change that was
+// just applied to account; AccountID, BalanceAfter and Currency are filled in from account
+func (db *DB) recordTransaction(ctx context.Context, account *models.Account, record *models.Transaction) error {
+	record.AccountID = account.ID
+	record.BalanceAfter = account.Balance
+	record.Currency = account.Currency
+	return db.conn.WithContext(ctx).Create(record).Error
+}
+
+// ListTransactions retrieves an account's history, newest first
+func (db *DB) ListTransactions(ctx context.Context, accountID string, filter TransactionFilter) ([]models.Transaction, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	query := db.conn.WithContext(ctx).Where("account_id = ?", accountID)
+	if filter.Type != "" {
+		query = query.Where("type = ?", filter.Type)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To.UTC())
+	}
+	if filter.BeforeID > 0 {
+		query = query.Where("id < ?", filter.BeforeID)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var transactions []models.Transaction
+	if err := query.Order("id DESC").Find(&transactions).Error; err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
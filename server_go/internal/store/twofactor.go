@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"server/internal/models"
+)
+
+// ==================== TWO-FACTOR OPERATIONS ====================
+
+// StartTOTPEnrollment stores a new, not yet confirmed TOTP secret for a user
+// Starting again before confirming replaces the pending secret
+func (db *DB) StartTOTPEnrollment(ctx context.Context, userID, encryptedSecret string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	res := db.conn.WithContext(ctx).Model(&models.User{}).
+		Where("id = ? AND totp_enabled = ?", userID, false).
+		Updates(map[string]interface{}{"totp_secret": encryptedSecret, "totp_last_step": 0})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return models.ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// ConfirmTOTPEnrollment enables two-factor authentication once the user proved to hold
+// the pending secret with a code of the given time step, and stores the recovery codes
+func (db *DB) ConfirmTOTPEnrollment(ctx context.Context, userID string, step int64, recoveryHashes []string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	res := db.conn.WithContext(ctx).Model(&models.User{}).
+		Where("id = ? AND totp_enabled = ? AND totp_secret <> ''", userID, false).
+		Updates(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_last_step": step,
+			"recovery_codes": strings.Join(recoveryHashes, " "),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return models.ErrTwoFactorNotPending
+	}
+	return nil
+}
+
+// UseTOTPStep records that a code of the given time step was accepted
+// A step that is not newer than the last accepted one is a replayed code
+func (db *DB) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	res := db.conn.WithContext(ctx).Model(&models.User{}).
+		Where("id = ? AND totp_last_step < ?", userID, step).
+		Update("totp_last_step", step)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return models.ErrInvalidTwoFactor
+	}
+	return nil
+}
+
+// UseRecoveryCode consumes the recovery code with the given hash
+func (db *DB) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+
+	return db.transaction(ctx, func(txDB *DB) error {
+		user, err := txDB.lockUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+		hashes := user.RecoveryCodeHashes()
+		i := slices.Index(hashes, codeHash)
+		if i < 0 {
+			return models.ErrInvalidTwoFactor
+		}
+		hashes = slices.Delete(hashes, i, i+1)
+		return txDB.conn.WithContext(ctx).Model(&models.User{}).
+			Where("id = ?", userID).
+			Update("recovery_codes", strings.Join(hashes, " ")).Error
+	})
+}